@@ -1,15 +1,246 @@
 package backend
 
 import (
+	"context"
+	"os"
+	"os/user"
+	"reflect"
+	"time"
+
 	"github.com/pyrooka/envman/config"
 )
 
 // IBackend is an interface what show what should implement if you want to create a new storage service.
+//
+// Deprecated: implement IContextBackend instead. Use WithContext to use an IBackend as an IContextBackend.
 type IBackend interface {
 	Init(c *config.Config) (err error)                         // Initialize the backend.
 	List(envName string) ([]string, error)                     // Returns a list with the variables in the env or the environments in the backend if the name is empty string.
 	Get(envName string) (vars map[string]string, err error)    // Gets the variables for the environment.
 	Update(envName string, vars map[string]string) (err error) // Updates variables in the environment.
-	Delete(envName string, vars []string) (err error)          // Deletes the given variables or the full environment if an empty slice given.
+	Delete(envName string, vars []string) (err error)          // Deletes the given variables or the full environment if an empty slice given. The missing variables are skipped.
 	CleanUp() (err error)                                      // Removes all the created things.
 }
+
+// IContextBackend is the context aware version of IBackend. The calls in progress should stop when the context is done.
+type IContextBackend interface {
+	Init(ctx context.Context, c *config.Config) (err error)                         // Initialize the backend.
+	List(ctx context.Context, envName string) ([]string, error)                     // Returns a list with the variables in the env or the environments in the backend if the name is empty string.
+	Get(ctx context.Context, envName string) (vars map[string]string, err error)    // Gets the variables for the environment.
+	Update(ctx context.Context, envName string, vars map[string]string) (err error) // Updates variables in the environment.
+	Delete(ctx context.Context, envName string, vars []string) (err error)          // Deletes the given variables or the full environment if an empty slice given. The missing variables are skipped.
+	CleanUp(ctx context.Context) (err error)                                        // Removes all the created things.
+}
+
+// Unwrapper is implemented by the backends which wrap another one, like Encrypted.
+type Unwrapper interface {
+	Unwrap() IContextBackend // Returns the wrapped backend.
+}
+
+// Attacher is implemented by the backends which can use an existing storage chosen by the user.
+type Attacher interface {
+	Attach(ctx context.Context, id string) (err error) // Uses the storage with the ID from now on.
+}
+
+// Versioned is implemented by the backends which keep the earlier states of the environments.
+type Versioned interface {
+	History(ctx context.Context, envName string) (revisions []Revision, err error)                  // Returns the revisions of the environment, the newest first.
+	GetRevision(ctx context.Context, envName string, id string) (vars map[string]string, err error) // Gets the variables of the environment at the revision.
+	Replace(ctx context.Context, envName string, variables map[string]string) (err error)           // Replaces all the variables of the environment in one revision.
+}
+
+// Revision is a saved state of an environment.
+type Revision struct {
+	ID      string    // Identifies the revision for GetRevision.
+	Time    time.Time // When it was saved.
+	Message string    // Description of the change if the backend has one.
+}
+
+// Annotated is implemented by the backends which keep metadata of the variables.
+type Annotated interface {
+	GetVariables(ctx context.Context, envName string) (vars map[string]Variable, err error)    // Gets the variables of the environment with their metadata.
+	UpdateVariables(ctx context.Context, envName string, vars map[string]Variable) (err error) // Updates the variables. The backend sets the timestamps and the author, an empty description or tags keep the current ones.
+}
+
+// Variable is the value of a variable with its metadata.
+type Variable struct {
+	Value string `json:"value"`
+	VariableMetadata
+}
+
+// VariableMetadata describes a variable.
+type VariableMetadata struct {
+	Description string    `json:"description,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	Created     time.Time `json:"created"`             // When the variable was saved first.
+	Updated     time.Time `json:"updated"`             // When the variable was changed last.
+	UpdatedBy   string    `json:"updatedBy,omitempty"` // The user and the machine which changed it last, like user@host.
+}
+
+// IsZero reports whether the metadata is empty, like the metadata of the variables saved before it was kept.
+func (m VariableMetadata) IsZero() bool {
+	return m.Description == "" && len(m.Tags) == 0 && m.Created.IsZero() && m.Updated.IsZero() && m.UpdatedBy == ""
+}
+
+// Returns the metadata of the variable after it is saved with the new value. Only the changes are counted,
+// so saving the same value again keeps the timestamps.
+func annotate(current *Variable, variable Variable, now time.Time) (metadata VariableMetadata) {
+	if current != nil {
+		metadata = current.VariableMetadata
+	}
+	if variable.Description != "" {
+		metadata.Description = variable.Description
+	}
+	if variable.Tags != nil {
+		metadata.Tags = variable.Tags
+	}
+
+	if current != nil && current.Value == variable.Value && current.Description == metadata.Description &&
+		equalTags(current.Tags, metadata.Tags) {
+		return
+	}
+
+	if metadata.Created.IsZero() {
+		metadata.Created = now
+	}
+	metadata.Updated = now
+	metadata.UpdatedBy = author()
+
+	return
+}
+
+// Checks if the tags are the same.
+func equalTags(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the current user and machine as user@host.
+func author() string {
+	name := "unknown"
+	if currentUser, err := user.Current(); err == nil {
+		name = currentUser.Username
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return name
+	}
+
+	return name + "@" + hostname
+}
+
+// Revalidator is implemented by the backends which can tell if the storage changed since a version,
+// so the cached environments can be used. The version is an opaque string, like an ETag.
+type Revalidator interface {
+	Revalidate(ctx context.Context, version string) (current string, changed bool, err error) // Returns the current version.
+}
+
+// As finds the first backend in the chain of the wrapped backends which implements the interface
+// the target points to, and sets the target to it. Works like errors.As.
+func As(b IContextBackend, target interface{}) bool {
+	targetValue := reflect.ValueOf(target)
+	if targetValue.Kind() != reflect.Ptr || targetValue.IsNil() {
+		panic("backend: As target must be a non-nil pointer")
+	}
+	targetType := targetValue.Type().Elem()
+
+	for b != nil {
+		if reflect.TypeOf(b).AssignableTo(targetType) {
+			targetValue.Elem().Set(reflect.ValueOf(b))
+			return true
+		}
+
+		unwrapper, ok := b.(Unwrapper)
+		if !ok {
+			break
+		}
+		b = unwrapper.Unwrap()
+	}
+
+	return false
+}
+
+// Adapter from IBackend to IContextBackend.
+type contextAdapter struct {
+	backend IBackend
+}
+
+// WithContext wraps an IBackend, so it can be used as an IContextBackend. A call in progress cannot be stopped,
+// because the wrapped backend doesn't know about the context. It is checked before every call instead.
+func WithContext(b IBackend) IContextBackend {
+	return &contextAdapter{backend: b}
+}
+
+// Init checks the context and initializes the wrapped backend.
+func (a *contextAdapter) Init(ctx context.Context, c *config.Config) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	err = a.backend.Init(c)
+
+	return
+}
+
+// List checks the context and lists with the wrapped backend.
+func (a *contextAdapter) List(ctx context.Context, envName string) (result []string, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	result, err = a.backend.List(envName)
+
+	return
+}
+
+// Get checks the context and gets the variables with the wrapped backend.
+func (a *contextAdapter) Get(ctx context.Context, envName string) (vars map[string]string, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	vars, err = a.backend.Get(envName)
+
+	return
+}
+
+// Update checks the context and updates the variables with the wrapped backend.
+func (a *contextAdapter) Update(ctx context.Context, envName string, vars map[string]string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	err = a.backend.Update(envName, vars)
+
+	return
+}
+
+// Delete checks the context and deletes with the wrapped backend.
+func (a *contextAdapter) Delete(ctx context.Context, envName string, vars []string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	err = a.backend.Delete(envName, vars)
+
+	return
+}
+
+// CleanUp checks the context and cleans up the wrapped backend.
+func (a *contextAdapter) CleanUp(ctx context.Context) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	err = a.backend.CleanUp()
+
+	return
+}
@@ -0,0 +1,41 @@
+package backend_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pyrooka/envman/backend"
+	"github.com/pyrooka/envman/config"
+)
+
+// Returns a config with the section of the backend.
+func sectionConfig(t *testing.T, name string, section interface{}) *config.Config {
+	t.Helper()
+
+	raw, err := json.Marshal(section)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &config.Config{Backends: map[string]json.RawMessage{name: raw}}
+}
+
+func TestAs(t *testing.T) {
+	local := &backend.Local{}
+	encrypted := &backend.Encrypted{Backend: local}
+
+	var versioned backend.Versioned
+	if !backend.As(encrypted, &versioned) || versioned != backend.Versioned(encrypted) {
+		t.Errorf("as versioned: %v, want the outermost one", versioned)
+	}
+
+	var found *backend.Local
+	if !backend.As(encrypted, &found) || found != local {
+		t.Errorf("as local: %v, want the wrapped one", found)
+	}
+
+	var attacher backend.Attacher
+	if backend.As(encrypted, &attacher) {
+		t.Errorf("as attacher: %v, want none", attacher)
+	}
+}
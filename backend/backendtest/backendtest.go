@@ -0,0 +1,246 @@
+// Package backendtest checks a backend against the contract of the backend interface.
+//
+// Use it from a test of the backend:
+//
+//	func TestLocal(t *testing.T) {
+//		backendtest.Run(t, func(t *testing.T) backend.IContextBackend {
+//			return backendtest.Init(t, &backend.Local{}, &config.Config{})
+//		})
+//	}
+//
+// An old IBackend can be checked with backend.WithContext.
+package backendtest
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/pyrooka/envman/backend"
+	"github.com/pyrooka/envman/config"
+)
+
+// Factory returns an initialized backend with an empty storage. Called for every check.
+type Factory func(t *testing.T) backend.IContextBackend
+
+// Init initializes the backend with the config and stops the test if it fails.
+func Init(t *testing.T, b backend.IContextBackend, c *config.Config) backend.IContextBackend {
+	t.Helper()
+
+	if err := b.Init(context.Background(), c); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+
+	return b
+}
+
+// Run runs the checks against the backends created by the factory.
+func Run(t *testing.T, factory Factory) {
+	checks := []struct {
+		name  string
+		check func(t *testing.T, ctx context.Context, b backend.IContextBackend)
+	}{
+		{"ListEmpty", checkListEmpty},
+		{"ListEnvironmentsAndVariables", checkList},
+		{"GetMissing", checkGetMissing},
+		{"UpdateMerges", checkUpdateMerges},
+		{"UpdateKeepsValues", checkUpdateKeepsValues},
+		{"DeleteVariables", checkDeleteVariables},
+		{"DeleteMissingVariable", checkDeleteMissingVariable},
+		{"DeleteEnvironment", checkDeleteEnvironment},
+		{"DeleteMissingEnvironment", checkDeleteMissingEnvironment},
+		{"CleanUp", checkCleanUp},
+	}
+
+	for _, c := range checks {
+		check := c.check
+		t.Run(c.name, func(t *testing.T) {
+			check(t, context.Background(), factory(t))
+		})
+	}
+}
+
+//-------------------------------------------------------------------
+//  Checks
+//-------------------------------------------------------------------
+
+// List of an empty name returns the environments, none in an empty storage.
+func checkListEmpty(t *testing.T, ctx context.Context, b backend.IContextBackend) {
+	envs, err := b.List(ctx, "")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(envs) != 0 {
+		t.Errorf("list of an empty storage: %v, want none", envs)
+	}
+}
+
+// List of an empty name returns the environments, list of an environment returns its variables.
+func checkList(t *testing.T, ctx context.Context, b backend.IContextBackend) {
+	mustUpdate(t, ctx, b, "dev", map[string]string{"A": "1", "B": "2"})
+	mustUpdate(t, ctx, b, "prod", map[string]string{"C": "3"})
+
+	envs, err := b.List(ctx, "")
+	if err != nil || !equal(envs, []string{"dev", "prod"}) {
+		t.Errorf("list environments: %v, %v, want [dev prod]", envs, err)
+	}
+
+	names, err := b.List(ctx, "dev")
+	if err != nil || !equal(names, []string{"A", "B"}) {
+		t.Errorf("list variables: %v, %v, want [A B]", names, err)
+	}
+}
+
+// Get and List of a missing environment return ErrEnvNotFound.
+func checkGetMissing(t *testing.T, ctx context.Context, b backend.IContextBackend) {
+	if vars, err := b.Get(ctx, "missing"); !errors.Is(err, backend.ErrEnvNotFound) {
+		t.Errorf("get missing environment: %v, %v, want ErrEnvNotFound", vars, err)
+	}
+	if names, err := b.List(ctx, "missing"); !errors.Is(err, backend.ErrEnvNotFound) {
+		t.Errorf("list missing environment: %v, %v, want ErrEnvNotFound", names, err)
+	}
+}
+
+// Update adds new variables and overwrites the existing ones, the others are kept.
+func checkUpdateMerges(t *testing.T, ctx context.Context, b backend.IContextBackend) {
+	mustUpdate(t, ctx, b, "dev", map[string]string{"A": "1", "B": "2"})
+	mustUpdate(t, ctx, b, "dev", map[string]string{"B": "changed", "C": "3"})
+
+	expectVars(t, ctx, b, "dev", map[string]string{"A": "1", "B": "changed", "C": "3"})
+}
+
+// The values are stored as they are.
+func checkUpdateKeepsValues(t *testing.T, ctx context.Context, b backend.IContextBackend) {
+	vars := map[string]string{
+		"SPACES":  "  leading and trailing  ",
+		"QUOTES":  `'single' "double" ` + "`back`",
+		"NEWLINE": "first\nsecond",
+		"SHELL":   "$HOME ${PATH} $(id) ; & | < > # !",
+		"UNICODE": "árvíztűrő tükörfúrógép ✓",
+	}
+	mustUpdate(t, ctx, b, "dev", vars)
+
+	expectVars(t, ctx, b, "dev", vars)
+}
+
+// Delete removes only the given variables.
+func checkDeleteVariables(t *testing.T, ctx context.Context, b backend.IContextBackend) {
+	mustUpdate(t, ctx, b, "dev", map[string]string{"A": "1", "B": "2", "C": "3"})
+
+	if err := b.Delete(ctx, "dev", []string{"A", "C"}); err != nil {
+		t.Fatalf("delete variables: %v", err)
+	}
+
+	expectVars(t, ctx, b, "dev", map[string]string{"B": "2"})
+}
+
+// Delete skips the missing variables and deletes the others.
+func checkDeleteMissingVariable(t *testing.T, ctx context.Context, b backend.IContextBackend) {
+	mustUpdate(t, ctx, b, "dev", map[string]string{"A": "1", "B": "2"})
+
+	if err := b.Delete(ctx, "dev", []string{"A", "missing"}); err != nil {
+		t.Errorf("delete missing variable: %v, want no error", err)
+	}
+	expectVars(t, ctx, b, "dev", map[string]string{"B": "2"})
+
+	if err := b.Delete(ctx, "dev", []string{"missing"}); err != nil {
+		t.Errorf("delete only missing variables: %v, want no error", err)
+	}
+	expectVars(t, ctx, b, "dev", map[string]string{"B": "2"})
+}
+
+// Delete with an empty slice removes the whole environment, the others are kept.
+func checkDeleteEnvironment(t *testing.T, ctx context.Context, b backend.IContextBackend) {
+	mustUpdate(t, ctx, b, "dev", map[string]string{"A": "1"})
+	mustUpdate(t, ctx, b, "prod", map[string]string{"B": "2"})
+
+	if err := b.Delete(ctx, "dev", []string{}); err != nil {
+		t.Fatalf("delete environment: %v", err)
+	}
+
+	if _, err := b.Get(ctx, "dev"); !errors.Is(err, backend.ErrEnvNotFound) {
+		t.Errorf("get deleted environment: %v, want ErrEnvNotFound", err)
+	}
+	if envs, err := b.List(ctx, ""); err != nil || !equal(envs, []string{"prod"}) {
+		t.Errorf("list environments: %v, %v, want [prod]", envs, err)
+	}
+	expectVars(t, ctx, b, "prod", map[string]string{"B": "2"})
+}
+
+// Delete of a missing environment returns ErrEnvNotFound.
+func checkDeleteMissingEnvironment(t *testing.T, ctx context.Context, b backend.IContextBackend) {
+	if err := b.Delete(ctx, "missing", []string{}); !errors.Is(err, backend.ErrEnvNotFound) {
+		t.Errorf("delete missing environment: %v, want ErrEnvNotFound", err)
+	}
+	if err := b.Delete(ctx, "missing", []string{"A"}); !errors.Is(err, backend.ErrEnvNotFound) {
+		t.Errorf("delete variable of missing environment: %v, want ErrEnvNotFound", err)
+	}
+}
+
+// CleanUp removes all the environments.
+func checkCleanUp(t *testing.T, ctx context.Context, b backend.IContextBackend) {
+	mustUpdate(t, ctx, b, "dev", map[string]string{"A": "1"})
+	mustUpdate(t, ctx, b, "prod", map[string]string{"B": "2"})
+
+	if err := b.CleanUp(ctx); err != nil {
+		t.Fatalf("cleanup: %v", err)
+	}
+
+	// Some backends remove their storage too (e.g. the git repository), the list still works without it.
+	if envs, err := b.List(ctx, ""); err != nil || len(envs) != 0 {
+		t.Errorf("list after cleanup: %v, %v, want none", envs, err)
+	}
+}
+
+//-------------------------------------------------------------------
+//  Helper functions
+//-------------------------------------------------------------------
+
+// Updates the environment and stops the test if it fails.
+func mustUpdate(t *testing.T, ctx context.Context, b backend.IContextBackend, envName string, vars map[string]string) {
+	t.Helper()
+
+	if err := b.Update(ctx, envName, vars); err != nil {
+		t.Fatalf("update %v: %v", envName, err)
+	}
+}
+
+// Checks the variables of the environment.
+func expectVars(t *testing.T, ctx context.Context, b backend.IContextBackend, envName string, expected map[string]string) {
+	t.Helper()
+
+	vars, err := b.Get(ctx, envName)
+	if err != nil {
+		t.Fatalf("get %v: %v", envName, err)
+	}
+
+	if len(vars) != len(expected) {
+		t.Errorf("get %v: %v, want %v", envName, vars, expected)
+		return
+	}
+	for key, value := range expected {
+		if actual, exists := vars[key]; !exists || actual != value {
+			t.Errorf("get %v: %v = %q, want %q", envName, key, actual, value)
+		}
+	}
+}
+
+// Checks if the two lists have the same elements.
+func equal(a []string, b []string) bool {
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,550 @@
+package backend
+
+// Offline read cache. Wraps any other backend and keeps the last known environments in an encrypted
+// file, so they can be listed and loaded without the network. The wrapped backend is initialized
+// only when it is needed.
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pyrooka/envman/config"
+)
+
+// Cache related constants.
+const (
+	cacheDefaultDir = ".envman-cache"
+	cacheKeyLen     = 32
+	defaultMaxAge   = time.Minute // Short, so the changes of the other machines show up soon.
+	defaultMaxStale = 7 * 24 * time.Hour
+)
+
+//-------------------------------------------------------------------
+// Structs
+//-------------------------------------------------------------------
+
+// Cached wraps another backend and serves List and Get from a cache file when the backend
+// is unreachable. The settings not set directly are read from the cache section of the config.
+type Cached struct {
+	Backend  IContextBackend
+	Name     string        // Name of the backend, the name of the cache file.
+	Path     string        // Directory of the cache files. ~/.envman-cache is used if empty.
+	MaxAge   time.Duration // The environments are used without asking the backend until this age. A minute by default.
+	MaxStale time.Duration // The environments are used until this age if the backend is unreachable. A week by default.
+	Key      []byte        // AES-256 key of the cache file.
+
+	config      *config.Config // For the initialization of the wrapped backend.
+	initialized bool           // The wrapped backend is initialized.
+	revalidated bool           // The cache was revalidated in this session.
+	upToDate    bool           // The backend said the cached version is the current one.
+	data        *cacheData
+}
+
+// Content of the cache file.
+type cacheData struct {
+	Version string                 `json:"version"` // Version of the storage if the backend is a Revalidator.
+	Envs    *cacheEntry            `json:"envs"`    // Names of the environments.
+	Vars    map[string]*cacheEntry `json:"vars"`    // Variables by environment.
+}
+
+// A cached result with the time it was fetched from the backend.
+type cacheEntry struct {
+	Names     []string          `json:"names,omitempty"`
+	Vars      map[string]string `json:"vars,omitempty"`
+	FetchedAt time.Time         `json:"fetchedAt"`
+}
+
+//-------------------------------------------------------------------
+//  Helper functions
+//-------------------------------------------------------------------
+
+// Parses a duration of the config. Returns the default if empty.
+func parseCacheAge(name string, value string, defaultAge time.Duration) (age time.Duration, err error) {
+	if value == "" {
+		return defaultAge, nil
+	}
+
+	age, err = time.ParseDuration(value)
+	if err != nil {
+		err = fmt.Errorf("invalid cache %v: %v", name, err)
+	}
+
+	return
+}
+
+// Checks if the error means the backend is unreachable, e.g. the network is down or it didn't respond in time.
+func isUnreachable(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && !errors.Is(err, context.Canceled)
+}
+
+// Returns the path of the cache file.
+func (c *Cached) filePath() string {
+	return filepath.Join(c.Path, c.Name)
+}
+
+// Creates the AES-GCM cipher with the key.
+func (c *Cached) cipher() (aead cipher.AEAD, err error) {
+	block, err := aes.NewCipher(c.Key)
+	if err != nil {
+		return
+	}
+
+	aead, err = cipher.NewGCM(block)
+
+	return
+}
+
+// Reads the cache file. A missing file is an empty cache. An unreadable one (e.g. encrypted with another key)
+// is an empty cache too with a warning, it is overwritten by the next save.
+func (c *Cached) load() {
+	c.data = &cacheData{}
+
+	encrypted, err := ioutil.ReadFile(c.filePath())
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: cannot read the cache, starting with an empty one: %v\n", err)
+		return
+	}
+	aead, err := c.cipher()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: invalid cache key, starting with an empty cache: %v\n", err)
+		return
+	}
+
+	// The name of the backend is authenticated too, so the files cannot be swapped.
+	var plain []byte
+	if len(encrypted) >= aead.NonceSize() {
+		plain, err = aead.Open(nil, encrypted[:aead.NonceSize()], encrypted[aead.NonceSize():], []byte(c.Name))
+	}
+	if len(encrypted) < aead.NonceSize() || err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: cannot decrypt the cache %v, the key in the config changed? Starting with an empty cache.\n", c.filePath())
+		return
+	}
+
+	data := &cacheData{}
+	if err = json.Unmarshal(plain, data); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: invalid cache %v, starting with an empty cache: %v\n", c.filePath(), err)
+		return
+	}
+	c.data = data
+}
+
+// Writes the cache file. Writes a temporary file first, then renames it, so the parallel runs
+// never see a half written file.
+func (c *Cached) save() (err error) {
+	plain, err := json.Marshal(c.data)
+	if err != nil {
+		return
+	}
+
+	aead, err := c.cipher()
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	encrypted := aead.Seal(nonce, nonce, plain, []byte(c.Name))
+
+	if err = os.MkdirAll(c.Path, 0700); err != nil {
+		return
+	}
+	file, err := ioutil.TempFile(c.Path, "."+c.Name+"-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(encrypted)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(file.Name(), c.filePath())
+
+	return
+}
+
+// Initializes the wrapped backend at the first call.
+func (c *Cached) initBackend(ctx context.Context) (err error) {
+	if c.initialized {
+		return
+	}
+
+	if err = c.Backend.Init(ctx, c.config); err != nil {
+		return
+	}
+	c.initialized = true
+
+	return
+}
+
+// Initializes the wrapped backend and checks once per session if the storage changed since the cached version.
+// If changed, all the entries are dropped.
+func (c *Cached) revalidate(ctx context.Context) (err error) {
+	if err = c.initBackend(ctx); err != nil || c.revalidated {
+		return
+	}
+
+	var revalidator Revalidator
+	if !As(c.Backend, &revalidator) {
+		c.revalidated = true
+		return
+	}
+
+	current, changed, err := revalidator.Revalidate(ctx, c.data.Version)
+	if err != nil {
+		return
+	}
+	c.revalidated = true
+
+	if changed {
+		c.data = &cacheData{}
+	} else {
+		// Everything is up to date.
+		c.upToDate = true
+		now := time.Now()
+		if c.data.Envs != nil {
+			c.data.Envs.FetchedAt = now
+		}
+		for _, entry := range c.data.Vars {
+			entry.FetchedAt = now
+		}
+	}
+	c.data.Version = current
+
+	err = c.save()
+
+	return
+}
+
+// Returns the entry if it is younger than the age.
+func usable(entry *cacheEntry, age time.Duration) bool {
+	return entry != nil && time.Since(entry.FetchedAt) <= age
+}
+
+// Returns the cached entry or fetches it from the backend. The stale entry is used if the backend is unreachable.
+func (c *Cached) entry(ctx context.Context, cached *cacheEntry, fetch func() (*cacheEntry, error)) (entry *cacheEntry, err error) {
+	if usable(cached, c.MaxAge) {
+		return cached, nil
+	}
+
+	if err = c.revalidate(ctx); err == nil {
+		if cached != nil && c.upToDate {
+			return cached, nil
+		}
+		entry, err = fetch()
+	}
+
+	if isUnreachable(err) && usable(cached, c.MaxStale) {
+		fmt.Fprintf(os.Stderr, "Warning: the backend is unreachable, using the cache from %v.\n", cached.FetchedAt.Local().Format("2006-01-02 15:04:05"))
+		return cached, nil
+	}
+
+	return
+}
+
+// Drops the cached entries of the environment after a change.
+func (c *Cached) invalidate(envName string) (err error) {
+	delete(c.data.Vars, envName)
+	c.data.Envs = nil
+	// Our change is a new version too.
+	c.data.Version = ""
+
+	err = c.save()
+
+	return
+}
+
+// Unwrap returns the wrapped backend.
+func (c *Cached) Unwrap() IContextBackend {
+	return c.Backend
+}
+
+//-------------------------------------------------------------------
+//  Interface functions
+//-------------------------------------------------------------------
+
+// Init reads the settings and the cache file. The wrapped backend is initialized by the first call which needs it.
+func (c *Cached) Init(ctx context.Context, conf *config.Config) (err error) {
+	c.config = conf
+
+	if c.MaxAge == 0 {
+		if c.MaxAge, err = parseCacheAge("maxAge", conf.Cache.MaxAge, defaultMaxAge); err != nil {
+			return
+		}
+	}
+	if c.MaxStale == 0 {
+		if c.MaxStale, err = parseCacheAge("maxStale", conf.Cache.MaxStale, defaultMaxStale); err != nil {
+			return
+		}
+	}
+
+	if c.Key == nil {
+		if conf.Cache.Key == "" {
+			// The config holds the credentials of the backends anyway.
+			key := make([]byte, cacheKeyLen)
+			if _, err = rand.Read(key); err != nil {
+				return
+			}
+			conf.Cache.Key = base64.StdEncoding.EncodeToString(key)
+		}
+		if c.Key, err = base64.StdEncoding.DecodeString(conf.Cache.Key); err != nil {
+			return fmt.Errorf("invalid cache key: %v", err)
+		}
+	}
+
+	if c.Path == "" {
+		currentUser, err := user.Current()
+		if err != nil {
+			return err
+		}
+		c.Path = filepath.Join(currentUser.HomeDir, cacheDefaultDir)
+	}
+
+	c.load()
+
+	return
+}
+
+// List returns the name of environments or variables. The variables are listed from the cached environment.
+func (c *Cached) List(ctx context.Context, envName string) (result []string, err error) {
+	if envName != "" {
+		vars, err := c.Get(ctx, envName)
+		if err != nil {
+			return nil, err
+		}
+		for key := range vars {
+			result = append(result, key)
+		}
+		sort.Strings(result)
+		return result, nil
+	}
+
+	entry, err := c.entry(ctx, c.data.Envs, func() (entry *cacheEntry, err error) {
+		names, err := c.Backend.List(ctx, "")
+		if err != nil {
+			return
+		}
+		entry = &cacheEntry{Names: names, FetchedAt: time.Now()}
+		c.data.Envs = entry
+		err = c.save()
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	result = append(result, entry.Names...)
+
+	return
+}
+
+// Get returns the environment variables with its values.
+func (c *Cached) Get(ctx context.Context, envName string) (vars map[string]string, err error) {
+	entry, err := c.entry(ctx, c.data.Vars[envName], func() (entry *cacheEntry, err error) {
+		vars, err := c.Backend.Get(ctx, envName)
+		if errors.Is(err, ErrEnvNotFound) {
+			// Deleted by another machine.
+			if saveErr := c.invalidate(envName); saveErr != nil {
+				return nil, saveErr
+			}
+		}
+		if err != nil {
+			return
+		}
+		// A copy, so the changes of the backend in the same process don't show up in the cache.
+		entry = &cacheEntry{Vars: make(map[string]string, len(vars)), FetchedAt: time.Now()}
+		for key, value := range vars {
+			entry.Vars[key] = value
+		}
+		if c.data.Vars == nil {
+			c.data.Vars = map[string]*cacheEntry{}
+		}
+		c.data.Vars[envName] = entry
+		err = c.save()
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	// A copy, so the caller cannot change the cache.
+	vars = map[string]string{}
+	for key, value := range entry.Vars {
+		vars[key] = value
+	}
+
+	return
+}
+
+// Update saves the variables with the wrapped backend and drops the cached environment.
+func (c *Cached) Update(ctx context.Context, envName string, variables map[string]string) (err error) {
+	if err = c.initBackend(ctx); err != nil {
+		return
+	}
+	if err = c.Backend.Update(ctx, envName, variables); err != nil {
+		return
+	}
+
+	err = c.invalidate(envName)
+
+	return
+}
+
+// Delete removes the environment or the variables with the wrapped backend and drops the cached environment.
+func (c *Cached) Delete(ctx context.Context, envName string, envVars []string) (err error) {
+	if err = c.initBackend(ctx); err != nil {
+		return
+	}
+	if err = c.Backend.Delete(ctx, envName, envVars); err != nil {
+		return
+	}
+
+	err = c.invalidate(envName)
+
+	return
+}
+
+// Attach attaches the wrapped backend to the storage and drops the cache.
+func (c *Cached) Attach(ctx context.Context, id string) (err error) {
+	if err = c.initBackend(ctx); err != nil {
+		return
+	}
+
+	var attacher Attacher
+	if !As(c.Backend, &attacher) {
+		return fmt.Errorf("%w: attach", ErrNotSupported)
+	}
+	if err = attacher.Attach(ctx, id); err != nil {
+		return
+	}
+
+	c.data = &cacheData{}
+	err = c.save()
+
+	return
+}
+
+// CleanUp cleans up the wrapped backend and removes the cache file.
+func (c *Cached) CleanUp(ctx context.Context) (err error) {
+	if err = c.initBackend(ctx); err != nil {
+		return
+	}
+	if err = c.Backend.CleanUp(ctx); err != nil {
+		return
+	}
+
+	c.data = &cacheData{}
+	err = os.Remove(c.filePath())
+	if os.IsNotExist(err) {
+		err = nil
+	}
+
+	return
+}
+
+// History returns the revisions of the wrapped backend. The history is not cached.
+func (c *Cached) History(ctx context.Context, envName string) (revisions []Revision, err error) {
+	if err = c.initBackend(ctx); err != nil {
+		return
+	}
+
+	var versioned Versioned
+	if !As(c.Backend, &versioned) {
+		return nil, fmt.Errorf("%w: history", ErrNotSupported)
+	}
+
+	revisions, err = versioned.History(ctx, envName)
+
+	return
+}
+
+// GetRevision gets the revision from the wrapped backend.
+func (c *Cached) GetRevision(ctx context.Context, envName string, id string) (vars map[string]string, err error) {
+	if err = c.initBackend(ctx); err != nil {
+		return
+	}
+
+	var versioned Versioned
+	if !As(c.Backend, &versioned) {
+		return nil, fmt.Errorf("%w: history", ErrNotSupported)
+	}
+
+	vars, err = versioned.GetRevision(ctx, envName, id)
+
+	return
+}
+
+// Replace replaces the variables of the environment with the wrapped backend and drops the cached environment.
+func (c *Cached) Replace(ctx context.Context, envName string, variables map[string]string) (err error) {
+	if err = c.initBackend(ctx); err != nil {
+		return
+	}
+
+	var versioned Versioned
+	if !As(c.Backend, &versioned) {
+		return fmt.Errorf("%w: history", ErrNotSupported)
+	}
+	if err = versioned.Replace(ctx, envName, variables); err != nil {
+		return
+	}
+
+	err = c.invalidate(envName)
+
+	return
+}
+
+// GetVariables gets the variables with their metadata from the wrapped backend. The metadata is not cached.
+func (c *Cached) GetVariables(ctx context.Context, envName string) (vars map[string]Variable, err error) {
+	if err = c.initBackend(ctx); err != nil {
+		return
+	}
+
+	var annotated Annotated
+	if !As(c.Backend, &annotated) {
+		return nil, fmt.Errorf("%w: metadata", ErrNotSupported)
+	}
+
+	vars, err = annotated.GetVariables(ctx, envName)
+
+	return
+}
+
+// UpdateVariables updates the variables with their metadata with the wrapped backend and drops the cached environment.
+func (c *Cached) UpdateVariables(ctx context.Context, envName string, variables map[string]Variable) (err error) {
+	if err = c.initBackend(ctx); err != nil {
+		return
+	}
+
+	var annotated Annotated
+	if !As(c.Backend, &annotated) {
+		return fmt.Errorf("%w: metadata", ErrNotSupported)
+	}
+	if err = annotated.UpdateVariables(ctx, envName, variables); err != nil {
+		return
+	}
+
+	err = c.invalidate(envName)
+
+	return
+}
@@ -0,0 +1,211 @@
+package backend_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pyrooka/envman/backend"
+	"github.com/pyrooka/envman/backend/backendtest"
+	"github.com/pyrooka/envman/config"
+)
+
+// Wraps a backend and fails all the calls with the error if it is set.
+// Initializes the wrapped backend only once, so it keeps its state between the sessions of the cache.
+type switchableBackend struct {
+	backend.IContextBackend
+	err         error
+	initialized bool
+}
+
+func (s *switchableBackend) Init(ctx context.Context, c *config.Config) (err error) {
+	if s.err != nil || s.initialized {
+		return s.err
+	}
+	s.initialized = true
+
+	return s.IContextBackend.Init(ctx, c)
+}
+
+func (s *switchableBackend) List(ctx context.Context, envName string) ([]string, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.IContextBackend.List(ctx, envName)
+}
+
+func (s *switchableBackend) Get(ctx context.Context, envName string) (map[string]string, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.IContextBackend.Get(ctx, envName)
+}
+
+// The network is down.
+var errUnreachable = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+// Returns a new session of the cache in the directory.
+func newTestCached(t *testing.T, b backend.IContextBackend, dir string, key []byte, maxAge time.Duration, maxStale time.Duration) *backend.Cached {
+	cached := &backend.Cached{Backend: b, Name: "test", Path: dir, Key: key, MaxAge: maxAge, MaxStale: maxStale}
+	backendtest.Init(t, cached, &config.Config{})
+
+	return cached
+}
+
+func TestCached(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.IContextBackend {
+		return backendtest.Init(t, &backend.Cached{Backend: &backend.Local{}, Name: "local", Path: t.TempDir()}, &config.Config{})
+	})
+}
+
+func TestCachedDefaults(t *testing.T) {
+	cached := &backend.Cached{Backend: &backend.Local{}, Name: "local", Path: t.TempDir()}
+	c := &config.Config{}
+	backendtest.Init(t, cached, c)
+
+	if cached.MaxAge != time.Minute || cached.MaxStale != 7*24*time.Hour {
+		t.Errorf("ages: %v and %v, want 1m and 168h", cached.MaxAge, cached.MaxStale)
+	}
+	if c.Cache.Key == "" || len(cached.Key) != 32 {
+		t.Errorf("key: %q, want a generated key in the config", c.Cache.Key)
+	}
+
+	// Zero in the config asks the backend every time.
+	cached = &backend.Cached{Backend: &backend.Local{}, Name: "local", Path: t.TempDir()}
+	backendtest.Init(t, cached, &config.Config{Cache: config.CacheConfig{MaxAge: "0s"}})
+	if cached.MaxAge != 0 {
+		t.Errorf("max age: %v, want 0", cached.MaxAge)
+	}
+}
+
+func TestCachedStale(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{1}, 32)
+	b := &switchableBackend{IContextBackend: &backend.Local{}}
+
+	cached := newTestCached(t, b, dir, key, time.Nanosecond, time.Hour)
+	if err := cached.Update(ctx, "dev", map[string]string{"A": "1"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if _, err := cached.Get(ctx, "dev"); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	// The stale cache is used if the backend is unreachable.
+	b.err = errUnreachable
+	stderr := captureStderr(t)
+	cached = newTestCached(t, b, dir, key, time.Nanosecond, time.Hour)
+	if vars, err := cached.Get(ctx, "dev"); err != nil || vars["A"] != "1" {
+		t.Errorf("get from the stale cache: %v, %v, want A=1", vars, err)
+	}
+	if output := stderr(); !strings.Contains(output, "the backend is unreachable") {
+		t.Errorf("output: %q, want a warning", output)
+	}
+
+	// Too old.
+	cached = newTestCached(t, b, dir, key, time.Nanosecond, time.Nanosecond)
+	if _, err := cached.Get(ctx, "dev"); !errors.Is(err, errUnreachable) {
+		t.Errorf("get from a too old cache: %v, want the network error", err)
+	}
+
+	// Only the network errors fall back to the cache.
+	b.err = backend.ErrUnauthorized
+	cached = newTestCached(t, b, dir, key, time.Nanosecond, time.Hour)
+	if _, err := cached.Get(ctx, "dev"); !errors.Is(err, backend.ErrUnauthorized) {
+		t.Errorf("get with an invalid token: %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestCachedKeyMismatch(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{1}, 32)
+	b := &switchableBackend{IContextBackend: &backend.Local{}}
+
+	cached := newTestCached(t, b, dir, key, time.Nanosecond, time.Hour)
+	if err := cached.Update(ctx, "dev", map[string]string{"A": "1"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if _, err := cached.Get(ctx, "dev"); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	b.err = errUnreachable
+
+	// The file cannot be decrypted with another key, so there is nothing to fall back to.
+	stderr := captureStderr(t)
+	cached = newTestCached(t, b, dir, bytes.Repeat([]byte{2}, 32), time.Nanosecond, time.Hour)
+	if output := stderr(); !strings.Contains(output, "cannot decrypt the cache") {
+		t.Errorf("output: %q, want a warning", output)
+	}
+	if _, err := cached.Get(ctx, "dev"); !errors.Is(err, errUnreachable) {
+		t.Errorf("get with another key: %v, want the network error", err)
+	}
+
+	// The file is still there for the right key.
+	cached = newTestCached(t, b, dir, key, time.Nanosecond, time.Hour)
+	if vars, err := cached.Get(ctx, "dev"); err != nil || vars["A"] != "1" {
+		t.Errorf("get with the key: %v, %v, want A=1", vars, err)
+	}
+}
+
+func TestCachedInvalidate(t *testing.T) {
+	ctx := context.Background()
+	local := &backend.Local{}
+	b := &switchableBackend{IContextBackend: local}
+	cached := newTestCached(t, b, t.TempDir(), bytes.Repeat([]byte{1}, 32), time.Hour, time.Hour)
+
+	if err := cached.Update(ctx, "dev", map[string]string{"A": "1"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if _, err := cached.Get(ctx, "dev"); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if _, err := cached.List(ctx, ""); err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	// Changed by someone else: the cache is used within the max age.
+	if err := local.Update(ctx, "dev", map[string]string{"A": "2"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := local.Update(ctx, "prod", map[string]string{"C": "3"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if vars, err := cached.Get(ctx, "dev"); err != nil || vars["A"] != "1" {
+		t.Errorf("get within the max age: %v, %v, want the cached A=1", vars, err)
+	}
+	if envs, err := cached.List(ctx, ""); err != nil || !reflect.DeepEqual(envs, []string{"dev"}) {
+		t.Errorf("list within the max age: %v, %v, want the cached [dev]", envs, err)
+	}
+
+	// Our own changes drop the cached environment and the list.
+	if err := cached.Update(ctx, "dev", map[string]string{"B": "2"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	want := map[string]string{"A": "2", "B": "2"}
+	if vars, err := cached.Get(ctx, "dev"); err != nil || !reflect.DeepEqual(vars, want) {
+		t.Errorf("get after update: %v, %v, want %v", vars, err, want)
+	}
+	envs, err := cached.List(ctx, "")
+	sort.Strings(envs)
+	if err != nil || !reflect.DeepEqual(envs, []string{"dev", "prod"}) {
+		t.Errorf("list after update: %v, %v, want [dev prod]", envs, err)
+	}
+
+	if err := cached.Delete(ctx, "dev", nil); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := cached.Get(ctx, "dev"); !errors.Is(err, backend.ErrEnvNotFound) {
+		t.Errorf("get after delete: %v, want ErrEnvNotFound", err)
+	}
+	if envs, err := cached.List(ctx, ""); err != nil || !reflect.DeepEqual(envs, []string{"prod"}) {
+		t.Errorf("list after delete: %v, %v, want [prod]", envs, err)
+	}
+}
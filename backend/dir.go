@@ -0,0 +1,437 @@
+package backend
+
+// Directory backend. Every environment is a dotenv file in a directory,
+// so the files can be edited by hand, checked into git or synced.
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pyrooka/envman/config"
+)
+
+// Dir related constants.
+const (
+	dirDefaultDir    = ".envman.d"
+	dotenvExtension  = ".env"
+	dotenvExportWord = "export "
+)
+
+// Registers the backend.
+func init() {
+	Register("dir", func() IContextBackend { return &Dir{} })
+}
+
+//-------------------------------------------------------------------
+// Structs
+//-------------------------------------------------------------------
+
+// DirConfig is the config section of the backend.
+type DirConfig struct {
+	Path string `json:"path"`
+}
+
+// Dir uses a directory of dotenv files for backend storage.
+type Dir struct {
+	Path string
+}
+
+// A line of a dotenv file. A quoted value can span multiple lines, then it contains all of them.
+type dotenvLine struct {
+	key   string // Empty for comments and blank lines.
+	value string
+	raw   string // The original text without the closing newline.
+}
+
+//-------------------------------------------------------------------
+//  Dotenv format
+//-------------------------------------------------------------------
+
+// Parses a dotenv file. Keeps the comments and the blank lines, so the file can be written back
+// without losing them. Supports the export prefix, single quoted (literal), double quoted (with escapes)
+// and unquoted values with comments at the end.
+func parseDotenv(data string) (lines []dotenvLine, err error) {
+	lineNumber := 0
+	for len(data) > 0 {
+		lineNumber++
+
+		end := strings.IndexByte(data, '\n')
+		if end == -1 {
+			end = len(data)
+		}
+
+		// Comments and blank lines.
+		trimmed := strings.TrimSpace(data[:end])
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			lines = append(lines, dotenvLine{raw: data[:end]})
+			data = skipLine(data, end)
+			continue
+		}
+
+		// Find the key.
+		pos := len(data[:end]) - len(strings.TrimLeft(data[:end], " \t"))
+		if strings.HasPrefix(data[pos:end], dotenvExportWord) {
+			pos += len(dotenvExportWord)
+		}
+		eq := strings.IndexByte(data[pos:end], '=')
+		if eq == -1 {
+			return nil, fmt.Errorf("line %v: missing =", lineNumber)
+		}
+		key := strings.TrimSpace(data[pos : pos+eq])
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("line %v: invalid key %q", lineNumber, key)
+		}
+		pos += eq + 1
+		for pos < end && (data[pos] == ' ' || data[pos] == '\t') {
+			pos++
+		}
+
+		// Parse the value.
+		var value string
+		closed := pos
+		switch {
+		case pos < end && data[pos] == '"':
+			value, closed, err = parseDoubleQuoted(data, pos)
+		case pos < end && data[pos] == '\'':
+			closing := strings.IndexByte(data[pos+1:], '\'')
+			if closing == -1 {
+				err = fmt.Errorf("unterminated single quote")
+			} else {
+				value = data[pos+1 : pos+1+closing]
+				closed = pos + 1 + closing + 1
+			}
+		default:
+			value = data[pos:end]
+			for _, commentStart := range []string{" #", "\t#"} {
+				if comment := strings.Index(value, commentStart); comment != -1 {
+					value = value[:comment]
+				}
+			}
+			value = strings.TrimSpace(value)
+			closed = end
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", lineNumber, err)
+		}
+
+		// Only a comment can be after a quoted value.
+		end = closed + strings.IndexByte(data[closed:]+"\n", '\n')
+		if rest := strings.TrimSpace(data[closed:end]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return nil, fmt.Errorf("line %v: unexpected characters after the value", lineNumber)
+		}
+
+		lineNumber += strings.Count(data[:end], "\n")
+		lines = append(lines, dotenvLine{key: key, value: value, raw: data[:end]})
+		data = skipLine(data, end)
+	}
+
+	return
+}
+
+// Returns the data after the newline at the end.
+func skipLine(data string, end int) string {
+	if end < len(data) {
+		end++
+	}
+
+	return data[end:]
+}
+
+// Parses a double quoted value starting at the position. Returns the position after the closing quote.
+func parseDoubleQuoted(data string, start int) (value string, closed int, err error) {
+	var b strings.Builder
+	for i := start + 1; i < len(data); i++ {
+		switch c := data[i]; c {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\\':
+			if i+1 >= len(data) {
+				break
+			}
+			i++
+			switch data[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case '"', '\\', '$', '`':
+				b.WriteByte(data[i])
+			default:
+				// Unknown escape, keep it as it is.
+				b.WriteByte('\\')
+				b.WriteByte(data[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	err = fmt.Errorf("unterminated double quote")
+
+	return
+}
+
+// Checks if the value can be written without quotes.
+func isSafeDotenvValue(value string) bool {
+	for _, r := range value {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("_-./:@%+,=~^", r):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Formats a line of a dotenv file. The value is double quoted and escaped if necessary.
+func formatDotenvLine(key string, value string) string {
+	if isSafeDotenvValue(value) {
+		return key + "=" + value
+	}
+
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "$", `\$`, "`", "\\`").Replace(value)
+
+	return key + `="` + escaped + `"`
+}
+
+// Renders the lines with the modifications. The existing lines of the variables are replaced in place,
+// the deleted ones are removed and the new ones are appended at the end in alphabetical order.
+func renderDotenv(lines []dotenvLine, updates map[string]string, deletes []string) string {
+	deleted := map[string]bool{}
+	for _, key := range deletes {
+		deleted[key] = true
+	}
+	written := map[string]bool{}
+
+	var b strings.Builder
+	for _, line := range lines {
+		if deleted[line.key] {
+			continue
+		}
+
+		raw := line.raw
+		if value, exists := updates[line.key]; exists && line.key != "" {
+			prefix := ""
+			if strings.HasPrefix(strings.TrimSpace(raw), dotenvExportWord) {
+				prefix = dotenvExportWord
+			}
+			raw = prefix + formatDotenvLine(line.key, value)
+			written[line.key] = true
+		}
+
+		b.WriteString(raw)
+		b.WriteByte('\n')
+	}
+
+	// Append the new variables.
+	var keys []string
+	for key := range updates {
+		if !written[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		b.WriteString(formatDotenvLine(key, updates[key]))
+		b.WriteByte('\n')
+	}
+
+	return b.String()
+}
+
+//-------------------------------------------------------------------
+//  Environment files
+//-------------------------------------------------------------------
+
+// Returns the path of the environment file.
+func (d *Dir) envPath(envName string) string {
+	return filepath.Join(d.Path, envName+dotenvExtension)
+}
+
+// Reads and parses the file of the environment.
+func (d *Dir) readEnv(envName string) (lines []dotenvLine, err error) {
+	if err = checkEnvFileName(envName); err != nil {
+		return
+	}
+
+	data, err := ioutil.ReadFile(d.envPath(envName))
+	if os.IsNotExist(err) {
+		return nil, envNotFound(envName)
+	} else if err != nil {
+		return
+	}
+
+	lines, err = parseDotenv(string(data))
+	if err != nil {
+		err = fmt.Errorf("%v: %v", d.envPath(envName), err)
+	}
+
+	return
+}
+
+// Writes the file of the environment. Writes a temporary file first, then renames it,
+// so the file is never half written.
+func (d *Dir) writeEnv(envName string, content string) (err error) {
+	if err = os.MkdirAll(d.Path, 0700); err != nil {
+		return
+	}
+
+	file, err := ioutil.TempFile(d.Path, "."+envName+"-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(file.Name(), d.envPath(envName))
+
+	return
+}
+
+//-------------------------------------------------------------------
+//  Interface functions
+//-------------------------------------------------------------------
+
+// Init sets the directory.
+func (d *Dir) Init(ctx context.Context, c *config.Config) (err error) {
+	conf := &DirConfig{}
+	if err = c.Bind("dir", conf); err != nil {
+		return
+	}
+
+	d.Path = conf.Path
+	if d.Path == "" {
+		currentUser, err := user.Current()
+		if err != nil {
+			return err
+		}
+		d.Path = filepath.Join(currentUser.HomeDir, dirDefaultDir)
+	}
+
+	return
+}
+
+// List returns the name of environments or variables.
+func (d *Dir) List(ctx context.Context, envName string) (result []string, err error) {
+	if envName != "" {
+		lines, err := d.readEnv(envName)
+		if err != nil {
+			return nil, err
+		}
+
+		seen := map[string]bool{}
+		for _, line := range lines {
+			if line.key != "" && !seen[line.key] {
+				seen[line.key] = true
+				result = append(result, line.key)
+			}
+		}
+
+		return result, nil
+	}
+
+	files, err := ioutil.ReadDir(d.Path)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") || !strings.HasSuffix(file.Name(), dotenvExtension) {
+			continue
+		}
+		result = append(result, strings.TrimSuffix(file.Name(), dotenvExtension))
+	}
+
+	return
+}
+
+// Get returns the environment variables with its values. If a key is in the file more than once, the last one wins.
+func (d *Dir) Get(ctx context.Context, envName string) (vars map[string]string, err error) {
+	lines, err := d.readEnv(envName)
+	if err != nil {
+		return
+	}
+
+	vars = map[string]string{}
+	for _, line := range lines {
+		if line.key != "" {
+			vars[line.key] = line.value
+		}
+	}
+
+	return
+}
+
+// Update saves the variables to the file of the environment. Overwrites if exists.
+func (d *Dir) Update(ctx context.Context, envName string, variables map[string]string) (err error) {
+	if err = checkEnvFileName(envName); err != nil {
+		return
+	}
+
+	// Create the environment if not already exists.
+	var lines []dotenvLine
+	if _, err = os.Stat(d.envPath(envName)); err == nil {
+		if lines, err = d.readEnv(envName); err != nil {
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		return
+	}
+
+	err = d.writeEnv(envName, renderDotenv(lines, variables, nil))
+
+	return
+}
+
+// Delete removes the file of the environment or the variables from it.
+func (d *Dir) Delete(ctx context.Context, envName string, envVars []string) (err error) {
+	lines, err := d.readEnv(envName)
+	if err != nil {
+		return
+	}
+
+	if len(envVars) == 0 {
+		err = os.Remove(d.envPath(envName))
+		return
+	}
+
+	// The missing variables are skipped.
+	err = d.writeEnv(envName, renderDotenv(lines, nil, envVars))
+
+	return
+}
+
+// CleanUp removes all the environment files. The directory is kept, because it can contain other files.
+func (d *Dir) CleanUp(ctx context.Context) (err error) {
+	envs, err := d.List(ctx, "")
+	if err != nil {
+		return
+	}
+
+	for _, env := range envs {
+		if err = os.Remove(d.envPath(env)); err != nil {
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,149 @@
+package backend_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pyrooka/envman/backend"
+	"github.com/pyrooka/envman/backend/backendtest"
+)
+
+// Returns a dir backend in a temporary directory.
+func newTestDir(t *testing.T) (d *backend.Dir) {
+	d = &backend.Dir{}
+	backendtest.Init(t, d, sectionConfig(t, "dir", &backend.DirConfig{Path: t.TempDir()}))
+
+	return
+}
+
+// Writes the file of the environment like someone who edits it by hand.
+func writeDotenv(t *testing.T, d *backend.Dir, envName string, content string) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(filepath.Join(d.Path, envName+".env"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Reads the file of the environment.
+func readDotenv(t *testing.T, d *backend.Dir, envName string) string {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filepath.Join(d.Path, envName+".env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+func TestDir(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.IContextBackend {
+		return newTestDir(t)
+	})
+}
+
+func TestDotenvParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{"Plain", "A=1\nB = two words \nC=\n", map[string]string{"A": "1", "B": "two words", "C": ""}, ""},
+		{"Export", "export A=1\n  export B='2'\n", map[string]string{"A": "1", "B": "2"}, ""},
+		{"SingleQuotes", `A='it is $HOME \n "literal"'`, map[string]string{"A": `it is $HOME \n "literal"`}, ""},
+		{"DoubleQuotes", `A="line\nnext\t\"q\" \$HOME \\ \x"`, map[string]string{"A": "line\nnext\t\"q\" $HOME \\ \\x"}, ""},
+		{"Comments", "# comment\n\n  # indented\nA=1 # trailing\nB='x' # after quotes\nC=a#b\nD=\"#\"\n", map[string]string{"A": "1", "B": "x", "C": "a#b", "D": "#"}, ""},
+		{"MultiLineDouble", "A=\"first\nsecond\"\nB=2", map[string]string{"A": "first\nsecond", "B": "2"}, ""},
+		{"MultiLineSingle", "A='first\n\nthird'\nB=2\n", map[string]string{"A": "first\n\nthird", "B": "2"}, ""},
+		{"Duplicate", "A=1\nA=2\n", map[string]string{"A": "2"}, ""},
+		{"NotUTF8", "A=\"\xff\xfe\"\nB=\xc3\n", map[string]string{"A": "\xff\xfe", "B": "\xc3"}, ""},
+		{"MissingEquals", "A=1\nB\n", nil, "line 2: missing ="},
+		{"MissingKey", "=1\n", nil, "line 1: invalid key"},
+		{"SpaceInKey", "A B=1\n", nil, "line 1: invalid key"},
+		{"UnterminatedDouble", "A=\"first\nB=2\n", nil, "line 1: unterminated double quote"},
+		{"UnterminatedSingle", "A='first\n", nil, "line 1: unterminated single quote"},
+		{"AfterQuotes", "A='x' y\n", nil, "line 1: unexpected characters"},
+		{"LineAfterMultiLine", "A=\"a\nb\"\nC\n", nil, "line 3: missing ="},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newTestDir(t)
+			writeDotenv(t, d, "dev", test.content)
+
+			vars, err := d.Get(context.Background(), "dev")
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("get: %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(vars, test.want) {
+				t.Errorf("get: %q, %v, want %q", vars, err, test.want)
+			}
+		})
+	}
+}
+
+func TestDotenvFormat(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		line  string
+	}{
+		{"Safe", "user@host:8080/path-1.0,a=b", "A=user@host:8080/path-1.0,a=b"},
+		{"Empty", "", "A="},
+		{"Space", "two words", `A="two words"`},
+		{"SingleQuote", "it's", `A="it's"`},
+		{"Escapes", "q\"\\$`", "A=\"q\\\"\\\\\\$\\`\""},
+		{"NewLines", "a\nb\r\n", `A="a\nb\r\n"`},
+		{"Tab", "a\tb", "A=\"a\tb\""},
+		{"Hash", "#not a comment", `A="#not a comment"`},
+		{"Unicode", "árvíztűrő", `A="árvíztűrő"`},
+		{"NotUTF8", "\xff\xfe\x00", "A=\"\xff\xfe\x00\""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			d := newTestDir(t)
+
+			if err := d.Update(ctx, "dev", map[string]string{"A": test.value}); err != nil {
+				t.Fatalf("update: %v", err)
+			}
+			if content := readDotenv(t, d, "dev"); content != test.line+"\n" {
+				t.Errorf("file: %q, want %q", content, test.line+"\n")
+			}
+
+			// The value is read back as it was.
+			if vars, err := d.Get(ctx, "dev"); err != nil || vars["A"] != test.value {
+				t.Errorf("get: %q, %v, want %q", vars["A"], err, test.value)
+			}
+		})
+	}
+}
+
+func TestDotenvKeepLines(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDir(t)
+	writeDotenv(t, d, "dev", "# Database\nexport HOST=localhost # local\n\nPORT=5432\nUSER='admin'\n")
+
+	if err := d.Update(ctx, "dev", map[string]string{"HOST": "db.example.com", "NAME": "app"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := d.Delete(ctx, "dev", []string{"PORT", "MISSING"}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	// The comments, the blank lines and the export prefix are kept, the new variables are appended.
+	want := "# Database\nexport HOST=db.example.com\n\nUSER='admin'\nNAME=app\n"
+	if content := readDotenv(t, d, "dev"); content != want {
+		t.Errorf("file: %q, want %q", content, want)
+	}
+}
@@ -0,0 +1,425 @@
+package backend
+
+// Client-side encryption layer. Wraps any other backend and encrypts the values with AES-GCM
+// before they leave the machine. The key is derived from a passphrase with scrypt.
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/pyrooka/envman/config"
+)
+
+// Encryption related constants.
+const (
+	// Prefix of every encrypted value. The version makes it possible to change the format later.
+	encryptedPrefix = "envman:v1:"
+	// Environment variable which can hold the passphrase, so no prompt needed.
+	passphraseEnvVar = "ENVMAN_PASSPHRASE"
+	// Default scrypt parameters. Recommended values for interactive logins.
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptSaltLen = 16
+	keyLen        = 32
+	// Upper bounds of the parameters read from the stored values, so a value written by someone else
+	// cannot make the key derivation use gigabytes of memory. The memory is 128 * N * r bytes.
+	scryptMaxN = 1 << 17
+	scryptMaxR = 16
+	scryptMaxP = 4
+)
+
+// The value is not encrypted, e.g. it was saved before the encryption was turned on.
+var errNotEncrypted = errors.New("value is not encrypted")
+
+//-------------------------------------------------------------------
+// Structs
+//-------------------------------------------------------------------
+
+// Encrypted wraps another backend and encrypts every value before it is stored.
+// The variable names stay in plain text, only the values are encrypted.
+type Encrypted struct {
+	Backend        IContextBackend
+	Passphrase     string
+	AllowPlaintext bool // Load the values which are not encrypted, e.g. saved before the encryption was turned on.
+
+	salt []byte            // Salt used for the new values in this session.
+	keys map[string][]byte // Cache for the derived keys. Key is the KDF parameters with the salt.
+}
+
+// Parameters of the key derivation function stored next to the ciphertext.
+type kdfParams struct {
+	N, R, P int
+	Salt    []byte
+}
+
+//-------------------------------------------------------------------
+//  Helper functions
+//-------------------------------------------------------------------
+
+// Reads the passphrase from the environment or from the terminal.
+func readPassphrase() (passphrase string, err error) {
+	if passphrase = os.Getenv(passphraseEnvVar); passphrase != "" {
+		return
+	}
+
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	bytePass, err := terminal.ReadPassword(int(syscall.Stdin))
+	if err != nil {
+		return
+	}
+	passphrase = string(bytePass)
+
+	// Newline after passphrase entered.
+	fmt.Fprintln(os.Stderr)
+
+	if passphrase == "" {
+		err = errors.New("empty passphrase")
+	}
+
+	return
+}
+
+// Returns the cache key of the parameters.
+func (p *kdfParams) String() string {
+	return fmt.Sprintf("%d:%d:%d:%s", p.N, p.R, p.P, base64.StdEncoding.EncodeToString(p.Salt))
+}
+
+// Parses an encrypted value to the KDF parameters and the nonce with the ciphertext.
+func parseEncrypted(value string) (params *kdfParams, data []byte, err error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		err = errNotEncrypted
+		return
+	}
+
+	// N:r:p:salt:data
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 5 {
+		err = errors.New("invalid encrypted value")
+		return
+	}
+
+	params = &kdfParams{}
+	for i, dst := range []*int{&params.N, &params.R, &params.P} {
+		*dst, err = strconv.Atoi(parts[i])
+		if err != nil {
+			return
+		}
+	}
+	// N must be a power of two.
+	if params.N < 2 || params.N > scryptMaxN || params.N&(params.N-1) != 0 ||
+		params.R < 1 || params.R > scryptMaxR || params.P < 1 || params.P > scryptMaxP {
+		err = fmt.Errorf("unsupported encryption parameters N=%d r=%d p=%d", params.N, params.R, params.P)
+		return
+	}
+
+	params.Salt, err = base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return
+	}
+	data, err = base64.StdEncoding.DecodeString(parts[4])
+
+	return
+}
+
+// Derives the key for the parameters or returns it from the cache.
+func (e *Encrypted) deriveKey(params *kdfParams) (key []byte, err error) {
+	if e.keys == nil {
+		e.keys = map[string][]byte{}
+	}
+
+	cacheKey := params.String()
+	if key, exists := e.keys[cacheKey]; exists {
+		return key, nil
+	}
+
+	key, err = scrypt.Key([]byte(e.Passphrase), params.Salt, params.N, params.R, params.P, keyLen)
+	if err != nil {
+		return
+	}
+	e.keys[cacheKey] = key
+
+	return
+}
+
+// Creates the AES-GCM cipher for the parameters.
+func (e *Encrypted) cipher(params *kdfParams) (aead cipher.AEAD, err error) {
+	key, err := e.deriveKey(params)
+	if err != nil {
+		return
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+
+	aead, err = cipher.NewGCM(block)
+
+	return
+}
+
+// Encrypts a value. The name of the variable is authenticated too, so values cannot be swapped.
+func (e *Encrypted) encrypt(name string, value string) (encrypted string, err error) {
+	// Generate the salt once per session, so the key derivation runs only once.
+	if e.salt == nil {
+		salt := make([]byte, scryptSaltLen)
+		if _, err = rand.Read(salt); err != nil {
+			return
+		}
+		e.salt = salt
+	}
+	params := &kdfParams{N: scryptN, R: scryptR, P: scryptP, Salt: e.salt}
+
+	aead, err := e.cipher(params)
+	if err != nil {
+		return
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+
+	data := aead.Seal(nonce, nonce, []byte(value), []byte(name))
+	encrypted = encryptedPrefix + fmt.Sprintf("%d:%d:%d:%s:%s", params.N, params.R, params.P,
+		base64.StdEncoding.EncodeToString(params.Salt), base64.StdEncoding.EncodeToString(data))
+
+	return
+}
+
+// Decrypts a value.
+func (e *Encrypted) decrypt(name string, value string) (decrypted string, err error) {
+	params, data, err := parseEncrypted(value)
+	if err != nil {
+		return
+	}
+
+	aead, err := e.cipher(params)
+	if err != nil {
+		return
+	}
+
+	if len(data) < aead.NonceSize() {
+		err = errors.New("invalid encrypted value")
+		return
+	}
+
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(name))
+	if err != nil {
+		err = errors.New("decryption failed, wrong passphrase?")
+		return
+	}
+	decrypted = string(plain)
+
+	return
+}
+
+// Decrypts the values of the variables. The values which are not encrypted are not authenticated,
+// anyone who can write to the backend could set them, so they are an error unless AllowPlaintext is set.
+// Then they are returned as they are with a warning, and they are encrypted when they are saved again.
+func (e *Encrypted) decryptVars(envName string, encrypted map[string]string) (vars map[string]string, err error) {
+	vars = make(map[string]string, len(encrypted))
+	var plain []string
+	for key, value := range encrypted {
+		vars[key], err = e.decrypt(key, value)
+		if errors.Is(err, errNotEncrypted) && e.AllowPlaintext {
+			vars[key], err = value, nil
+			plain = append(plain, key)
+		} else if errors.Is(err, errNotEncrypted) {
+			return nil, fmt.Errorf("variable %v of environment %q: %v, set allowPlaintext in the encryption section of the config to load it", key, envName, err)
+		} else if err != nil {
+			return nil, fmt.Errorf("variable %v: %v", key, err)
+		}
+	}
+
+	if len(plain) > 0 {
+		sort.Strings(plain)
+		fmt.Fprintf(os.Stderr, "Warning: %v of environment %q not encrypted, save them again to encrypt them.\n", strings.Join(plain, ", "), envName)
+	}
+
+	return
+}
+
+// Unwrap returns the wrapped backend.
+func (e *Encrypted) Unwrap() IContextBackend {
+	return e.Backend
+}
+
+//-------------------------------------------------------------------
+//  Interface functions
+//-------------------------------------------------------------------
+
+// Init initializes the wrapped backend and asks for the passphrase if not set.
+func (e *Encrypted) Init(ctx context.Context, c *config.Config) (err error) {
+	err = e.Backend.Init(ctx, c)
+	if err != nil {
+		return
+	}
+
+	if e.Passphrase == "" {
+		e.Passphrase, err = readPassphrase()
+	}
+
+	return
+}
+
+// List returns the list of the wrapped backend. Names are not encrypted.
+func (e *Encrypted) List(ctx context.Context, envName string) (result []string, err error) {
+	result, err = e.Backend.List(ctx, envName)
+
+	return
+}
+
+// Get gets the variables from the wrapped backend and decrypts them.
+func (e *Encrypted) Get(ctx context.Context, envName string) (vars map[string]string, err error) {
+	encrypted, err := e.Backend.Get(ctx, envName)
+	if err != nil {
+		return
+	}
+
+	vars, err = e.decryptVars(envName, encrypted)
+
+	return
+}
+
+// Update encrypts the variables and saves them with the wrapped backend.
+func (e *Encrypted) Update(ctx context.Context, envName string, variables map[string]string) (err error) {
+	encrypted := make(map[string]string, len(variables))
+	for key, value := range variables {
+		encrypted[key], err = e.encrypt(key, value)
+		if err != nil {
+			return
+		}
+	}
+
+	err = e.Backend.Update(ctx, envName, encrypted)
+
+	return
+}
+
+// Delete deletes with the wrapped backend.
+func (e *Encrypted) Delete(ctx context.Context, envName string, envVars []string) (err error) {
+	err = e.Backend.Delete(ctx, envName, envVars)
+
+	return
+}
+
+// CleanUp cleans up the wrapped backend.
+func (e *Encrypted) CleanUp(ctx context.Context) (err error) {
+	err = e.Backend.CleanUp(ctx)
+
+	return
+}
+
+// History returns the revisions of the wrapped backend.
+func (e *Encrypted) History(ctx context.Context, envName string) (revisions []Revision, err error) {
+	var versioned Versioned
+	if !As(e.Backend, &versioned) {
+		return nil, fmt.Errorf("%w: history", ErrNotSupported)
+	}
+
+	revisions, err = versioned.History(ctx, envName)
+
+	return
+}
+
+// GetRevision gets the revision from the wrapped backend and decrypts the values.
+func (e *Encrypted) GetRevision(ctx context.Context, envName string, id string) (vars map[string]string, err error) {
+	var versioned Versioned
+	if !As(e.Backend, &versioned) {
+		return nil, fmt.Errorf("%w: history", ErrNotSupported)
+	}
+
+	encrypted, err := versioned.GetRevision(ctx, envName, id)
+	if err != nil {
+		return
+	}
+
+	vars, err = e.decryptVars(envName, encrypted)
+
+	return
+}
+
+// Replace encrypts the variables and replaces the variables of the environment with them with the wrapped backend.
+func (e *Encrypted) Replace(ctx context.Context, envName string, variables map[string]string) (err error) {
+	var versioned Versioned
+	if !As(e.Backend, &versioned) {
+		return fmt.Errorf("%w: history", ErrNotSupported)
+	}
+
+	encrypted := make(map[string]string, len(variables))
+	for key, value := range variables {
+		encrypted[key], err = e.encrypt(key, value)
+		if err != nil {
+			return
+		}
+	}
+
+	err = versioned.Replace(ctx, envName, encrypted)
+
+	return
+}
+
+// GetVariables gets the variables with their metadata from the wrapped backend and decrypts the values.
+// The metadata is not encrypted.
+func (e *Encrypted) GetVariables(ctx context.Context, envName string) (vars map[string]Variable, err error) {
+	var annotated Annotated
+	if !As(e.Backend, &annotated) {
+		return nil, fmt.Errorf("%w: metadata", ErrNotSupported)
+	}
+
+	vars, err = annotated.GetVariables(ctx, envName)
+	if err != nil {
+		return
+	}
+
+	encrypted := make(map[string]string, len(vars))
+	for key, variable := range vars {
+		encrypted[key] = variable.Value
+	}
+	decrypted, err := e.decryptVars(envName, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	for key, variable := range vars {
+		variable.Value = decrypted[key]
+		vars[key] = variable
+	}
+
+	return
+}
+
+// UpdateVariables encrypts the values and updates them with their metadata with the wrapped backend.
+func (e *Encrypted) UpdateVariables(ctx context.Context, envName string, variables map[string]Variable) (err error) {
+	var annotated Annotated
+	if !As(e.Backend, &annotated) {
+		return fmt.Errorf("%w: metadata", ErrNotSupported)
+	}
+
+	encrypted := make(map[string]Variable, len(variables))
+	for key, variable := range variables {
+		variable.Value, err = e.encrypt(key, variable.Value)
+		if err != nil {
+			return
+		}
+		encrypted[key] = variable
+	}
+
+	err = annotated.UpdateVariables(ctx, envName, encrypted)
+
+	return
+}
@@ -0,0 +1,116 @@
+package backend_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/pyrooka/envman/backend"
+	"github.com/pyrooka/envman/backend/backendtest"
+	"github.com/pyrooka/envman/config"
+)
+
+func TestEncrypted(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.IContextBackend {
+		return backendtest.Init(t, &backend.Encrypted{Backend: &backend.Local{}, Passphrase: "passphrase"}, &config.Config{})
+	})
+}
+
+func TestEncryptedValues(t *testing.T) {
+	ctx := context.Background()
+	local := &backend.Local{}
+	encrypted := &backend.Encrypted{Backend: local, Passphrase: "passphrase"}
+	backendtest.Init(t, encrypted, &config.Config{})
+
+	if err := encrypted.Update(ctx, "dev", map[string]string{"A": "secret", "B": "other"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if stored := local.Environments["dev"]["A"]; stored == "secret" || !strings.HasPrefix(stored, "envman:v1:") {
+		t.Errorf("stored value: %q, want encrypted", stored)
+	}
+
+	wrong := &backend.Encrypted{Backend: local, Passphrase: "wrong"}
+	if _, err := wrong.Get(ctx, "dev"); err == nil {
+		t.Error("get with a wrong passphrase: no error")
+	}
+
+	// The name is authenticated, so the values cannot be swapped.
+	local.Environments["dev"]["B"] = local.Environments["dev"]["A"]
+	if _, err := encrypted.Get(ctx, "dev"); err == nil {
+		t.Error("get swapped values: no error")
+	}
+}
+
+func TestEncryptedParameters(t *testing.T) {
+	ctx := context.Background()
+	local := &backend.Local{}
+	encrypted := &backend.Encrypted{Backend: local, Passphrase: "passphrase"}
+	backendtest.Init(t, encrypted, &config.Config{})
+
+	tests := []struct {
+		name   string
+		params string
+	}{
+		{"HugeN", "1073741824:8:1"},
+		{"NotPowerOfTwo", "1000:8:1"},
+		{"HugeR", "32768:1024:1"},
+		{"HugeP", "32768:8:64"},
+		{"Zero", "0:0:0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			local.Environments["dev"] = map[string]string{"A": "envman:v1:" + test.params + ":c2FsdA==:ZGF0YQ=="}
+			_, err := encrypted.Get(ctx, "dev")
+			if err == nil || !strings.Contains(err.Error(), "unsupported encryption parameters") {
+				t.Errorf("get: %v, want unsupported parameters", err)
+			}
+		})
+	}
+}
+
+func TestEncryptedPlaintext(t *testing.T) {
+	ctx := context.Background()
+	local := &backend.Local{}
+	encrypted := &backend.Encrypted{Backend: local, Passphrase: "passphrase"}
+	backendtest.Init(t, encrypted, &config.Config{})
+
+	// Saved before the encryption was turned on, or by anyone who can write to the backend.
+	if err := local.Update(ctx, "dev", map[string]string{"A": "plain"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := encrypted.Update(ctx, "dev", map[string]string{"B": "secret"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	// Not authenticated, so rejected by default.
+	if vars, err := encrypted.Get(ctx, "dev"); err == nil || !strings.Contains(err.Error(), "variable A") || !strings.Contains(err.Error(), "allowPlaintext") {
+		t.Errorf("get plain value: %v, %v, want an error", vars, err)
+	}
+	if _, err := encrypted.GetVariables(ctx, "dev"); err == nil {
+		t.Error("get plain variable: no error")
+	}
+
+	// Allowed for the migration with a warning.
+	encrypted.AllowPlaintext = true
+	stderr := captureStderr(t)
+	vars, err := encrypted.Get(ctx, "dev")
+	if err != nil || vars["A"] != "plain" || vars["B"] != "secret" {
+		t.Fatalf("get: %v, %v, want the plain and the decrypted value", vars, err)
+	}
+	if output := stderr(); !strings.Contains(output, "A of environment \"dev\" not encrypted") {
+		t.Errorf("output: %q, want a warning", output)
+	}
+
+	// Saving it again encrypts it.
+	if err := encrypted.Update(ctx, "dev", vars); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if stored := local.Environments["dev"]["A"]; !strings.HasPrefix(stored, "envman:v1:") {
+		t.Errorf("stored value: %q, want encrypted", stored)
+	}
+	encrypted.AllowPlaintext = false
+	if _, err := encrypted.Get(ctx, "dev"); err != nil {
+		t.Errorf("get after migration: %v", err)
+	}
+}
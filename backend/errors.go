@@ -0,0 +1,61 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Errors returned by the backends. Check them with errors.Is, because they are wrapped with the details.
+var (
+	ErrEnvNotFound      = errors.New("environment not found")
+	ErrVarNotFound      = errors.New("variable not found")
+	ErrReservedName     = errors.New("reserved name")
+	ErrInvalidName      = errors.New("invalid name")
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrRateLimited      = errors.New("rate limited")
+	ErrConflict         = errors.New("conflict")
+	ErrRevisionNotFound = errors.New("revision not found")
+	ErrNotSupported     = errors.New("not supported by the backend")
+	ErrCycle            = errors.New("inheritance cycle")
+)
+
+// RateLimitError is an ErrRateLimited which knows when the limit resets.
+type RateLimitError struct {
+	Reset   time.Time // When the requests are allowed again. Zero if unknown.
+	Message string    // Details from the backend.
+}
+
+// Error returns the message with the time of the reset.
+func (e *RateLimitError) Error() string {
+	message := ErrRateLimited.Error()
+	if e.Message != "" {
+		message += ": " + e.Message
+	}
+	if !e.Reset.IsZero() {
+		message += ", resets at " + e.Reset.Local().Format("2006-01-02 15:04:05")
+	}
+
+	return message
+}
+
+// Is makes errors.Is(err, ErrRateLimited) true.
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// Returns an ErrEnvNotFound with the name of the environment.
+func envNotFound(envName string) error {
+	return fmt.Errorf("%w: %q", ErrEnvNotFound, envName)
+}
+
+// Returns an ErrConflict with the name of the environment and the variables.
+func conflict(envName string, varNames []string) error {
+	return fmt.Errorf("%w: %v changed at the same time in environment %q", ErrConflict, strings.Join(varNames, ", "), envName)
+}
+
+// Returns an ErrInvalidName with the name of the environment.
+func invalidEnvName(envName string) error {
+	return fmt.Errorf("%w: %q", ErrInvalidName, envName)
+}
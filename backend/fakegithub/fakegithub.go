@@ -0,0 +1,968 @@
+// Package fakegithub is an in-process fake of the parts of the GitHub API used by the gist backend.
+//
+// It emulates /user, /gists (with pagination, revisions, ETags and raw file URLs), /authorizations,
+// the OAuth device flow and the token revocation of the OAuth apps, and can inject faults,
+// so the backend can be tested without a network:
+//
+//	server := fakegithub.New()
+//	defer server.Close()
+//	server.AddToken("octocat", "secret", "gist")
+//	gist := &backend.GitHubGist{APIURL: server.URL, WebURL: server.URL}
+//
+// The raw file URLs and the device flow endpoints are served by the same server.
+// NewEnterprise starts a GitHub Enterprise Server like one instead, with TLS and the API under
+// /api/v3, to test the apiUrl and caBundle settings.
+package fakegithub
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fake related constants.
+const (
+	defaultPerPage = 30
+	maxPerPage     = 100
+	rateLimit      = 5000
+	deviceExpiry   = 15 * time.Minute
+)
+
+//-------------------------------------------------------------------
+// Structs
+//-------------------------------------------------------------------
+
+// Server is the fake GitHub API. The URL of the API is the URL of the embedded test server.
+type Server struct {
+	*httptest.Server
+
+	mu             sync.Mutex
+	users          map[string]string         // Password by login.
+	tokens         map[string]*authorization // Authorization by token.
+	authorizations map[int]*authorization    // Authorization by ID.
+	gists          map[string]*gist          // Gist by ID.
+	faults         []*Fault                  // Injected faults.
+	requests       []string                  // Method and path of the received requests.
+	remaining      map[string]int            // Remaining requests by login.
+	nextID         int                       // Counter for the IDs.
+	clock          func() time.Time          // Time of the changes.
+	apps           map[string]string         // Secret by the client ID of the OAuth apps.
+	devices        map[string]*device        // Device flow logins by device code.
+	approver       string                    // Login of the user who approves the device logins.
+	apiPath        string                    // Path of the API, empty on github.com.
+
+	// DeviceInterval is the polling interval in seconds sent in the device flow.
+	DeviceInterval int
+}
+
+// Fault is an error response for the matching requests.
+type Fault struct {
+	Method      string        // Method of the requests, any if empty.
+	Path        string        // Prefix of the path of the requests, any if empty.
+	Status      int           // Status code of the response, e.g. 401, 404, 422 or 500.
+	RateLimited bool          // Responds with 403 and an exhausted rate limit.
+	Secondary   bool          // Responds with 403 and the message of the secondary rate limit, but without Retry-After.
+	RetryAfter  time.Duration // Sends a Retry-After header in seconds with the status, e.g. a secondary rate limit with 403.
+	Delay       time.Duration // Waits before the response. Without a status the request is served normally after it.
+	Times       int           // Number of the requests affected, all if 0.
+	Before      func()        // Runs before the request is served, e.g. to change a gist at the same time.
+}
+
+// A token of a user. A token without scopes is a fine-grained one.
+type authorization struct {
+	ID       int
+	Login    string
+	Token    string
+	Note     string
+	Scopes   []string
+	ClientID string // The OAuth app which created it.
+}
+
+// A login with the device flow.
+type device struct {
+	ClientID string
+	UserCode string
+	Scopes   []string
+	Expires  time.Time
+	Issued   bool
+}
+
+// A gist with all of its revisions. The last revision is the current one.
+type gist struct {
+	ID          string
+	Owner       string
+	Description string
+	Public      bool
+	CreatedAt   time.Time
+	History     []*revision
+}
+
+// A revision of a gist.
+type revision struct {
+	Version     string
+	CommittedAt time.Time
+	Files       map[string]string // Content by file name.
+}
+
+// File in a request.
+type fileRequest struct {
+	Filename *string `json:"filename"`
+	Content  *string `json:"content"`
+}
+
+// Body of the gist create and update requests.
+type gistRequest struct {
+	Description *string                 `json:"description"`
+	Public      bool                    `json:"public"`
+	Files       map[string]*fileRequest `json:"files"`
+}
+
+//-------------------------------------------------------------------
+//  Setup
+//-------------------------------------------------------------------
+
+// New starts a fake server.
+func New() *Server {
+	s := newServer()
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+
+	return s
+}
+
+// NewEnterprise starts a fake GitHub Enterprise Server. It uses TLS with a certificate of its own
+// (see Certificate) and serves the API under /api/v3, the web and raw URLs are at the root.
+func NewEnterprise() *Server {
+	s := newServer()
+	s.apiPath = "/api/v3"
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.handle))
+
+	return s
+}
+
+// Creates the server without starting it.
+func newServer() *Server {
+	return &Server{
+		users:          map[string]string{},
+		tokens:         map[string]*authorization{},
+		authorizations: map[int]*authorization{},
+		gists:          map[string]*gist{},
+		remaining:      map[string]int{},
+		clock:          time.Now,
+		apps:           map[string]string{},
+		devices:        map[string]*device{},
+		DeviceInterval: 1,
+	}
+}
+
+// APIURL returns the base URL of the API.
+func (s *Server) APIURL() string {
+	return s.URL + s.apiPath
+}
+
+// AddUser adds a user who can use basic authentication.
+func (s *Server) AddUser(login string, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users[login] = password
+}
+
+// AddToken adds a token of the user with the scopes. Without scopes it is a fine-grained token.
+// The user is created if not exists.
+func (s *Server) AddToken(login string, token string, scopes ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.users[login]; !exists {
+		s.users[login] = ""
+	}
+	s.addAuthorization(login, token, "", scopes)
+}
+
+// HasToken checks if the token is valid.
+func (s *Server) HasToken(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, exists := s.tokens[token]
+
+	return exists
+}
+
+// AddOAuthApp adds an OAuth app which can be used for the device flow.
+func (s *Server) AddOAuthApp(clientID string, clientSecret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.apps[clientID] = clientSecret
+}
+
+// ApproveDevices makes the user approve all the device flow logins, like entering the code in the browser.
+func (s *Server) ApproveDevices(login string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.users[login]; !exists {
+		s.users[login] = ""
+	}
+	s.approver = login
+}
+
+// AddGist creates a gist of the user with the files and returns its ID.
+func (s *Server) AddGist(login string, description string, public bool, files map[string]string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.createGist(login, description, public, files).ID
+}
+
+// SetFile changes a file of the gist like another client, in a new revision. An empty content deletes the file.
+func (s *Server) SetFile(gistID string, filename string, content string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g, exists := s.gists[gistID]
+	if !exists {
+		return
+	}
+
+	files := map[string]string{}
+	for name, current := range g.current().Files {
+		files[name] = current
+	}
+	if content == "" {
+		delete(files, filename)
+	} else {
+		files[filename] = content
+	}
+
+	g.History = append(g.History, &revision{Version: s.newHash(), CommittedAt: s.clock().UTC(), Files: files})
+}
+
+// File returns the current content of a file of the gist.
+func (s *Server) File(gistID string, filename string) (content string, exists bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g, found := s.gists[gistID]
+	if !found {
+		return
+	}
+	content, exists = g.current().Files[filename]
+
+	return
+}
+
+// GistIDs returns the IDs of the gists of the user.
+func (s *Server) GistIDs(login string) (ids []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, g := range s.userGists(login) {
+		ids = append(ids, g.ID)
+	}
+
+	return
+}
+
+// Inject adds a fault. The faults are checked in the order they were added.
+func (s *Server) Inject(fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := fault
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes all the injected faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = nil
+}
+
+// Requests returns the received requests as "METHOD /path" strings.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.requests...)
+}
+
+//-------------------------------------------------------------------
+//  Helper functions
+//-------------------------------------------------------------------
+
+// Returns the current revision of the gist.
+func (g *gist) current() *revision {
+	return g.History[len(g.History)-1]
+}
+
+// Returns a new unique ID.
+func (s *Server) newID() int {
+	s.nextID++
+
+	return s.nextID
+}
+
+// Returns a new unique hex string like the IDs and versions of GitHub.
+func (s *Server) newHash() string {
+	sum := sha1.Sum([]byte(strconv.Itoa(s.newID())))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Adds a token of the user. The scopes of a classic token are never nil.
+func (s *Server) addAuthorization(login string, token string, note string, scopes []string) *authorization {
+	auth := &authorization{ID: s.newID(), Login: login, Token: token, Note: note, Scopes: scopes}
+	s.tokens[token] = auth
+	s.authorizations[auth.ID] = auth
+
+	return auth
+}
+
+// Creates a gist with the first revision.
+func (s *Server) createGist(login string, description string, public bool, files map[string]string) *gist {
+	now := s.clock().UTC()
+	g := &gist{
+		ID:          s.newHash()[:20],
+		Owner:       login,
+		Description: description,
+		Public:      public,
+		CreatedAt:   now,
+		History:     []*revision{{Version: s.newHash(), CommittedAt: now, Files: files}},
+	}
+	s.gists[g.ID] = g
+
+	return g
+}
+
+// Returns the gists of the user, the last updated first.
+func (s *Server) userGists(login string) (gists []*gist) {
+	for _, g := range s.gists {
+		if g.Owner == login {
+			gists = append(gists, g)
+		}
+	}
+	sort.Slice(gists, func(i, j int) bool {
+		a, b := gists[i].current().CommittedAt, gists[j].current().CommittedAt
+		if a.Equal(b) {
+			return gists[i].ID > gists[j].ID
+		}
+		return a.After(b)
+	})
+
+	return
+}
+
+// Returns the gist in the format of the API. The content and the history are only in the single gist responses.
+func (s *Server) gistJSON(g *gist, rev *revision, single bool) map[string]interface{} {
+	files := map[string]interface{}{}
+	for name, content := range rev.Files {
+		file := map[string]interface{}{
+			"filename":  name,
+			"type":      "text/plain",
+			"size":      len(content),
+			"raw_url":   fmt.Sprintf("%s/raw/%s/%s/%s", s.URL, g.ID, rev.Version, name),
+			"truncated": false,
+		}
+		if single {
+			file["content"] = content
+		}
+		files[name] = file
+	}
+
+	result := map[string]interface{}{
+		"id":          g.ID,
+		"url":         s.APIURL() + "/gists/" + g.ID,
+		"html_url":    "https://gist.github.com/" + g.ID,
+		"description": g.Description,
+		"public":      g.Public,
+		"owner":       map[string]interface{}{"login": g.Owner},
+		"files":       files,
+		"created_at":  g.CreatedAt.Format(time.RFC3339),
+		"updated_at":  g.current().CommittedAt.Format(time.RFC3339),
+	}
+
+	if single {
+		var history []interface{}
+		for i := len(g.History) - 1; i >= 0; i-- {
+			history = append(history, map[string]interface{}{
+				"version":      g.History[i].Version,
+				"committed_at": g.History[i].CommittedAt.Format(time.RFC3339),
+				"url":          s.APIURL() + "/gists/" + g.ID + "/" + g.History[i].Version,
+			})
+		}
+		result["history"] = history
+	}
+
+	return result
+}
+
+// Writes a JSON response.
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// Writes an error response like the API.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"message": message, "documentation_url": "https://docs.github.com/rest"})
+}
+
+//-------------------------------------------------------------------
+//  Handlers
+//-------------------------------------------------------------------
+
+// Handles all the requests.
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	fault := s.matchFault(r)
+	s.mu.Unlock()
+
+	if fault != nil {
+		if fault.Before != nil {
+			fault.Before()
+		}
+		if fault.Delay > 0 {
+			select {
+			case <-time.After(fault.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		switch {
+		case fault.RateLimited:
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(rateLimit))
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(s.clock().Add(time.Hour).Unix(), 10))
+			writeError(w, http.StatusForbidden, "API rate limit exceeded")
+			return
+		case fault.Secondary:
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(rateLimit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(rateLimit-1))
+			writeError(w, http.StatusForbidden, "You have exceeded a secondary rate limit. Please wait a few minutes before you try again.")
+			return
+		case fault.Status != 0:
+			if fault.RetryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(fault.RetryAfter.Round(time.Second)/time.Second)))
+			}
+			writeError(w, fault.Status, http.StatusText(fault.Status))
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, s.apiPath), "/")
+	parts := strings.Split(path, "/")
+
+	// The raw files don't need authentication.
+	if parts[0] == "raw" {
+		s.handleRaw(w, parts[1:])
+		return
+	}
+
+	if parts[0] == "authorizations" {
+		s.handleAuthorizations(w, r, parts[1:])
+		return
+	}
+
+	if parts[0] == "login" {
+		s.handleDeviceFlow(w, r, path)
+		return
+	}
+
+	if parts[0] == "applications" && len(parts) == 3 && parts[2] == "token" && r.Method == http.MethodDelete {
+		s.revokeToken(w, r, parts[1])
+		return
+	}
+
+	auth := s.authenticate(w, r)
+	if auth == nil {
+		return
+	}
+
+	switch {
+	case path == "user" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"login": auth.Login})
+	case path == "gists" && r.Method == http.MethodGet:
+		s.listGists(w, r, auth)
+	case path == "gists" && r.Method == http.MethodPost:
+		s.postGist(w, r, auth)
+	case parts[0] == "gists" && (len(parts) == 2 || len(parts) == 3):
+		s.handleGist(w, r, auth, parts[1:])
+	default:
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+// Returns the first matching fault and counts it.
+func (s *Server) matchFault(r *http.Request) *Fault {
+	for i, fault := range s.faults {
+		if fault.Method != "" && fault.Method != r.Method {
+			continue
+		}
+		if !strings.HasPrefix(r.URL.Path, fault.Path) {
+			continue
+		}
+
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+			}
+		}
+
+		return fault
+	}
+
+	return nil
+}
+
+// Checks the token of the request and sets the rate limit headers. Writes the error response if it fails.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) *authorization {
+	header := r.Header.Get("Authorization")
+	var token string
+	switch {
+	case strings.HasPrefix(header, "token "):
+		token = strings.TrimPrefix(header, "token ")
+	case strings.HasPrefix(header, "Bearer "):
+		token = strings.TrimPrefix(header, "Bearer ")
+	case header == "":
+		writeError(w, http.StatusUnauthorized, "Requires authentication")
+		return nil
+	}
+
+	auth, exists := s.tokens[token]
+	if !exists {
+		writeError(w, http.StatusUnauthorized, "Bad credentials")
+		return nil
+	}
+
+	remaining, exists := s.remaining[auth.Login]
+	if !exists {
+		remaining = rateLimit
+	}
+	if remaining > 0 {
+		remaining--
+	}
+	s.remaining[auth.Login] = remaining
+
+	if auth.Scopes != nil {
+		w.Header().Set("X-OAuth-Scopes", strings.Join(auth.Scopes, ", "))
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(rateLimit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(s.clock().Add(time.Hour).Unix(), 10))
+
+	return auth
+}
+
+// Serves the content of a file in a revision: /raw/{id}/{version}/{filename}
+func (s *Server) handleRaw(w http.ResponseWriter, parts []string) {
+	if len(parts) != 3 {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	g, exists := s.gists[parts[0]]
+	if !exists {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	for _, rev := range g.History {
+		if rev.Version != parts[1] {
+			continue
+		}
+		if content, exists := rev.Files[parts[2]]; exists {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte(content))
+			return
+		}
+	}
+
+	writeError(w, http.StatusNotFound, "Not Found")
+}
+
+// Lists the gists of the user with pagination.
+func (s *Server) listGists(w http.ResponseWriter, r *http.Request, auth *authorization) {
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if perPage <= 0 {
+		perPage = defaultPerPage
+	} else if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page <= 0 {
+		page = 1
+	}
+
+	gists := s.userGists(auth.Login)
+	lastPage := (len(gists) + perPage - 1) / perPage
+	if lastPage == 0 {
+		lastPage = 1
+	}
+
+	result := []interface{}{}
+	for i := (page - 1) * perPage; i < page*perPage && i < len(gists); i++ {
+		result = append(result, s.gistJSON(gists[i], gists[i].current(), false))
+	}
+
+	// Links of the other pages.
+	var links []string
+	link := func(page int, rel string) {
+		links = append(links, fmt.Sprintf(`<%s/gists?per_page=%d&page=%d>; rel="%s"`, s.APIURL(), perPage, page, rel))
+	}
+	if page < lastPage {
+		link(page+1, "next")
+		link(lastPage, "last")
+	}
+	if page > 1 {
+		link(1, "first")
+		link(page-1, "prev")
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// Creates a gist.
+func (s *Server) postGist(w http.ResponseWriter, r *http.Request, auth *authorization) {
+	req := gistRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Problems parsing JSON")
+		return
+	}
+
+	files := map[string]string{}
+	for name, file := range req.Files {
+		if file == nil || file.Content == nil || *file.Content == "" {
+			writeError(w, http.StatusUnprocessableEntity, "Validation Failed: contents can't be blank")
+			return
+		}
+		files[name] = *file.Content
+	}
+	if len(files) == 0 {
+		writeError(w, http.StatusUnprocessableEntity, "Validation Failed: files can't be blank")
+		return
+	}
+
+	description := ""
+	if req.Description != nil {
+		description = *req.Description
+	}
+
+	g := s.createGist(auth.Login, description, req.Public, files)
+	writeJSON(w, http.StatusCreated, s.gistJSON(g, g.current(), true))
+}
+
+// Handles a single gist: /gists/{id} and /gists/{id}/{version}
+func (s *Server) handleGist(w http.ResponseWriter, r *http.Request, auth *authorization, parts []string) {
+	g, exists := s.gists[parts[0]]
+	if !exists || (g.Owner != auth.Login && !g.Public && r.Method != http.MethodGet) {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	// A revision of the gist.
+	if len(parts) == 2 {
+		for _, rev := range g.History {
+			if rev.Version == parts[1] && r.Method == http.MethodGet {
+				writeJSON(w, http.StatusOK, s.gistJSON(g, rev, true))
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		etag := `"` + g.current().Version + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		writeJSON(w, http.StatusOK, s.gistJSON(g, g.current(), true))
+	case http.MethodPatch:
+		if g.Owner != auth.Login {
+			writeError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+		s.patchGist(w, r, g)
+	case http.MethodDelete:
+		if g.Owner != auth.Login {
+			writeError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+		delete(s.gists, g.ID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+// Updates a gist. A null file or an empty content deletes the file, a filename renames it.
+func (s *Server) patchGist(w http.ResponseWriter, r *http.Request, g *gist) {
+	// Decode the files by hand, because a null file is not the same as a missing one.
+	var raw struct {
+		Description *string                    `json:"description"`
+		Files       map[string]json.RawMessage `json:"files"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		writeError(w, http.StatusBadRequest, "Problems parsing JSON")
+		return
+	}
+
+	files := map[string]string{}
+	for name, content := range g.current().Files {
+		files[name] = content
+	}
+
+	for name, data := range raw.Files {
+		if string(data) == "null" {
+			if _, exists := files[name]; !exists {
+				writeError(w, http.StatusUnprocessableEntity, "Validation Failed: file not found: "+name)
+				return
+			}
+			delete(files, name)
+			continue
+		}
+
+		file := fileRequest{}
+		if err := json.Unmarshal(data, &file); err != nil {
+			writeError(w, http.StatusBadRequest, "Problems parsing JSON")
+			return
+		}
+
+		content, exists := files[name]
+		if file.Content != nil {
+			content = *file.Content
+		} else if !exists {
+			writeError(w, http.StatusUnprocessableEntity, "Validation Failed: contents can't be blank")
+			return
+		}
+		if content == "" {
+			delete(files, name)
+			continue
+		}
+
+		newName := name
+		if file.Filename != nil && *file.Filename != "" {
+			delete(files, name)
+			newName = *file.Filename
+		}
+		files[newName] = content
+	}
+
+	if len(files) == 0 {
+		writeError(w, http.StatusUnprocessableEntity, "Validation Failed: files can't be blank")
+		return
+	}
+	if raw.Description != nil {
+		g.Description = *raw.Description
+	}
+
+	// Only a change of the files creates a new revision.
+	if !equalFiles(files, g.current().Files) {
+		g.History = append(g.History, &revision{Version: s.newHash(), CommittedAt: s.clock().UTC(), Files: files})
+	}
+
+	writeJSON(w, http.StatusOK, s.gistJSON(g, g.current(), true))
+}
+
+// Checks if the files are the same.
+func equalFiles(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, content := range a {
+		if other, exists := b[name]; !exists || other != content {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Handles the OAuth authorizations API with basic authentication: /authorizations and /authorizations/{id}
+func (s *Server) handleAuthorizations(w http.ResponseWriter, r *http.Request, parts []string) {
+	login, password, ok := r.BasicAuth()
+	if expected, exists := s.users[login]; !ok || !exists || expected == "" || expected != password {
+		writeError(w, http.StatusUnauthorized, "Bad credentials")
+		return
+	}
+
+	authJSON := func(auth *authorization, withToken bool) map[string]interface{} {
+		result := map[string]interface{}{
+			"id":     auth.ID,
+			"url":    fmt.Sprintf("%s/authorizations/%d", s.APIURL(), auth.ID),
+			"note":   auth.Note,
+			"scopes": auth.Scopes,
+		}
+		if withToken {
+			result["token"] = auth.Token
+		}
+		return result
+	}
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		var ids []int
+		for id, auth := range s.authorizations {
+			if auth.Login == login {
+				ids = append(ids, id)
+			}
+		}
+		sort.Ints(ids)
+
+		result := []interface{}{}
+		for _, id := range ids {
+			result = append(result, authJSON(s.authorizations[id], false))
+		}
+		writeJSON(w, http.StatusOK, result)
+
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		var req struct {
+			Scopes []string `json:"scopes"`
+			Note   string   `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "Problems parsing JSON")
+			return
+		}
+		for _, auth := range s.authorizations {
+			if auth.Login == login && auth.Note == req.Note {
+				writeError(w, http.StatusUnprocessableEntity, "Validation Failed: description already_exists")
+				return
+			}
+		}
+
+		auth := s.addAuthorization(login, s.newHash(), req.Note, req.Scopes)
+		writeJSON(w, http.StatusCreated, authJSON(auth, true))
+
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		id, _ := strconv.Atoi(parts[0])
+		auth, exists := s.authorizations[id]
+		if !exists || auth.Login != login {
+			writeError(w, http.StatusNotFound, "Not Found")
+			return
+		}
+		delete(s.authorizations, id)
+		delete(s.tokens, auth.Token)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+// Handles the OAuth device flow: /login/device/code and /login/oauth/access_token
+// Like GitHub, responds with 200 and an error field if the login is not finished.
+func (s *Server) handleDeviceFlow(w http.ResponseWriter, r *http.Request, path string) {
+	var req struct {
+		ClientID   string `json:"client_id"`
+		Scope      string `json:"scope"`
+		DeviceCode string `json:"device_code"`
+		GrantType  string `json:"grant_type"`
+	}
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&req) != nil {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	oauthError := func(code string) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"error": code, "error_description": code, "interval": s.DeviceInterval})
+	}
+
+	if _, exists := s.apps[req.ClientID]; !exists {
+		oauthError("incorrect_client_credentials")
+		return
+	}
+
+	switch path {
+	case "login/device/code":
+		deviceCode := s.newHash()
+		d := &device{
+			ClientID: req.ClientID,
+			UserCode: strings.ToUpper(deviceCode[:4] + "-" + deviceCode[4:8]),
+			Scopes:   strings.Fields(strings.Replace(req.Scope, ",", " ", -1)),
+			Expires:  s.clock().Add(deviceExpiry),
+		}
+		s.devices[deviceCode] = d
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"device_code":      deviceCode,
+			"user_code":        d.UserCode,
+			"verification_uri": s.URL + "/login/device",
+			"expires_in":       int(deviceExpiry.Seconds()),
+			"interval":         s.DeviceInterval,
+		})
+
+	case "login/oauth/access_token":
+		d, exists := s.devices[req.DeviceCode]
+		switch {
+		case req.GrantType != "urn:ietf:params:oauth:grant-type:device_code":
+			oauthError("unsupported_grant_type")
+		case !exists || d.ClientID != req.ClientID:
+			oauthError("incorrect_device_code")
+		case d.Issued || s.clock().After(d.Expires):
+			oauthError("expired_token")
+		case s.approver == "":
+			oauthError("authorization_pending")
+		default:
+			d.Issued = true
+			auth := s.addAuthorization(s.approver, "gho_"+s.newHash(), "", append([]string{}, d.Scopes...))
+			auth.ClientID = d.ClientID
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"access_token": auth.Token,
+				"token_type":   "bearer",
+				"scope":        strings.Join(d.Scopes, ","),
+			})
+		}
+
+	default:
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+// Revokes a token of the OAuth app with the basic authentication of the app: /applications/{client_id}/token
+func (s *Server) revokeToken(w http.ResponseWriter, r *http.Request, clientID string) {
+	user, password, ok := r.BasicAuth()
+	if secret, exists := s.apps[clientID]; !ok || !exists || user != clientID || password != secret {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	var req struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Problems parsing JSON")
+		return
+	}
+
+	auth, exists := s.tokens[req.AccessToken]
+	if !exists || auth.ClientID != clientID {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	delete(s.tokens, auth.Token)
+	delete(s.authorizations, auth.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
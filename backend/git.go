@@ -0,0 +1,509 @@
+package backend
+
+// Git repository backend. Every environment is a JSON file in the repository,
+// every change is a commit. Uses the git command line tool.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pyrooka/envman/config"
+)
+
+// Git related constants.
+const (
+	gitDefaultDir    = ".envman-repo"
+	gitDefaultBranch = "main"
+	gitRemoteName    = "origin"
+	gitFileExtension = ".json"
+	gitAuthorName    = "envman"
+)
+
+// Matches the commit hashes, the IDs of the revisions.
+var gitRevisionRegexp = regexp.MustCompile(`^[0-9a-f]{4,40}$`)
+
+// Registers the backend.
+func init() {
+	Register("git", func() IContextBackend { return &Git{} })
+}
+
+//-------------------------------------------------------------------
+// Structs
+//-------------------------------------------------------------------
+
+// GitConfig is the config section of the backend.
+type GitConfig struct {
+	Path   string `json:"path"`
+	Remote string `json:"remote"`
+	Branch string `json:"branch"`
+}
+
+// Git uses a git repository for backend storage. If a remote is configured,
+// the changes are pulled before and pushed after every modification.
+type Git struct {
+	Path   string
+	Remote string
+	Branch string
+}
+
+//-------------------------------------------------------------------
+//  Git commands
+//-------------------------------------------------------------------
+
+// Runs a git command in the repository and returns the trimmed output.
+func (g *Git) git(ctx context.Context, args ...string) (output string, err error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", g.Path}, args...)...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		// Keep the context error, so the caller can check it.
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return "", fmt.Errorf("git %v: %w: %v", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	output = strings.TrimSpace(stdout.String())
+
+	return
+}
+
+// Checks if the branch exists on the remote.
+func (g *Git) remoteBranchExists(ctx context.Context) (exists bool, err error) {
+	output, err := g.git(ctx, "ls-remote", "--heads", gitRemoteName, g.Branch)
+	exists = output != ""
+
+	return
+}
+
+// Pulls the changes from the remote if it is configured and the branch already exists there.
+// If our commits conflict with the remote, they are dropped and an ErrConflict is returned.
+func (g *Git) pull(ctx context.Context) (err error) {
+	if g.Remote == "" {
+		return
+	}
+
+	exists, err := g.remoteBranchExists(ctx)
+	if err != nil || !exists {
+		return
+	}
+
+	_, err = g.git(ctx, "pull", "--rebase", gitRemoteName, g.Branch)
+	if err != nil {
+		// A stopped rebase must not be left behind, even if the context is done.
+		if _, abortErr := g.git(context.Background(), "rebase", "--abort"); abortErr == nil {
+			// Drop our commits too, so the next change starts from the remote.
+			if _, resetErr := g.git(context.Background(), "reset", "--quiet", "--hard", "FETCH_HEAD"); resetErr != nil {
+				return resetErr
+			}
+			err = fmt.Errorf("%w: the same variables changed on the remote, try again: %v", ErrConflict, err)
+		}
+	}
+
+	return
+}
+
+// Pushes the commits to the remote if it is configured.
+// If someone pushed in the meantime, rebases on it and tries again.
+func (g *Git) push(ctx context.Context) (err error) {
+	if g.Remote == "" {
+		return
+	}
+
+	_, err = g.git(ctx, "push", gitRemoteName, "HEAD:refs/heads/"+g.Branch)
+	if err != nil {
+		if err = g.pull(ctx); err != nil {
+			return
+		}
+		_, err = g.git(ctx, "push", gitRemoteName, "HEAD:refs/heads/"+g.Branch)
+	}
+
+	return
+}
+
+// Commits the staged changes with the message and pushes them.
+func (g *Git) commit(ctx context.Context, message string) (err error) {
+	// Nothing to commit if the values didn't change.
+	if staged, err := g.git(ctx, "diff", "--cached", "--name-only"); err != nil || staged == "" {
+		return err
+	}
+
+	_, err = g.git(ctx, "commit", "--quiet", "-m", message)
+	if err != nil {
+		return
+	}
+
+	err = g.push(ctx)
+
+	return
+}
+
+// Creates the repository and adds the remote.
+func (g *Git) create(ctx context.Context) (err error) {
+	if err = os.MkdirAll(g.Path, 0700); err != nil {
+		return
+	}
+	if _, err = g.git(ctx, "init", "--quiet"); err != nil {
+		return
+	}
+	if _, err = g.git(ctx, "symbolic-ref", "HEAD", "refs/heads/"+g.Branch); err != nil {
+		return
+	}
+
+	// Use a default identity in the repository if the user doesn't have one, so the commits won't fail.
+	if email, _ := g.git(ctx, "config", "user.email"); email == "" {
+		hostname, _ := os.Hostname()
+		if _, err = g.git(ctx, "config", "user.name", gitAuthorName); err != nil {
+			return
+		}
+		if _, err = g.git(ctx, "config", "user.email", gitAuthorName+"@"+hostname); err != nil {
+			return
+		}
+	}
+
+	if g.Remote != "" {
+		_, err = g.git(ctx, "remote", "add", gitRemoteName, g.Remote)
+	}
+
+	return
+}
+
+//-------------------------------------------------------------------
+//  Environment files
+//-------------------------------------------------------------------
+
+// Checks the name of the environment, because it will be a file name. Used by the dir backend too.
+func checkEnvFileName(envName string) (err error) {
+	if envName == "" || strings.HasPrefix(envName, ".") || strings.ContainsAny(envName, `/\`) {
+		err = invalidEnvName(envName)
+	}
+
+	return
+}
+
+// Returns the file name of the environment in the repository.
+func envFileName(envName string) string {
+	return envName + gitFileExtension
+}
+
+// Checks if the file of the environment exists.
+func (g *Git) envExists(envName string) bool {
+	_, err := os.Stat(filepath.Join(g.Path, envFileName(envName)))
+
+	return err == nil
+}
+
+// Reads the variables of the environment from its file.
+func (g *Git) readEnv(envName string) (vars map[string]string, err error) {
+	if err = checkEnvFileName(envName); err != nil {
+		return
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(g.Path, envFileName(envName)))
+	if os.IsNotExist(err) {
+		return nil, envNotFound(envName)
+	} else if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &vars)
+
+	return
+}
+
+// Writes the variables to the file of the environment and stages it.
+func (g *Git) writeEnv(ctx context.Context, envName string, vars map[string]string) (err error) {
+	// Indented, so the diffs are readable. The keys are sorted by the encoder.
+	data, err := json.MarshalIndent(vars, "", "  ")
+	if err != nil {
+		return
+	}
+
+	err = ioutil.WriteFile(filepath.Join(g.Path, envFileName(envName)), append(data, '\n'), 0600)
+	if err != nil {
+		return
+	}
+
+	_, err = g.git(ctx, "add", "--", envFileName(envName))
+
+	return
+}
+
+// Returns the sorted keys as a comma separated list for the commit messages.
+func joinKeys(keys []string) string {
+	sorted := append([]string{}, keys...)
+	sort.Strings(sorted)
+
+	return strings.Join(sorted, ", ")
+}
+
+//-------------------------------------------------------------------
+//  Interface functions
+//-------------------------------------------------------------------
+
+// Init clones or creates the repository if not exists yet, otherwise pulls the changes.
+func (g *Git) Init(ctx context.Context, c *config.Config) (err error) {
+	conf := &GitConfig{}
+	if err = c.Bind("git", conf); err != nil {
+		return
+	}
+
+	g.Path = conf.Path
+	if g.Path == "" {
+		currentUser, err := user.Current()
+		if err != nil {
+			return err
+		}
+		g.Path = filepath.Join(currentUser.HomeDir, gitDefaultDir)
+	}
+	g.Remote = conf.Remote
+	g.Branch = conf.Branch
+	if g.Branch == "" {
+		g.Branch = gitDefaultBranch
+	}
+
+	if _, err = os.Stat(filepath.Join(g.Path, ".git")); os.IsNotExist(err) {
+		err = g.create(ctx)
+	}
+	if err != nil {
+		return
+	}
+
+	err = g.pull(ctx)
+
+	return
+}
+
+// List returns the name of environments or variables.
+func (g *Git) List(ctx context.Context, envName string) (result []string, err error) {
+	if envName != "" {
+		vars, err := g.readEnv(envName)
+		if err != nil {
+			return nil, err
+		}
+
+		for key := range vars {
+			result = append(result, key)
+		}
+
+		return result, nil
+	}
+
+	// The repository is removed by the cleanup, then there are no environments.
+	files, err := ioutil.ReadDir(g.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") || !strings.HasSuffix(file.Name(), gitFileExtension) {
+			continue
+		}
+		result = append(result, strings.TrimSuffix(file.Name(), gitFileExtension))
+	}
+
+	return
+}
+
+// Get returns the environment variables with its values.
+func (g *Git) Get(ctx context.Context, envName string) (vars map[string]string, err error) {
+	vars, err = g.readEnv(envName)
+
+	return
+}
+
+// Update saves the variables to the environment file and commits it.
+func (g *Git) Update(ctx context.Context, envName string, variables map[string]string) (err error) {
+	if err = checkEnvFileName(envName); err != nil {
+		return
+	}
+
+	// Create the environment if not already exists.
+	vars := map[string]string{}
+	message := "Create"
+	if g.envExists(envName) {
+		if vars, err = g.readEnv(envName); err != nil {
+			return
+		}
+		message = "Update"
+	}
+
+	keys := make([]string, 0, len(variables))
+	for key, value := range variables {
+		vars[key] = value
+		keys = append(keys, key)
+	}
+
+	if err = g.writeEnv(ctx, envName, vars); err != nil {
+		return
+	}
+
+	err = g.commit(ctx, fmt.Sprintf("%s %s: set %s", message, envName, joinKeys(keys)))
+
+	return
+}
+
+// Delete removes the environment file or the variables from it and commits it.
+func (g *Git) Delete(ctx context.Context, envName string, envVars []string) (err error) {
+	vars, err := g.readEnv(envName)
+	if err != nil {
+		return
+	}
+
+	if len(envVars) == 0 {
+		if _, err = g.git(ctx, "rm", "--quiet", "--", envFileName(envName)); err != nil {
+			return
+		}
+		err = g.commit(ctx, fmt.Sprintf("Delete %s", envName))
+		return
+	}
+
+	// The missing variables are skipped. Nothing is committed if none of them exists.
+	var removed []string
+	for _, envVar := range envVars {
+		if _, exists := vars[envVar]; exists {
+			delete(vars, envVar)
+			removed = append(removed, envVar)
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	if err = g.writeEnv(ctx, envName, vars); err != nil {
+		return
+	}
+
+	err = g.commit(ctx, fmt.Sprintf("Update %s: remove %s", envName, joinKeys(removed)))
+
+	return
+}
+
+// Replace writes the variables to the environment file instead of its current ones and commits it.
+func (g *Git) Replace(ctx context.Context, envName string, variables map[string]string) (err error) {
+	if err = checkEnvFileName(envName); err != nil {
+		return
+	}
+
+	message := "Create"
+	if g.envExists(envName) {
+		message = "Update"
+	}
+
+	if err = g.writeEnv(ctx, envName, variables); err != nil {
+		return
+	}
+
+	err = g.commit(ctx, fmt.Sprintf("%s %s: replace all variables", message, envName))
+
+	return
+}
+
+// CleanUp removes all the environments in a commit and deletes the local repository.
+// The commit is pushed, so the environments are removed from the remote too, but they stay in its history.
+func (g *Git) CleanUp(ctx context.Context) (err error) {
+	envs, err := g.List(ctx, "")
+	if err != nil {
+		return
+	}
+
+	if len(envs) > 0 {
+		for _, env := range envs {
+			if _, err = g.git(ctx, "rm", "--quiet", "--", envFileName(env)); err != nil {
+				return
+			}
+		}
+		if err = g.commit(ctx, "Remove all environments"); err != nil {
+			return
+		}
+	}
+
+	err = os.RemoveAll(g.Path)
+
+	return
+}
+
+// History returns the commits which changed the environment file, the newest first.
+func (g *Git) History(ctx context.Context, envName string) (revisions []Revision, err error) {
+	if err = checkEnvFileName(envName); err != nil {
+		return
+	}
+
+	// No commits yet.
+	if _, err = g.git(ctx, "rev-parse", "--verify", "--quiet", "HEAD"); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, envNotFound(envName)
+	}
+
+	// The commits deleting the file are left out, they have no variables to roll back to.
+	output, err := g.git(ctx, "log", "--diff-filter=AM", "--format=%H%x09%ct%x09%s", "--", envFileName(envName))
+	if err != nil {
+		return
+	}
+	if output == "" {
+		return nil, envNotFound(envName)
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected git log output: %q", line)
+		}
+		timestamp, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, Revision{ID: fields[0], Time: time.Unix(timestamp, 0), Message: fields[2]})
+	}
+
+	return
+}
+
+// GetRevision returns the variables of the environment file in the commit.
+func (g *Git) GetRevision(ctx context.Context, envName string, id string) (vars map[string]string, err error) {
+	if err = checkEnvFileName(envName); err != nil {
+		return
+	}
+
+	notFound := fmt.Errorf("%w: %q of environment %q", ErrRevisionNotFound, id, envName)
+	if !gitRevisionRegexp.MatchString(id) {
+		return nil, notFound
+	}
+
+	commit, err := g.git(ctx, "rev-parse", "--verify", "--quiet", id+"^{commit}")
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, notFound
+	}
+
+	content, err := g.git(ctx, "show", commit+":"+envFileName(envName))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, notFound
+	}
+
+	err = json.Unmarshal([]byte(content), &vars)
+
+	return
+}
@@ -0,0 +1,185 @@
+package backend_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pyrooka/envman/backend"
+	"github.com/pyrooka/envman/backend/backendtest"
+)
+
+// Creates a bare repository for the remote. The user and the system config of git are not used,
+// so the tests don't depend on the machine.
+func newGitRemote(t *testing.T) (remote string) {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(t.TempDir(), "gitconfig"))
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+
+	remote = filepath.Join(t.TempDir(), "remote.git")
+	if output, err := exec.Command("git", "init", "--quiet", "--bare", remote).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, output)
+	}
+
+	return
+}
+
+// Returns a git backend with a new local repository for the remote.
+func newTestGit(t *testing.T, remote string) (g *backend.Git) {
+	g = &backend.Git{}
+	backendtest.Init(t, g, sectionConfig(t, "git", &backend.GitConfig{Path: filepath.Join(t.TempDir(), "repo"), Remote: remote}))
+
+	return
+}
+
+// Returns the subjects of the commits on the branch of the remote, the newest first.
+func remoteCommits(t *testing.T, remote string) []string {
+	t.Helper()
+
+	output, err := exec.Command("git", "-C", remote, "log", "--format=%s", "main").CombinedOutput()
+	if err != nil {
+		t.Fatalf("git log: %v: %s", err, output)
+	}
+
+	return strings.Split(strings.TrimSpace(string(output)), "\n")
+}
+
+func TestGit(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.IContextBackend {
+		return newTestGit(t, newGitRemote(t))
+	})
+}
+
+func TestGitPushRetry(t *testing.T) {
+	ctx := context.Background()
+	remote := newGitRemote(t)
+	first := newTestGit(t, remote)
+	second := newTestGit(t, remote)
+
+	if err := first.Update(ctx, "dev", map[string]string{"A": "1"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	// The second one is behind, so its push is rejected, then it rebases and pushes again.
+	if err := second.Update(ctx, "prod", map[string]string{"B": "2"}); err != nil {
+		t.Fatalf("update behind the remote: %v", err)
+	}
+
+	want := []string{"Create prod: set B", "Create dev: set A"}
+	if commits := remoteCommits(t, remote); !reflect.DeepEqual(commits, want) {
+		t.Errorf("remote commits: %q, want %q", commits, want)
+	}
+	if vars, err := second.Get(ctx, "dev"); err != nil || vars["A"] != "1" {
+		t.Errorf("get rebased environment: %v, %v, want A=1", vars, err)
+	}
+}
+
+func TestGitConflict(t *testing.T) {
+	ctx := context.Background()
+	remote := newGitRemote(t)
+	first := newTestGit(t, remote)
+
+	if err := first.Update(ctx, "dev", map[string]string{"A": "1"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	second := newTestGit(t, remote)
+	if err := first.Update(ctx, "dev", map[string]string{"A": "2"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	// The second one changes the same variable without the change of the first one.
+	if err := second.Update(ctx, "dev", map[string]string{"A": "3"}); !errors.Is(err, backend.ErrConflict) {
+		t.Fatalf("update the same variable: %v, want ErrConflict", err)
+	}
+
+	// The rebase is aborted and the clone has the value of the remote.
+	if output, err := exec.Command("git", "-C", second.Path, "status", "--porcelain").CombinedOutput(); err != nil || len(output) != 0 {
+		t.Errorf("git status: %v: %s, want clean", err, output)
+	}
+	if vars, err := second.Get(ctx, "dev"); err != nil || vars["A"] != "2" {
+		t.Errorf("get after conflict: %v, %v, want A=2", vars, err)
+	}
+
+	// It can be changed again.
+	if err := second.Update(ctx, "dev", map[string]string{"A": "3"}); err != nil {
+		t.Fatalf("update again: %v", err)
+	}
+	if vars, err := newTestGit(t, remote).Get(ctx, "dev"); err != nil || vars["A"] != "3" {
+		t.Errorf("get the pushed value: %v, %v, want A=3", vars, err)
+	}
+}
+
+func TestGitReplace(t *testing.T) {
+	ctx := context.Background()
+	remote := newGitRemote(t)
+	g := newTestGit(t, remote)
+
+	if err := g.Update(ctx, "dev", map[string]string{"A": "1", "B": "2"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := g.Replace(ctx, "dev", map[string]string{"A": "3"}); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+
+	// The removed variable and the changed one are in the same commit.
+	want := []string{"Update dev: replace all variables", "Create dev: set A, B"}
+	if commits := remoteCommits(t, remote); !reflect.DeepEqual(commits, want) {
+		t.Errorf("remote commits: %q, want %q", commits, want)
+	}
+	if vars, err := g.Get(ctx, "dev"); err != nil || !reflect.DeepEqual(vars, map[string]string{"A": "3"}) {
+		t.Errorf("get: %v, %v, want only A=3", vars, err)
+	}
+
+	// A deleted environment is created again.
+	if err := g.Delete(ctx, "dev", nil); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := g.Replace(ctx, "dev", map[string]string{"A": "1"}); err != nil {
+		t.Fatalf("replace deleted environment: %v", err)
+	}
+	if commits := remoteCommits(t, remote); len(commits) != 4 || commits[0] != "Create dev: replace all variables" {
+		t.Errorf("remote commits: %q, want the environment created again", commits)
+	}
+}
+
+func TestGitCleanUp(t *testing.T) {
+	ctx := context.Background()
+	remote := newGitRemote(t)
+	g := newTestGit(t, remote)
+
+	if err := g.Update(ctx, "dev", map[string]string{"A": "1"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := g.Update(ctx, "prod", map[string]string{"B": "2"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := g.CleanUp(ctx); err != nil {
+		t.Fatalf("cleanup: %v", err)
+	}
+
+	// The removal is pushed too, so the environments are gone for every user of the remote,
+	// but they stay in the history of the remote.
+	if commits := remoteCommits(t, remote); commits[0] != "Remove all environments" || len(commits) != 3 {
+		t.Errorf("remote commits: %q, want the removal on top", commits)
+	}
+	if _, err := os.Stat(g.Path); !os.IsNotExist(err) {
+		t.Errorf("local repository: %v, want removed", err)
+	}
+
+	other := newTestGit(t, remote)
+	if envs, err := other.List(ctx, ""); err != nil || len(envs) != 0 {
+		t.Errorf("list of a new clone: %v, %v, want none", envs, err)
+	}
+	if revisions, err := other.History(ctx, "dev"); err != nil || len(revisions) != 1 {
+		t.Errorf("history of a removed environment: %v, %v, want the creation", revisions, err)
+	}
+}
@@ -4,12 +4,21 @@ package backend
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -19,60 +28,242 @@ import (
 	"github.com/pyrooka/envman/config"
 )
 
-// API URLs for requests.
+// Default URLs of GitHub.
 const (
-	apiURL     = "https://api.github.com"
-	userAPIURL = apiURL + "/user"
-	gistAPIURL = apiURL + "/gists"
-	authAPIURL = apiURL + "/authorizations"
+	defaultAPIURL = "https://api.github.com"
+	defaultWebURL = "https://github.com"
+)
+
+// Path of the API on GitHub Enterprise Server, after the URL of the web interface.
+const enterpriseAPIPath = "/api/v3"
+
+// API paths for requests.
+const (
+	userAPIPath     = "/user"
+	gistAPIPath     = "/gists"
+	revokeAPIPath   = "/applications/%s/token"
+	deviceCodePath  = "/login/device/code"
+	accessTokenPath = "/login/oauth/access_token"
+	tokensPagePath  = "/settings/tokens"
+	appsPagePath    = "/settings/applications"
+	newAppPagePath  = "/settings/applications/new"
 )
 
 // GitHub related constants.
 const (
-	gistDescription = "Envman Data"
-	authTokenNote   = "Envman @ "
-	reservedName    = "envman"
+	gistDescription  = "Envman Data"
+	reservedName     = "envman"
+	gistScope        = "gist"
+	deviceGrantType  = "urn:ietf:params:oauth:grant-type:device_code"
+	devicePollPeriod = 5 * time.Second // Default and the increment on slow_down of the polling.
+	gistsPerPage     = 100             // Maximum allowed by the API.
+	maxMergeAttempts = 3               // Merges of the concurrent writes before giving up.
+)
+
+// Retry policy of the idempotent requests.
+const (
+	maxRetries             = 3                // Retries after the first attempt.
+	defaultRetryDelay      = time.Second      // Base of the exponential backoff.
+	maxRetryWait           = 30 * time.Second // A longer wait is not worth it, the error is returned instead.
+	secondaryRateLimitWait = time.Minute      // Wait after a secondary rate limit without a Retry-After header.
+)
+
+// Errors of the requests.
+var (
+	errNotFound    = errors.New("not found")    // The resource doesn't exist.
+	errNotModified = errors.New("not modified") // The resource didn't change since the version in the If-None-Match header.
+)
+
+// The device flow cannot be started, e.g. the client ID is wrong or the device flow is not enabled for the app.
+var errNoDeviceFlow = errors.New("browser login is not available")
+
+// Finds the URL of the next page in the Link header.
+var nextLinkRegexp = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="next"`)
+
+// Types of the tokens, how they were obtained.
+const (
+	tokenTypePAT   = "pat"   // Personal access token created by the user.
+	tokenTypeOAuth = "oauth" // OAuth token from the device flow.
 )
 
+// Registers the backend.
+func init() {
+	Register("githubgist", func() IContextBackend { return &GitHubGist{} })
+}
+
 //-------------------------------------------------------------------
 // Structs
 //-------------------------------------------------------------------
 
+// GitHubGistConfig is the config section of the backend.
+type GitHubGistConfig struct {
+	Token        string `json:"token"`
+	TokenType    string `json:"tokenType"`    // How the token was obtained: pat or oauth.
+	ClientID     string `json:"clientId"`     // Client ID of an OAuth app for the device flow login.
+	ClientSecret string `json:"clientSecret"` // Secret of the OAuth app. Only needed to revoke the tokens.
+	GistID       string `json:"gistId"`       // ID of the envman gist. Found or created on the first run.
+	APIURL       string `json:"apiUrl"`       // Base URL of the API, e.g. https://github.example.com/api/v3 for Enterprise.
+	CABundle     string `json:"caBundle"`     // PEM file with the certificates of custom CAs to trust.
+}
+
 // GitHubGist uses the Gist service of GitHub for backend storage.
 type GitHubGist struct {
-	Token         string
+	Token      string
 	EnvManGist *gist
+	APIURL     string        // Base URL of the API. The default is used if empty.
+	WebURL     string        // Base URL of the web interface for the device flow. The default is used if empty.
+	Client     *http.Client  // Client for the requests. The default is used if nil.
+	RetryDelay time.Duration // Base delay of the backoff between the retries. The default is used if zero.
+
+	config *GitHubGistConfig
+	etag   string // ETag of the loaded gist.
 }
 
 // A file in the gist.
 type gistFile struct {
-	Filename string `json:"filename,omitempty"`
-	URL      string `json:"raw_url,omitempty"`
-	Content  string `json:"content,omitempty"`
+	Filename  string `json:"filename,omitempty"`
+	URL       string `json:"raw_url,omitempty"`
+	Content   string `json:"content,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"` // The content is too large, only the raw URL has all of it.
+}
+
+// A revision of the gist.
+type gistRevision struct {
+	Version     string    `json:"version"`
+	CommittedAt time.Time `json:"committed_at"`
 }
 
 // The gist.
 type gist struct {
+	ID          string               `json:"id,omitempty"`
 	URL         string               `json:"url,omitempty"`
 	Public      bool                 `json:"public,omitempty"`
 	Description string               `json:"description,omitempty"`
 	Files       map[string]*gistFile `json:"files"`
+	History     []gistRevision       `json:"history,omitempty"` // Newest first. Only in the single gist responses.
+}
+
+// Response of the device code request.
+type deviceCodeResponse struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+	Error           string `json:"error"`
 }
 
-// Auth token response.
-type authResponse struct {
-	URL    string   `json:"url,omitempty"`
-	Scopes []string `json:"scopes"`
-	Token  string   `json:"token,omitempty"`
-	Note   string   `json:"note"`
+// Response of the access token request. Error is set while the user didn't authorize the device.
+type accessTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	Scope            string `json:"scope"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+	Interval         int    `json:"interval"`
 }
 
 //-------------------------------------------------------------------
 //  HTTP requests
 //-------------------------------------------------------------------
 
+// Returns the URL of the API path.
+func (g *GitHubGist) apiURL(path string) string {
+	base := g.APIURL
+	if base == "" {
+		base = defaultAPIURL
+	}
+
+	return strings.TrimSuffix(base, "/") + path
+}
+
+// Returns the URL of the web path.
+func (g *GitHubGist) webURL(path string) string {
+	base := g.WebURL
+	if base == "" {
+		base = defaultWebURL
+	}
+
+	return strings.TrimSuffix(base, "/") + path
+}
+
+// Sets the URLs and the client from the config. The fields set directly take precedence.
+func (g *GitHubGist) configure() (err error) {
+	if g.APIURL == "" {
+		g.APIURL = g.config.APIURL
+	}
+	// The web interface of Enterprise is on the same host, the API is under /api/v3.
+	if g.WebURL == "" && g.APIURL != "" {
+		base := strings.TrimSuffix(g.APIURL, "/")
+		if strings.HasSuffix(base, enterpriseAPIPath) {
+			g.WebURL = strings.TrimSuffix(base, enterpriseAPIPath)
+		}
+	}
+
+	if g.Client == nil && g.config.CABundle != "" {
+		g.Client, err = newClientWithCAs(g.config.CABundle)
+	}
+
+	return
+}
+
+// Creates an HTTP client which trusts the CAs in the PEM file besides the system ones.
+func newClientWithCAs(path string) (client *http.Client, err error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	// The system pool is not available on every platform, then only the bundle is trusted.
+	pool, poolErr := x509.SystemCertPool()
+	if poolErr != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in the CA bundle %v", path)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	client = &http.Client{Transport: transport}
+
+	return
+}
+
 // Basic HTTP request.
-func makeRequest(url string, method string, content []byte, contentType string, auth ...string) (body []byte, err error) {
+func (g *GitHubGist) makeRequest(ctx context.Context, url string, method string, content []byte, contentType string, auth ...string) (body []byte, err error) {
+	body, _, err = g.request(ctx, url, method, content, contentType, nil, auth...)
+	return
+}
+
+// HTTP request with extra request headers, which returns the headers of the response too.
+// The idempotent requests are retried on server errors and secondary rate limits.
+func (g *GitHubGist) request(ctx context.Context, url string, method string, content []byte, contentType string, reqHeader http.Header, auth ...string) (body []byte, header http.Header, err error) {
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		var wait time.Duration
+		body, header, retry, wait, err = g.attempt(ctx, url, method, content, contentType, reqHeader, auth...)
+		if err == nil || !retry || !isIdempotent(method) || attempt == maxRetries {
+			return
+		}
+
+		// Wait as the server asked or back off.
+		if wait == 0 {
+			wait = g.backoff(attempt)
+		}
+		if wait > maxRetryWait {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// A single HTTP request. Retry is true if the request can be tried again, after the wait if it is known.
+func (g *GitHubGist) attempt(ctx context.Context, url string, method string, content []byte, contentType string, reqHeader http.Header, auth ...string) (body []byte, header http.Header, retry bool, wait time.Duration, err error) {
 	// Decide the type of the auth.
 	var token, user, pass string
 	if len(auth) == 1 {
@@ -82,11 +273,14 @@ func makeRequest(url string, method string, content []byte, contentType string,
 		pass = auth[1]
 	}
 
-	// Create the client.
-	client := &http.Client{}
+	// Get the client.
+	client := g.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
 
 	// Prepare the request.
-	req, err := http.NewRequest(method, url, bytes.NewReader(content))
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(content))
 	if err != nil {
 		return
 	}
@@ -99,24 +293,58 @@ func makeRequest(url string, method string, content []byte, contentType string,
 	if contentType != "" {
 		req.Header.Add("Content-Type", contentType)
 	}
+	for key, values := range reqHeader {
+		req.Header[key] = values
+	}
+	// The OAuth endpoints respond with a form without it.
+	req.Header.Add("Accept", "application/json")
 
 	// Fire the request.
 	resp, err := client.Do(req)
 	if err != nil {
 		return
 	}
+	defer resp.Body.Close()
+
+	// Nothing changed since the version in the If-None-Match header.
+	if resp.StatusCode == http.StatusNotModified {
+		err = errNotModified
+		return
+	}
 
 	// Check the status code.
-	successStatusCode := http.StatusOK
-	switch method {
-	case http.MethodPost:
-		successStatusCode = http.StatusCreated
-	case http.MethodDelete:
-		successStatusCode = http.StatusNoContent
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message := fmt.Sprintf("invalid status code: %v (%v)", resp.StatusCode, http.StatusText(resp.StatusCode))
+		retryAfter := parseRetryAfter(resp.Header)
+		remaining := resp.Header.Get("X-RateLimit-Remaining")
+
+		switch {
+		case (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests) && remaining == "0":
+			// The primary rate limit is exhausted until the reset, usually an hour. Not worth to wait.
+			err = &RateLimitError{Reset: parseRateLimitReset(resp.Header), Message: message}
+		case resp.StatusCode == http.StatusTooManyRequests,
+			resp.StatusCode == http.StatusForbidden && resp.Header.Get("Retry-After") != "":
+			// Secondary rate limit, the server tells how long to wait.
+			rateLimitErr := &RateLimitError{Message: message}
+			if retryAfter > 0 {
+				rateLimitErr.Reset = time.Now().Add(retryAfter)
+			}
+			err, retry, wait = rateLimitErr, true, retryAfter
+		case resp.StatusCode == http.StatusForbidden && isSecondaryRateLimit(resp.Body):
+			// Secondary rate limit without a Retry-After header, only the message tells it.
+			wait = secondaryRateLimitWait
+			err, retry = &RateLimitError{Reset: time.Now().Add(wait), Message: message}, true
+		case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+			err = fmt.Errorf("%w: %v", ErrUnauthorized, message)
+		case resp.StatusCode == http.StatusNotFound:
+			err = fmt.Errorf("%w: %v", errNotFound, message)
+		case resp.StatusCode >= 500:
+			err, retry, wait = errors.New(message), true, retryAfter
+		default:
+			err = errors.New(message)
+		}
 
-	}
-	if resp.StatusCode != successStatusCode {
-		return nil, fmt.Errorf("invalid status code: %v (%v). should be: %v", resp.StatusCode, http.StatusText(resp.StatusCode), successStatusCode)
+		return
 	}
 
 	// Read the body.
@@ -124,32 +352,91 @@ func makeRequest(url string, method string, content []byte, contentType string,
 	if err != nil {
 		return
 	}
-	resp.Body.Close()
+	header = resp.Header
+
+	return
+}
+
+// Checks if the error response is about the secondary rate limit. Only the start of the body is read.
+func isSecondaryRateLimit(body io.Reader) bool {
+	data, err := ioutil.ReadAll(io.LimitReader(body, 4096))
+	if err != nil {
+		return false
+	}
+	message := strings.ToLower(string(data))
+
+	return strings.Contains(message, "secondary rate limit") || strings.Contains(message, "abuse detection")
+}
+
+// Returns the wait before the retry: exponential backoff with jitter, so the clients in a loop spread out.
+func (g *GitHubGist) backoff(attempt int) time.Duration {
+	base := g.RetryDelay
+	if base <= 0 {
+		base = defaultRetryDelay
+	}
+
+	delay := base << uint(attempt)
+	// Somewhere between the half and the full delay.
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Checks if the request can be repeated without side effects.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return false
+}
+
+// Parses the Retry-After header, which is in seconds or a HTTP date. Zero if not set or invalid.
+func parseRetryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(time.Now()) {
+		return time.Until(date)
+	}
+
+	return 0
+}
+
+// Parses the X-RateLimit-Reset header, the Unix time of the reset. Zero if not set or invalid.
+func parseRateLimitReset(header http.Header) (reset time.Time) {
+	if seconds, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		reset = time.Unix(seconds, 0)
+	}
 
 	return
 }
 
-// HTTP get request.
-func makeGet(url string, token string) (body []byte, err error) {
-	body, err = makeRequest(url, http.MethodGet, nil, "", token)
+// HTTP get request with the token.
+func (g *GitHubGist) makeGet(ctx context.Context, url string) (body []byte, err error) {
+	body, err = g.makeRequest(ctx, url, http.MethodGet, nil, "", g.Token)
 	return
 }
 
-// HTTP post request.
-func makePost(url string, token string, content []byte) (body []byte, err error) {
-	body, err = makeRequest(url, http.MethodPost, content, "application/json", token)
+// HTTP post request with the token.
+func (g *GitHubGist) makePost(ctx context.Context, url string, content []byte) (body []byte, err error) {
+	body, err = g.makeRequest(ctx, url, http.MethodPost, content, "application/json", g.Token)
 	return
 }
 
-// HTTP patch request.
-func makePatch(url string, token string, content []byte) (body []byte, err error) {
-	body, err = makeRequest(url, http.MethodPatch, content, "application/json", token)
+// HTTP patch request with the token.
+func (g *GitHubGist) makePatch(ctx context.Context, url string, content []byte) (body []byte, err error) {
+	body, err = g.makeRequest(ctx, url, http.MethodPatch, content, "application/json", g.Token)
 	return
 }
 
-// HTTP delete request.
-func makeDelete(url string, token string) (err error) {
-	_, err = makeRequest(url, http.MethodDelete, nil, "", token)
+// HTTP delete request with the token.
+func (g *GitHubGist) makeDelete(ctx context.Context, url string) (err error) {
+	_, err = g.makeRequest(ctx, url, http.MethodDelete, nil, "", g.Token)
 	return
 }
 
@@ -157,119 +444,214 @@ func makeDelete(url string, token string) (err error) {
 //  Init functions
 //-------------------------------------------------------------------
 
-// Login to GitHub.
-func login() (token string, err error) {
-	// Username
-	fmt.Print("Username: ")
-	var username string
-	_, err = fmt.Scanln(&username)
-	if err != nil {
-		return
+// Login to GitHub. Uses the device flow if an OAuth app is configured and the user chooses it,
+// otherwise asks for a personal access token. There is no default OAuth app, the device flow
+// needs the client ID of an app registered by the user.
+func (g *GitHubGist) login(ctx context.Context) (token string, tokenType string, err error) {
+	if g.config.ClientID == "" {
+		fmt.Fprintf(os.Stderr, "To login in the browser instead, register an OAuth app with the device flow enabled at %v and set its client ID as clientId in the githubgist section of the config.\n", g.webURL(newAppPagePath))
+	} else {
+		fmt.Fprint(os.Stderr, "Login in the browser (1) or with a personal access token (2) [1]: ")
+		var choice string
+		// An empty line is an error, but it means the default.
+		fmt.Scanln(&choice)
+
+		if choice != "2" {
+			token, err = g.deviceLogin(ctx)
+			if !errors.Is(err, errNoDeviceFlow) {
+				return token, tokenTypeOAuth, err
+			}
+			fmt.Fprintf(os.Stderr, "%v, check the clientId in the config. Login with a personal access token.\n", err)
+		}
 	}
-	// Password
-	fmt.Print("Password: ")
-	bytePass, err := terminal.ReadPassword(int(syscall.Stdin))
+
+	// Personal access token.
+	fmt.Fprintf(os.Stderr, "Create a token with the gist scope (classic) or with the gists read and write permission (fine-grained) at %v\n", g.webURL(tokensPagePath))
+	fmt.Fprint(os.Stderr, "Token: ")
+	byteToken, err := terminal.ReadPassword(int(syscall.Stdin))
 	if err != nil {
 		return
 	}
-	password := string(bytePass)
 
-	// Newline after password entered.
-	fmt.Println()
+	// Newline after token entered.
+	fmt.Fprintln(os.Stderr)
 
-	token, err = createToken(username, password)
+	token = strings.TrimSpace(string(byteToken))
+	if token == "" {
+		return "", "", errors.New("empty token")
+	}
 
-	return
-}
+	err = g.checkToken(ctx, token)
 
-// Checks the token validity.
-func testToken(token string) (err error) {
-	// Simple get request to the authenticated user.
-	_, err = makeGet(userAPIURL, token)
-	return
+	return token, tokenTypePAT, err
 }
 
-// List the user's authentications.
-func listAuths(auth ...string) (auths []*authResponse, err error) {
-	// Get the tokens.
-	body, err := makeRequest(authAPIURL, http.MethodGet, nil, "", auth...)
+// Checks the token validity and returns its scopes. The fine-grained tokens have no scopes, then it is nil.
+func (g *GitHubGist) testToken(ctx context.Context) (scopes []string, err error) {
+	// Simple get request to the authenticated user.
+	_, header, err := g.request(ctx, g.apiURL(userAPIPath), http.MethodGet, nil, "", nil, g.Token)
 	if err != nil {
 		return
 	}
 
-	err = json.Unmarshal(body, &auths)
+	if _, exists := header["X-Oauth-Scopes"]; exists {
+		scopes = []string{}
+		for _, scope := range strings.Split(header.Get("X-OAuth-Scopes"), ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
 
 	return
 }
 
-// Get the app's authentication.
-func getAuth(note string, creds ...string) (envAuth *authResponse, err error) {
-	// Check if we already have an authentication for this machine.
-	auths, err := listAuths(creds...)
-	if err != nil {
+// Checks if the new token is valid and has the gist scope.
+func (g *GitHubGist) checkToken(ctx context.Context, token string) (err error) {
+	g.Token = token
+	scopes, err := g.testToken(ctx)
+	if errors.Is(err, ErrUnauthorized) {
+		return fmt.Errorf("%w: invalid token", ErrUnauthorized)
+	} else if err != nil {
 		return
 	}
 
-	for _, auth := range auths {
-		if auth.Note == note {
-			envAuth = auth
-			break
+	// The permissions of the fine-grained tokens are checked by the requests.
+	if scopes == nil {
+		return
+	}
+	for _, scope := range scopes {
+		if scope == gistScope {
+			return
 		}
 	}
 
-	return
+	return fmt.Errorf("%w: the token doesn't have the %v scope", ErrUnauthorized, gistScope)
 }
 
-// Basic auth request.
-func createToken(user string, pass string) (token string, err error) {
-	// Create the note for the token description.
-	hostname, err := os.Hostname()
+// Login with the OAuth device flow. The user authorizes envman in the browser, meanwhile it polls for the token.
+func (g *GitHubGist) deviceLogin(ctx context.Context) (token string, err error) {
+	payload, _ := json.Marshal(map[string]string{"client_id": g.config.ClientID, "scope": gistScope})
+	body, err := g.makeRequest(ctx, g.webURL(deviceCodePath), http.MethodPost, payload, "application/json")
 	if err != nil {
-		return
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("%w: %v", errNoDeviceFlow, err)
 	}
-	note := authTokenNote + hostname
 
-	// If already have an auth but don't have the token, delete it then create a new one.
-	// Why? Because once a token generated cannot get the secret from it again.
-	auth, err := getAuth(note, user, pass)
-	if err != nil {
+	code := deviceCodeResponse{}
+	if err = json.Unmarshal(body, &code); err != nil {
 		return
 	}
-	if auth != nil {
-		err = deleteAuth(auth.URL, user, pass)
+	if code.DeviceCode == "" {
+		return "", fmt.Errorf("%w: %v", errNoDeviceFlow, code.Error)
+	}
+
+	fmt.Fprintf(os.Stderr, "Open %v and enter the code: %v\n", code.VerificationURI, code.UserCode)
+
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = devicePollPeriod
+	}
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+
+	payload, _ = json.Marshal(map[string]string{
+		"client_id":   g.config.ClientID,
+		"device_code": code.DeviceCode,
+		"grant_type":  deviceGrantType,
+	})
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(interval):
+		}
+
+		body, err = g.makeRequest(ctx, g.webURL(accessTokenPath), http.MethodPost, payload, "application/json")
 		if err != nil {
 			return
 		}
-	}
 
-	// Create the payload.
-	data := authResponse{
-		Scopes: []string{"gist"},
-		Note:   note,
+		resp := accessTokenResponse{}
+		if err = json.Unmarshal(body, &resp); err != nil {
+			return
+		}
+
+		switch resp.Error {
+		case "":
+			return resp.AccessToken, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += devicePollPeriod
+			if resp.Interval > 0 {
+				interval = time.Duration(resp.Interval) * time.Second
+			}
+		default:
+			return "", fmt.Errorf("device login failed: %v: %v", resp.Error, resp.ErrorDescription)
+		}
+
+		if code.ExpiresIn > 0 && time.Now().After(deadline) {
+			return "", errors.New("device login failed: the code expired")
+		}
 	}
-	payload, _ := json.Marshal(data)
+}
 
-	// Make the request.
-	body, err := makeRequest(authAPIURL, http.MethodPost, payload, "application/json", user, pass)
-	if err != nil {
+// Revokes the token if it is possible. A personal access token can only be deleted by the user,
+// an OAuth token can be revoked with the secret of the app.
+func (g *GitHubGist) revokeToken(ctx context.Context) (err error) {
+	if g.config.TokenType == tokenTypeOAuth && g.config.ClientSecret != "" {
+		payload, _ := json.Marshal(map[string]string{"access_token": g.Token})
+		url := g.apiURL(fmt.Sprintf(revokeAPIPath, g.config.ClientID))
+		_, err = g.makeRequest(ctx, url, http.MethodDelete, payload, "application/json", g.config.ClientID, g.config.ClientSecret)
 		return
 	}
 
-	// Parse the response.
-	authResp := authResponse{}
-	err = json.Unmarshal(body, &authResp)
+	if g.config.TokenType == tokenTypeOAuth {
+		fmt.Fprintf(os.Stderr, "Revoke the access of the app at %v\n", g.webURL(appsPagePath))
+	} else {
+		fmt.Fprintf(os.Stderr, "Delete the token at %v\n", g.webURL(tokensPagePath))
+	}
+
+	return
+}
+
+// Logs in and stores the new token.
+func (g *GitHubGist) relogin(ctx context.Context) (err error) {
+	token, tokenType, err := g.login(ctx)
 	if err != nil {
 		return
 	}
 
-	token = authResp.Token
+	// Set the token to the struct and the config.
+	g.Token = token
+	g.config.Token = token
+	g.config.TokenType = tokenType
 
 	return
 }
 
-// Deletes the authentication on the given URL.
-func deleteAuth(URL string, auth ...string) (err error) {
-	_, err = makeRequest(URL, http.MethodDelete, nil, "", auth...)
+// Loads the envman gist if it is not loaded yet. Asks for a new token if the current one is invalid.
+func (g *GitHubGist) loadGist(ctx context.Context) (err error) {
+	if g.EnvManGist != nil {
+		return
+	}
+
+	envGist, err := g.getOrCreateGist(ctx, "")
+	if errors.Is(err, ErrUnauthorized) {
+		// Clear the token, so the user can login again.
+		fmt.Fprintln(os.Stderr, "Invalid token. Please create a new one.")
+		if err = g.relogin(ctx); err != nil {
+			return
+		}
+		envGist, err = g.getOrCreateGist(ctx, "")
+	}
+	if err != nil {
+		return
+	}
+
+	g.EnvManGist = envGist
+
 	return
 }
 
@@ -277,55 +659,127 @@ func deleteAuth(URL string, auth ...string) (err error) {
 //  GitHub Gist functions
 //-------------------------------------------------------------------
 
-// Gets the all of the user's gists from GitHub.
-func getGists(token string) (userGists *[]gist, err error) {
-	// Get all the gists.
-	body, err := makeGet(gistAPIURL, token)
+// Checks if the name of the environment is the reserved one.
+func checkReservedName(envName string) (err error) {
+	// INFO: envman is a reserved name.
+	if strings.ToLower(envName) == reservedName {
+		err = fmt.Errorf("%w: %v in all variation (lower/uppercase)", ErrReservedName, reservedName)
+	}
+
+	return
+}
+
+// Returns the URL of the next page from the Link header or an empty string on the last page.
+func nextPageURL(header http.Header) string {
+	for _, link := range header["Link"] {
+		if match := nextLinkRegexp.FindStringSubmatch(link); match != nil {
+			return match[1]
+		}
+	}
+
+	return ""
+}
+
+// Gets the all of the user's gists from GitHub. Follows the pages.
+func (g *GitHubGist) getGists(ctx context.Context) (userGists []gist, err error) {
+	pageURL := g.apiURL(fmt.Sprintf("%v?per_page=%v", gistAPIPath, gistsPerPage))
+	visited := map[string]bool{}
+
+	for pageURL != "" && !visited[pageURL] {
+		visited[pageURL] = true
+
+		body, header, err := g.request(ctx, pageURL, http.MethodGet, nil, "", nil, g.Token)
+		if err != nil {
+			return nil, err
+		}
+
+		// Parse the body json to structs.
+		page := []gist{}
+		if err = json.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+		userGists = append(userGists, page...)
+
+		pageURL = nextPageURL(header)
+	}
+
+	return
+}
+
+// Gets a gist by its ID and remembers its ETag. With an ETag it returns errNotModified
+// if the gist didn't change since that version.
+func (g *GitHubGist) getGist(ctx context.Context, id string, etag string) (foundGist *gist, err error) {
+	var reqHeader http.Header
+	if etag != "" {
+		reqHeader = http.Header{"If-None-Match": {etag}}
+	}
+
+	body, header, err := g.request(ctx, g.apiURL(gistAPIPath+"/"+url.PathEscape(id)), http.MethodGet, nil, "", reqHeader, g.Token)
 	if err != nil {
 		return
 	}
 
-	// Parse the body json to structs.
-	err = json.Unmarshal(body, &userGists)
-	if err != nil {
+	if err = json.Unmarshal(body, &foundGist); err != nil {
 		return
 	}
+	g.etag = header.Get("ETag")
 
 	return
 }
 
-// Gets the envman gist.
-func getOrCreateGist(token string) (g *gist, err error) {
+// Gets the envman gist. Searches for it by the description if the ID is unknown.
+// The ETag is passed to getGist if the ID is known.
+func (g *GitHubGist) getOrCreateGist(ctx context.Context, etag string) (envmanGist *gist, err error) {
+	if id := g.config.GistID; id != "" {
+		envmanGist, err = g.getGist(ctx, id, etag)
+		if errors.Is(err, errNotFound) {
+			err = fmt.Errorf("the gist %v doesn't exist anymore, attach another one or remove the gistId from the config", id)
+		}
+		return
+	}
+
 	// Get all the gists.
-	userGists, err := getGists(token)
+	userGists, err := g.getGists(ctx)
 	if err != nil {
 		return
 	}
 
-	// Iterate while we didn't find the envman gist.
-	for _, userGist := range *userGists {
-		if userGist.Description == gistDescription {
-			g = &userGist
-			return
+	// Find the envman gist. The list is ordered by the last update, so the first one is the most recent.
+	for i := range userGists {
+		if userGists[i].Description != gistDescription {
+			continue
+		}
+		if envmanGist == nil {
+			envmanGist = &userGists[i]
+		} else {
+			fmt.Fprintf(os.Stderr, "Warning: more than one %q gist found, using %v. Use envman attach to choose another one.\n", gistDescription, envmanGist.ID)
+			break
 		}
 	}
 
 	// If the gist not found create it now.
-	g, err = createGist(token)
+	if envmanGist == nil {
+		envmanGist, err = g.createGist(ctx)
+		if err != nil {
+			return
+		}
+	}
+
+	// Fetch it directly from now on.
+	g.config.GistID = envmanGist.ID
 
 	return
 }
 
 // Gets the content of a gist file.
-func getGistFileContent(url string, token string) (content map[string]string, err error) {
+func (g *GitHubGist) getGistFileContent(ctx context.Context, url string) (content map[string]string, err error) {
 	// Get the body in bytes.
-	body, err := makeGet(url, token)
+	body, err := g.makeGet(ctx, url)
 	if err != nil {
 		return
 	}
 
-	// Decode the JSON.
-	json.Unmarshal(body, &content)
+	content, err = decodeContent(body)
 
 	return
 }
@@ -343,16 +797,20 @@ func getEnvironments(g *gist) (envs []string) {
 }
 
 // Gets the variables in an environment.
-func getVariables(g *gist, envName string, token string) (vars []string, err error) {
+func (g *GitHubGist) getVariables(ctx context.Context, envName string) (vars []string, err error) {
+	if err = checkReservedName(envName); err != nil {
+		return
+	}
+
 	// First check if the environment exists.
-	env, exists := g.Files[envName]
+	env, exists := g.EnvManGist.Files[envName]
 	if !exists {
-		err = fmt.Errorf("environment \"%v\" doesn't exist", envName)
+		err = envNotFound(envName)
 		return
 	}
 
 	// Get the gist file.
-	envVars, err := getGistFileContent(env.URL, token)
+	envVars, err := g.getGistFileContent(ctx, env.URL)
 	if err != nil {
 		return
 	}
@@ -365,7 +823,7 @@ func getVariables(g *gist, envName string, token string) (vars []string, err err
 }
 
 // Creates the default gist.
-func createGist(token string) (createdGist *gist, err error) {
+func (g *GitHubGist) createGist(ctx context.Context) (createdGist *gist, err error) {
 	// Create the default gist file content.
 	content := map[string]string{"created": time.Now().String()}
 	contentJSON, err := json.Marshal(content)
@@ -389,7 +847,7 @@ func createGist(token string) (createdGist *gist, err error) {
 		return
 	}
 
-	body, err := makePost(gistAPIURL, token, baseJSON)
+	body, err := g.makePost(ctx, g.apiURL(gistAPIPath), baseJSON)
 	if err != nil {
 		return
 	}
@@ -403,151 +861,424 @@ func createGist(token string) (createdGist *gist, err error) {
 	return
 }
 
+// Patches the files of the gist. A nil file deletes the file.
+// The gist in the response replaces the current one, so it has the new URLs of the files.
+func (g *GitHubGist) patchGist(ctx context.Context, files map[string]*gistFile) (err error) {
+	// Create json from the changed files only.
+	body, err := json.Marshal(&gist{Files: files})
+	if err != nil {
+		return
+	}
+
+	// Let's patch the old one.
+	body, err = g.makePatch(ctx, g.EnvManGist.URL, body)
+	if err != nil {
+		return
+	}
+
+	// Parse the updated gist.
+	updatedGist := &gist{}
+	err = json.Unmarshal(body, updatedGist)
+	if err != nil {
+		return
+	}
+	g.EnvManGist = updatedGist
+	// The ETag of the new version is unknown.
+	g.etag = ""
+
+	return
+}
+
 // Updates the gist.
-func updateGist(token string, envName string, envVars map[string]string, envmanGist *gist) (err error) {
-	// INFO: envman is a reserved name.
-	if strings.ToLower(envName) == reservedName {
-		err = fmt.Errorf("%v is a reserved name in all variation (lower/uppercase)", reservedName)
+func (g *GitHubGist) updateGist(ctx context.Context, envName string, envVars map[string]Variable) (err error) {
+	if err = checkReservedName(envName); err != nil {
 		return
 	}
 
-	// Get or create the file contains our variables.
-	if env, exists := envmanGist.Files[envName]; exists {
-		// So the gist file (environment) exists.
-		// Get the content of the file.
-		content, err := getGistFileContent(env.URL, token)
-		if err != nil {
-			return err
-		}
+	changes := map[string]*Variable{}
+	for key := range envVars {
+		variable := envVars[key]
+		changes[key] = &variable
+	}
 
-		// Edit the content.
-		for key, value := range envVars {
-			content[key] = value
-		}
+	// The file is created if the environment doesn't exist.
+	err = g.modifyEnv(ctx, envName, changes, func(content map[string]string) error { return nil })
 
-		// Create JSON again.
-		contentJSON, err := json.Marshal(content)
-		if err != nil {
-			return err
-		}
+	return
+}
+
+// Deletes a gist.
+func (g *GitHubGist) deleteGist(ctx context.Context) (err error) {
+	err = g.makeDelete(ctx, g.EnvManGist.URL)
+
+	return
+}
+
+// Deletes a while gist file (environment).
+func (g *GitHubGist) deleteGistFile(ctx context.Context, envName string) (err error) {
+	if err = checkReservedName(envName); err != nil {
+		return
+	}
+
+	// Get the environment.
+	if _, exists := g.EnvManGist.Files[envName]; !exists {
+		err = envNotFound(envName)
+		return
+	}
+
+	// A null file deletes it.
+	err = g.patchGist(ctx, map[string]*gistFile{
+		envName: nil,
+	})
+
+	return
+}
 
-		// Set the content to the current env (a gist file).
-		env.Content = string(contentJSON)
+// Deletes a variable from the environment (gist file).
+func (g *GitHubGist) deleteEnvVars(ctx context.Context, envName string, envVars []string) (err error) {
+	if err = checkReservedName(envName); err != nil {
+		return
+	}
 
-		// Set this the only file in the gist.
-		envmanGist.Files = map[string]*gistFile{
-			envName: env,
+	// Check the environment.
+	if _, exists := g.EnvManGist.Files[envName]; !exists {
+		err = envNotFound(envName)
+		return
+	}
+
+	changes := map[string]*Variable{}
+	for _, envVar := range envVars {
+		changes[envVar] = nil
+	}
+
+	// The environment could be deleted in the meantime. The missing variables are skipped.
+	err = g.modifyEnv(ctx, envName, changes, func(content map[string]string) error {
+		if content == nil {
+			return envNotFound(envName)
 		}
+		return nil
+	})
+
+	return
+}
+
+//-------------------------------------------------------------------
+//  Environment files
+//-------------------------------------------------------------------
+
+// The content of an environment file maps the variables to their JSON entries. An entry is the value
+// as a string, like in the files of the earlier versions, or an object with the value and the metadata.
+// The entries are kept as raw JSON strings, so they can be compared and merged without decoding them.
+
+// Decodes the content of an environment file.
+func decodeContent(data []byte) (content map[string]string, err error) {
+	var entries map[string]json.RawMessage
+	if err = json.Unmarshal(data, &entries); err != nil || entries == nil {
+		return
+	}
+
+	content = make(map[string]string, len(entries))
+	for key, entry := range entries {
+		content[key] = string(entry)
+	}
+
+	return
+}
+
+// Encodes the content of an environment file.
+func encodeContent(content map[string]string) (data []byte, err error) {
+	entries := make(map[string]json.RawMessage, len(content))
+	for key, entry := range content {
+		entries[key] = json.RawMessage(entry)
+	}
+
+	data, err = json.Marshal(entries)
+
+	return
+}
 
+// Decodes an entry of an environment file.
+func decodeEntry(entry string) (variable Variable, err error) {
+	if strings.HasPrefix(strings.TrimSpace(entry), `"`) {
+		err = json.Unmarshal([]byte(entry), &variable.Value)
 	} else {
-		// This means no gist file (environment) found with the name.
-		// Create the JSON content.
-		contentJSON, err := json.Marshal(envVars)
-		if err != nil {
-			return err
-		}
+		err = json.Unmarshal([]byte(entry), &variable)
+	}
 
-		// Create a new gist file.
-		env := &gistFile{
-			Content: string(contentJSON),
-		}
+	return
+}
+
+// Encodes a variable to an entry. Without metadata it is only the value.
+func encodeEntry(variable Variable) (entry string, err error) {
+	var data []byte
+	if variable.IsZero() {
+		data, err = json.Marshal(variable.Value)
+	} else {
+		data, err = json.Marshal(variable)
+	}
+	entry = string(data)
+
+	return
+}
 
-		// Set this file to the only one in the gist.
-		envmanGist.Files = map[string]*gistFile{
-			envName: env,
+// Decodes the variables with their metadata from the content of an environment file.
+func contentVariables(content map[string]string) (vars map[string]Variable, err error) {
+	vars = make(map[string]Variable, len(content))
+	for key, entry := range content {
+		if vars[key], err = decodeEntry(entry); err != nil {
+			return nil, fmt.Errorf("variable %v: %v", key, err)
 		}
 	}
 
-	// Create json from the gist struct.
-	body, err := json.Marshal(&envmanGist)
+	return
+}
+
+// Decodes the values of the variables from the content of an environment file.
+func contentValues(content map[string]string) (vars map[string]string, err error) {
+	variables, err := contentVariables(content)
 	if err != nil {
 		return
 	}
 
-	// Let's patch the old one.
-	_, err = makePatch(envmanGist.URL, token, body)
+	vars = make(map[string]string, len(variables))
+	for key, variable := range variables {
+		vars[key] = variable.Value
+	}
 
 	return
 }
 
-// Deletes a gist.
-func deleteGist(token string, envmanGist *gist) (err error) {
-	err = makeDelete(envmanGist.URL, token)
+// Checks if the entries have the same value, description and tags. The timestamps don't matter.
+func sameEntry(a string, b string) bool {
+	if a == b {
+		return true
+	}
+
+	variableA, errA := decodeEntry(a)
+	variableB, errB := decodeEntry(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+
+	return variableA.Value == variableB.Value && variableA.Description == variableB.Description && equalTags(variableA.Tags, variableB.Tags)
+}
+
+//-------------------------------------------------------------------
+//  Concurrent writes
+//-------------------------------------------------------------------
+
+// Returns the version of the gist, empty if unknown. The gists in the list have no history.
+func gistVersion(g *gist) string {
+	if len(g.History) == 0 {
+		return ""
+	}
+
+	return g.History[0].Version
+}
+
+// Returns the version before ours if it is not the base, so someone else wrote between them.
+// Empty if nobody did or it cannot be known.
+func intermediateVersion(updated *gist, baseVersion string) string {
+	if baseVersion == "" || len(updated.History) < 2 {
+		return ""
+	}
+	// Nothing changed by our write or ours follows the base.
+	if updated.History[0].Version == baseVersion || updated.History[1].Version == baseVersion {
+		return ""
+	}
+
+	return updated.History[1].Version
+}
+
+// Applies the changes to a copy of the content. A nil variable deletes the variable.
+// The metadata of the changed variables is updated at the time.
+func applyChanges(content map[string]string, changes map[string]*Variable, now time.Time) (result map[string]string, err error) {
+	result = map[string]string{}
+	for key, entry := range content {
+		result[key] = entry
+	}
+	for key, variable := range changes {
+		if variable == nil {
+			delete(result, key)
+			continue
+		}
+
+		var current *Variable
+		if entry, exists := result[key]; exists {
+			decoded, err := decodeEntry(entry)
+			if err != nil {
+				return nil, fmt.Errorf("variable %v: %v", key, err)
+			}
+			current = &decoded
+		}
+
+		changed := Variable{Value: variable.Value, VariableMetadata: annotate(current, *variable, now)}
+		if result[key], err = encodeEntry(changed); err != nil {
+			return
+		}
+	}
 
 	return
 }
 
-// Deletes a while gist file (environment).
-func deleteGistFile(token string, envName string, envmanGist *gist) (err error) {
-	// INFO: envman is a reserved name.
-	if strings.ToLower(envName) == reservedName {
-		err = fmt.Errorf("%v is a reserved name in all variation (lower/uppercase)", reservedName)
-		return
+// Merges the changes of both sides since the base. If both changed a variable to different values,
+// their value is kept and the variable is a conflict. The timestamps of the entries are not compared.
+func mergeContents(base map[string]string, ours map[string]string, theirs map[string]string) (merged map[string]string, conflicts []string) {
+	merged = map[string]string{}
+
+	keys := map[string]bool{}
+	for _, content := range []map[string]string{base, ours, theirs} {
+		for key := range content {
+			keys[key] = true
+		}
 	}
 
-	// Get the environment.
-	if _, exists := envmanGist.Files[envName]; exists {
-		// Set the name to an empty string.
-		envmanGist.Files = map[string]*gistFile{
-			envName: nil,
+	for key := range keys {
+		baseValue, inBase := base[key]
+		ourValue, inOurs := ours[key]
+		theirValue, inTheirs := theirs[key]
+		oursChanged := inOurs != inBase || !sameEntry(ourValue, baseValue)
+		theirsChanged := inTheirs != inBase || !sameEntry(theirValue, baseValue)
+
+		switch {
+		case !theirsChanged || (inOurs == inTheirs && sameEntry(ourValue, theirValue)):
+			// Only we changed it or both the same way.
+			if inOurs {
+				merged[key] = ourValue
+			}
+		case !oursChanged:
+			if inTheirs {
+				merged[key] = theirValue
+			}
+		default:
+			if inTheirs {
+				merged[key] = theirValue
+			}
+			conflicts = append(conflicts, key)
 		}
-	} else {
-		err = fmt.Errorf("environment %v doesn't exists", envName)
+	}
+	sort.Strings(conflicts)
+
+	return
+}
+
+// Gets the content of the environment file in the gist. Uses the content in the single gist responses
+// if it is there, otherwise fetches the raw file. Nil if the file doesn't exist.
+func (g *GitHubGist) envContent(ctx context.Context, from *gist, envName string) (content map[string]string, err error) {
+	file, exists := from.Files[envName]
+	if !exists || file == nil {
+		return
+	}
+
+	if file.Content != "" && !file.Truncated {
+		content, err = decodeContent([]byte(file.Content))
 		return
 	}
 
-	// Create json from the gist struct.
-	body, err := json.Marshal(&envmanGist)
+	content, err = g.getGistFileContent(ctx, file.URL)
+
+	return
+}
+
+// Gets a revision of the gist.
+func (g *GitHubGist) getGistRevision(ctx context.Context, version string) (revision *gist, err error) {
+	body, err := g.makeGet(ctx, g.apiURL(gistAPIPath+"/"+url.PathEscape(g.EnvManGist.ID)+"/"+url.PathEscape(version)))
 	if err != nil {
 		return
 	}
 
-	// Let's patch the old one.
-	_, err = makePatch(envmanGist.URL, token, body)
+	err = json.Unmarshal(body, &revision)
 
 	return
 }
 
-// Deletes a variable from the environment (gist file).
-func deleteEnvVars(token string, envName string, envVars []string, envmanGist *gist) (err error) {
-	// Check the environment.
-	if env, exists := envmanGist.Files[envName]; exists {
-		// Get the content of the file.
-		content, err := getGistFileContent(env.URL, token)
+// Changes the variables of the environment file. A nil value deletes the variable.
+// The gist API has no conditional writes, so the version is checked before the write and the parent of
+// our version after it. The changes made by someone else since the loaded version are merged, unless
+// they changed the same variables: then their values are kept and ErrConflict is returned.
+// The check is called with the current content before the write.
+func (g *GitHubGist) modifyEnv(ctx context.Context, envName string, changes map[string]*Variable, check func(content map[string]string) error) (err error) {
+	now := time.Now()
+
+	// The content our changes are based on.
+	base, err := g.envContent(ctx, g.EnvManGist, envName)
+	if err != nil {
+		return
+	}
+	baseVersion := gistVersion(g.EnvManGist)
+
+	// Check if the gist changed since it was loaded. The conditional request costs nothing if not.
+	current, err := g.getGist(ctx, g.EnvManGist.ID, g.etag)
+	if err != nil && !errors.Is(err, errNotModified) {
+		return
+	}
+	if err == nil {
+		theirs, err := g.envContent(ctx, current, envName)
 		if err != nil {
 			return err
 		}
-
-		// Delete the keys.
-		for _, envVar := range envVars {
-			delete(content, envVar)
-		}
-
-		// Create JSON from the map.
-		contentJSON, err := json.Marshal(content)
+		ours, err := applyChanges(base, changes, now)
 		if err != nil {
 			return err
 		}
-		// Set the content to this env.
-		env.Content = string(contentJSON)
-
-		// Edit the files.
-		envmanGist.Files = map[string]*gistFile{
-			envName: env,
+		_, conflicts := mergeContents(base, ours, theirs)
+		g.EnvManGist, base, baseVersion = current, theirs, gistVersion(current)
+		// Nothing is written on a conflict. Saving again overwrites their values.
+		if len(conflicts) > 0 {
+			return conflict(envName, conflicts)
 		}
-	} else {
-		err = fmt.Errorf("environment %v not found", envName)
+	}
+
+	if err = check(base); err != nil {
 		return
 	}
 
-	// Create json from the gist struct.
-	body, err := json.Marshal(&envmanGist)
+	content, err := applyChanges(base, changes, now)
 	if err != nil {
 		return
 	}
+	var conflicts []string
+	for attempt := 0; ; attempt++ {
+		contentJSON, err := encodeContent(content)
+		if err != nil {
+			return err
+		}
 
-	// Let's patch the old one.
-	_, err = makePatch(envmanGist.URL, token, body)
+		// Set the new content of the file.
+		err = g.patchGist(ctx, map[string]*gistFile{
+			envName: {Content: string(contentJSON)},
+		})
+		if err != nil {
+			return err
+		}
+
+		// Someone else wrote between the check and our write, so their changes were overwritten.
+		intermediate := intermediateVersion(g.EnvManGist, baseVersion)
+		if intermediate == "" {
+			break
+		}
+		if attempt == maxMergeAttempts {
+			return fmt.Errorf("%w: %q changed too many times at the same time", ErrConflict, envName)
+		}
+
+		// Merge their changes back. Our version is the base of the next write.
+		revision, err := g.getGistRevision(ctx, intermediate)
+		if err != nil {
+			return err
+		}
+		theirs, err := g.envContent(ctx, revision, envName)
+		if err != nil {
+			return err
+		}
+		merged, newConflicts := mergeContents(base, content, theirs)
+		conflicts = append(conflicts, newConflicts...)
+		base, baseVersion, content = content, gistVersion(g.EnvManGist), merged
+	}
+
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		err = conflict(envName, conflicts)
+	}
 
 	return
 }
@@ -556,109 +1287,293 @@ func deleteEnvVars(token string, envName string, envVars []string, envmanGist *g
 //  Interface functions
 //-------------------------------------------------------------------
 
-// Init makes the authentication if necessary.
-func (g *GitHubGist) Init(c *config.Config) (err error) {
-	var token string
-	// Check if we have auth token.
-	if token = c.GitHubGist.Token; len(token) > 0 {
-		// If have, test is.
-		err = testToken(token)
-		// If no error occured it means we got HTTP 200.
-		if err != nil {
-			// Clear the error.
-			err = nil
-			fmt.Println("Invalid token. Please create a new one.")
-		}
-	} else {
-		// Otherwise we need to authenticate the user and create the token.
-		fmt.Println("No token found for authentication. Please login.")
+// Init makes the authentication if necessary. The gist is loaded by the first call which needs it.
+func (g *GitHubGist) Init(ctx context.Context, c *config.Config) (err error) {
+	g.config = &GitHubGistConfig{}
+	if err = c.Bind("githubgist", g.config); err != nil {
+		return
+	}
+	if err = g.configure(); err != nil {
+		return
 	}
 
-	if token == "" {
-		token, err = login()
-		if err != nil {
+	// Check if we have auth token.
+	g.Token = g.config.Token
+	if g.Token == "" {
+		// Otherwise we need to authenticate the user and create the token.
+		fmt.Fprintln(os.Stderr, "No token found for authentication. Please login.")
+		if err = g.relogin(ctx); err != nil {
 			return
 		}
 	}
 
-	// Set the token to the struct and the config.
-	g.Token = token
-	c.GitHubGist.Token = token
-
-	// Load our gist to the struct.
-	envGist, err := getOrCreateGist(token)
-	if err != nil {
+	// The token is checked by the first request, which loads the pinned gist.
+	if g.config.GistID != "" {
 		return
 	}
 
-	g.EnvManGist = envGist
+	err = g.loadGist(ctx)
 
 	return
 }
 
 // List the environments or variables.
-func (g *GitHubGist) List(envName string) (result []string, err error) {
+func (g *GitHubGist) List(ctx context.Context, envName string) (result []string, err error) {
+	if err = g.loadGist(ctx); err != nil {
+		return
+	}
+
 	// If no env name given, list the environments.
 	if envName == "" {
 		result = getEnvironments(g.EnvManGist)
 	} else {
-		result, err = getVariables(g.EnvManGist, envName, g.Token)
+		result, err = g.getVariables(ctx, envName)
 	}
 
 	return
 }
 
 // Get the environment from the gist and returns it as a map.
-func (g *GitHubGist) Get(envName string) (vars map[string]string, err error) {
+func (g *GitHubGist) Get(ctx context.Context, envName string) (vars map[string]string, err error) {
+	if err = checkReservedName(envName); err != nil {
+		return
+	}
+	if err = g.loadGist(ctx); err != nil {
+		return
+	}
+
 	// Get the environment from the map.
 	env, exists := g.EnvManGist.Files[envName]
 	if !exists {
-		return nil, errors.New("environment not found")
+		return nil, envNotFound(envName)
 	}
 
 	// Get the content of the gist file.
-	vars, err = getGistFileContent(env.URL, g.Token)
+	content, err := g.getGistFileContent(ctx, env.URL)
+	if err != nil {
+		return
+	}
+
+	vars, err = contentValues(content)
 
 	return
 }
 
 // Update variables in the environment.
-func (g *GitHubGist) Update(envName string, variables map[string]string) (err error) {
-	err = updateGist(g.Token, envName, variables, g.EnvManGist)
+func (g *GitHubGist) Update(ctx context.Context, envName string, variables map[string]string) (err error) {
+	vars := make(map[string]Variable, len(variables))
+	for key, value := range variables {
+		vars[key] = Variable{Value: value}
+	}
+
+	err = g.UpdateVariables(ctx, envName, vars)
+
+	return
+}
+
+// GetVariables gets the variables of the environment with their metadata.
+func (g *GitHubGist) GetVariables(ctx context.Context, envName string) (vars map[string]Variable, err error) {
+	if err = checkReservedName(envName); err != nil {
+		return
+	}
+	if err = g.loadGist(ctx); err != nil {
+		return
+	}
+
+	env, exists := g.EnvManGist.Files[envName]
+	if !exists {
+		return nil, envNotFound(envName)
+	}
+
+	content, err := g.getGistFileContent(ctx, env.URL)
+	if err != nil {
+		return
+	}
+
+	vars, err = contentVariables(content)
+
+	return
+}
+
+// UpdateVariables updates the variables in the environment with their metadata.
+func (g *GitHubGist) UpdateVariables(ctx context.Context, envName string, variables map[string]Variable) (err error) {
+	if err = g.loadGist(ctx); err != nil {
+		return
+	}
+
+	err = g.updateGist(ctx, envName, variables)
 
 	return
 }
 
 // Delete an environment.
-func (g *GitHubGist) Delete(envName string, envVars []string) (err error) {
+func (g *GitHubGist) Delete(ctx context.Context, envName string, envVars []string) (err error) {
+	if err = g.loadGist(ctx); err != nil {
+		return
+	}
+
 	// If no variable delete the whole gist file.
 	if len(envVars) == 0 {
-		err = deleteGistFile(g.Token, envName, g.EnvManGist)
+		err = g.deleteGistFile(ctx, envName)
 	} else {
-		err = deleteEnvVars(g.Token, envName, envVars, g.EnvManGist)
+		err = g.deleteEnvVars(ctx, envName, envVars)
 	}
 
 	return
 }
 
-// CleanUp removes all the created thing. Gist here.
-func (g *GitHubGist) CleanUp() (err error) {
-	// Delete the gist first.
-	err = deleteGist(g.Token, g.EnvManGist)
+// Attach uses the existing gist with the ID from now on.
+func (g *GitHubGist) Attach(ctx context.Context, id string) (err error) {
+	attachedGist, err := g.getGist(ctx, id, "")
+	if errors.Is(err, errNotFound) {
+		return fmt.Errorf("the gist %v doesn't exist", id)
+	} else if err != nil {
+		return
+	}
+
+	g.EnvManGist = attachedGist
+	g.config.GistID = attachedGist.ID
+
+	return
+}
+
+// Revalidate checks if the gist changed since the version with the ETag. The conditional request
+// doesn't count against the rate limit if nothing changed.
+func (g *GitHubGist) Revalidate(ctx context.Context, etag string) (current string, changed bool, err error) {
+	if g.EnvManGist == nil && etag != "" && g.config.GistID != "" {
+		envGist, err := g.getOrCreateGist(ctx, etag)
+		switch {
+		case errors.Is(err, errNotModified):
+			return etag, false, nil
+		case err == nil:
+			g.EnvManGist = envGist
+		case !errors.Is(err, ErrUnauthorized):
+			return "", false, err
+		}
+	}
+
+	// Invalid token or no version to compare, load it normally.
+	if err = g.loadGist(ctx); err != nil {
+		return
+	}
+
+	return g.etag, g.etag == "" || g.etag != etag, nil
+}
+
+// History returns the revisions of the gist, the newest first. These are the revisions of the whole gist,
+// so some of them may not change the environment.
+func (g *GitHubGist) History(ctx context.Context, envName string) (revisions []Revision, err error) {
+	if err = checkReservedName(envName); err != nil {
+		return
+	}
+	if err = g.loadGist(ctx); err != nil {
+		return
+	}
+
+	// The gists found in the list have no history.
+	if len(g.EnvManGist.History) == 0 {
+		envGist, err := g.getGist(ctx, g.EnvManGist.ID, "")
+		if err != nil {
+			return nil, err
+		}
+		g.EnvManGist = envGist
+	}
+
+	if _, exists := g.EnvManGist.Files[envName]; !exists {
+		return nil, envNotFound(envName)
+	}
+
+	for _, revision := range g.EnvManGist.History {
+		revisions = append(revisions, Revision{ID: revision.Version, Time: revision.CommittedAt})
+	}
+
+	return
+}
+
+// GetRevision returns the variables of the environment in the revision of the gist.
+func (g *GitHubGist) GetRevision(ctx context.Context, envName string, id string) (vars map[string]string, err error) {
+	if err = checkReservedName(envName); err != nil {
+		return
+	}
+	if err = g.loadGist(ctx); err != nil {
+		return
+	}
+
+	notFound := fmt.Errorf("%w: %q of environment %q", ErrRevisionNotFound, id, envName)
+	revision, err := g.getGistRevision(ctx, id)
+	if errors.Is(err, errNotFound) {
+		return nil, notFound
+	} else if err != nil {
+		return
+	}
+
+	content, err := g.envContent(ctx, revision, envName)
 	if err != nil {
 		return
 	}
+	if content == nil {
+		return nil, notFound
+	}
+
+	vars, err = contentValues(content)
+
+	return
+}
+
+// Replace replaces the variables of the environment file, or creates it, in one revision of the gist.
+// The variables added by someone else since the gist was loaded are merged like in the updates.
+func (g *GitHubGist) Replace(ctx context.Context, envName string, variables map[string]string) (err error) {
+	if err = checkReservedName(envName); err != nil {
+		return
+	}
+	if err = g.loadGist(ctx); err != nil {
+		return
+	}
 
-	// Now the authorization.
-	auth, err := getAuth(g.Token)
+	current, err := g.envContent(ctx, g.EnvManGist, envName)
 	if err != nil {
 		return
-	} else if auth == nil {
-		err = errors.New("no authorization found")
+	}
+
+	// The current variables missing from the new ones are deleted.
+	changes := map[string]*Variable{}
+	for key := range current {
+		changes[key] = nil
+	}
+	for key, value := range variables {
+		changes[key] = &Variable{Value: value}
+	}
+
+	err = g.modifyEnv(ctx, envName, changes, func(content map[string]string) error { return nil })
+
+	return
+}
+
+// CleanUp removes all the created thing. The gist and the token here.
+func (g *GitHubGist) CleanUp(ctx context.Context) (err error) {
+	if err = g.loadGist(ctx); err != nil {
+		return
+	}
+
+	// Delete the gist first.
+	err = g.deleteGist(ctx)
+	if err != nil {
+		return
+	}
+
+	g.EnvManGist = &gist{}
+	g.config.GistID = ""
+
+	// Now the token.
+	err = g.revokeToken(ctx)
+	if err != nil {
 		return
 	}
 
-	err = deleteAuth(auth.URL, g.Token)
+	// Forget the token, it won't work anymore.
+	g.Token = ""
+	g.config.Token = ""
+	g.config.TokenType = ""
 
 	return
 }
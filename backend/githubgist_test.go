@@ -0,0 +1,582 @@
+package backend_test
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pyrooka/envman/backend"
+	"github.com/pyrooka/envman/backend/backendtest"
+	"github.com/pyrooka/envman/backend/fakegithub"
+	"github.com/pyrooka/envman/config"
+)
+
+// Returns a gist backend logged in to a new fake GitHub.
+func newTestGist(t *testing.T) (g *backend.GitHubGist, server *fakegithub.Server) {
+	server = fakegithub.New()
+	t.Cleanup(server.Close)
+	server.AddToken("octocat", "token", "gist")
+
+	g = &backend.GitHubGist{APIURL: server.URL, WebURL: server.URL, Client: server.Client(), RetryDelay: time.Millisecond}
+	backendtest.Init(t, g, sectionConfig(t, "githubgist", &backend.GitHubGistConfig{Token: "token"}))
+
+	return
+}
+
+// Counts the requests to the path with the method.
+func countRequests(server *fakegithub.Server, request string) (count int) {
+	for _, r := range server.Requests() {
+		if r == request {
+			count++
+		}
+	}
+
+	return
+}
+
+// Returns the decoded config section of the gist backend.
+func gistSection(t *testing.T, c *config.Config) (section backend.GitHubGistConfig) {
+	t.Helper()
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sections map[string]json.RawMessage
+	if err = json.Unmarshal(data, &sections); err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(sections["githubgist"], &section); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+// Replaces the standard input with the text until the end of the test.
+func fakeStdin(t *testing.T, text string) {
+	t.Helper()
+
+	stdin, input, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	input.WriteString(text)
+	input.Close()
+
+	oldStdin := os.Stdin
+	os.Stdin = stdin
+	t.Cleanup(func() {
+		os.Stdin = oldStdin
+		stdin.Close()
+	})
+}
+
+// Redirects the standard error to a file until the end of the test. The returned function reads it.
+func captureStderr(t *testing.T) func() string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "stderr")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldStderr := os.Stderr
+	os.Stderr = file
+	t.Cleanup(func() {
+		os.Stderr = oldStderr
+		file.Close()
+	})
+
+	return func() string {
+		data, _ := ioutil.ReadFile(path)
+		return string(data)
+	}
+}
+
+// Returns the values of the environment file in the gist. The entries are plain values or variables with metadata.
+func gistFileValues(t *testing.T, server *fakegithub.Server, id string, envName string) (vars map[string]string) {
+	t.Helper()
+
+	content, exists := server.File(id, envName)
+	if !exists {
+		t.Fatalf("file %v doesn't exist", envName)
+	}
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(content), &entries); err != nil {
+		t.Fatalf("file %v: %v", envName, err)
+	}
+
+	vars = map[string]string{}
+	for key, entry := range entries {
+		var variable backend.Variable
+		if err := json.Unmarshal(entry, &variable.Value); err != nil {
+			if err = json.Unmarshal(entry, &variable); err != nil {
+				t.Fatalf("variable %v: %v", key, err)
+			}
+		}
+		vars[key] = variable.Value
+	}
+
+	return
+}
+
+func TestGitHubGist(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.IContextBackend {
+		g, _ := newTestGist(t)
+		return g
+	})
+}
+
+func TestGitHubGistRetry(t *testing.T) {
+	ctx := context.Background()
+	g, server := newTestGist(t)
+	if err := g.Update(ctx, "dev", map[string]string{"A": "1"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		fault fakegithub.Fault
+		call  func() error
+		check func(err error) bool
+	}{
+		{
+			name:  "ServerError",
+			fault: fakegithub.Fault{Method: http.MethodGet, Status: http.StatusBadGateway, Times: 3},
+			call:  func() error { _, err := g.Get(ctx, "dev"); return err },
+			check: func(err error) bool { return err == nil },
+		},
+		{
+			name:  "TooManyServerErrors",
+			fault: fakegithub.Fault{Method: http.MethodGet, Status: http.StatusServiceUnavailable, Times: 4},
+			call:  func() error { _, err := g.Get(ctx, "dev"); return err },
+			check: func(err error) bool { return err != nil },
+		},
+		{
+			// Not idempotent, so it could be applied twice.
+			name:  "PatchNotRetried",
+			fault: fakegithub.Fault{Method: http.MethodPatch, Status: http.StatusInternalServerError, Times: 1},
+			call:  func() error { return g.Update(ctx, "dev", map[string]string{"B": "2"}) },
+			check: func(err error) bool { return err != nil },
+		},
+		{
+			name:  "SecondaryRateLimit",
+			fault: fakegithub.Fault{Method: http.MethodGet, Status: http.StatusForbidden, RetryAfter: time.Second, Times: 1},
+			call:  func() error { _, err := g.Get(ctx, "dev"); return err },
+			check: func(err error) bool { return err == nil },
+		},
+		{
+			// Waiting that long is not worth it.
+			name:  "SecondaryRateLimitTooLong",
+			fault: fakegithub.Fault{Method: http.MethodGet, Status: http.StatusTooManyRequests, RetryAfter: time.Hour, Times: 1},
+			call:  func() error { _, err := g.Get(ctx, "dev"); return err },
+			check: func(err error) bool {
+				var rateLimitErr *backend.RateLimitError
+				return errors.As(err, &rateLimitErr) && rateLimitErr.Reset.After(time.Now().Add(50*time.Minute))
+			},
+		},
+		{
+			// Only the message tells it, GitHub asks to wait at least a minute.
+			name:  "SecondaryRateLimitMessage",
+			fault: fakegithub.Fault{Method: http.MethodGet, Secondary: true, Times: 1},
+			call:  func() error { _, err := g.Get(ctx, "dev"); return err },
+			check: func(err error) bool {
+				var rateLimitErr *backend.RateLimitError
+				return errors.As(err, &rateLimitErr) && !errors.Is(err, backend.ErrUnauthorized) &&
+					rateLimitErr.Reset.After(time.Now().Add(59*time.Second))
+			},
+		},
+		{
+			name:  "PrimaryRateLimit",
+			fault: fakegithub.Fault{RateLimited: true, Times: 1},
+			call:  func() error { _, err := g.Get(ctx, "dev"); return err },
+			check: func(err error) bool {
+				var rateLimitErr *backend.RateLimitError
+				return errors.As(err, &rateLimitErr) && errors.Is(err, backend.ErrRateLimited) && !rateLimitErr.Reset.IsZero()
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server.ClearFaults()
+			server.Inject(test.fault)
+
+			if err := test.call(); !test.check(err) {
+				t.Errorf("unexpected result: %v", err)
+			}
+		})
+	}
+
+	server.ClearFaults()
+	if vars, err := g.Get(ctx, "dev"); err != nil || len(vars) != 1 {
+		t.Errorf("get after the faults: %v, %v, want only A", vars, err)
+	}
+}
+
+func TestGitHubGistFaults(t *testing.T) {
+	ctx := context.Background()
+	g, server := newTestGist(t)
+	if err := g.Update(ctx, "dev", map[string]string{"A": "1"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	server.Inject(fakegithub.Fault{Method: http.MethodPatch, Status: http.StatusUnprocessableEntity, Times: 1})
+	if err := g.Update(ctx, "dev", map[string]string{"B": "2"}); err == nil {
+		t.Error("update with 422: no error")
+	}
+
+	server.Inject(fakegithub.Fault{Status: http.StatusUnauthorized, Times: 1})
+	if _, err := g.Get(ctx, "dev"); !errors.Is(err, backend.ErrUnauthorized) {
+		t.Errorf("get with 401: %v, want ErrUnauthorized", err)
+	}
+
+	server.Inject(fakegithub.Fault{Status: http.StatusForbidden, Times: 1})
+	if _, err := g.Get(ctx, "dev"); !errors.Is(err, backend.ErrUnauthorized) {
+		t.Errorf("get with 403: %v, want ErrUnauthorized", err)
+	}
+
+	// A secondary rate limit is not an invalid token, so the token is kept and no login is asked.
+	c := sectionConfig(t, "githubgist", &backend.GitHubGistConfig{Token: "token", GistID: server.GistIDs("octocat")[0]})
+	limited := &backend.GitHubGist{APIURL: server.URL, Client: server.Client()}
+	backendtest.Init(t, limited, c)
+	server.Inject(fakegithub.Fault{Secondary: true, Times: 1})
+	if _, err := limited.List(ctx, ""); !errors.Is(err, backend.ErrRateLimited) {
+		t.Errorf("list with a secondary rate limit: %v, want ErrRateLimited", err)
+	}
+	if section := gistSection(t, c); section.Token != "token" {
+		t.Errorf("token after a secondary rate limit: %q, want kept", section.Token)
+	}
+
+	server.Inject(fakegithub.Fault{Delay: time.Second, Times: 1})
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := g.Get(timeoutCtx, "dev"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("get with a delay: %v, want the deadline", err)
+	}
+
+	if vars, err := g.Get(ctx, "dev"); err != nil || len(vars) != 1 || vars["A"] != "1" {
+		t.Errorf("get after the faults: %v, %v, want only A", vars, err)
+	}
+
+	// The pinned gist is deleted.
+	stale := &backend.GitHubGist{APIURL: server.URL, Client: server.Client()}
+	backendtest.Init(t, stale, sectionConfig(t, "githubgist", &backend.GitHubGistConfig{Token: "token", GistID: "deleted"}))
+	if _, err := stale.List(ctx, ""); err == nil || !strings.Contains(err.Error(), "doesn't exist anymore") {
+		t.Errorf("list of a deleted gist: %v, want it doesn't exist", err)
+	}
+}
+
+func TestGitHubGistPagination(t *testing.T) {
+	ctx := context.Background()
+	server := fakegithub.New()
+	t.Cleanup(server.Close)
+	server.AddToken("octocat", "token", "gist")
+
+	// The envman gist is the oldest, so it is on the last page.
+	id := server.AddGist("octocat", "Envman Data", false, map[string]string{"envman": "{}", "dev": `{"A": "1"}`})
+	for i := 0; i < 250; i++ {
+		server.AddGist("octocat", "other", false, map[string]string{"file": "content"})
+	}
+
+	c := sectionConfig(t, "githubgist", &backend.GitHubGistConfig{Token: "token"})
+	g := &backend.GitHubGist{APIURL: server.URL, Client: server.Client()}
+	backendtest.Init(t, g, c)
+
+	if count := countRequests(server, "GET /gists"); count != 3 {
+		t.Errorf("list requests: %v, want 3 pages", count)
+	}
+	if ids := server.GistIDs("octocat"); len(ids) != 251 {
+		t.Errorf("gists: %v, want no new one", len(ids))
+	}
+	if vars, err := g.Get(ctx, "dev"); err != nil || vars["A"] != "1" {
+		t.Errorf("get: %v, %v, want A=1", vars, err)
+	}
+
+	// The gist is pinned in the config, so it is not searched again.
+	section := gistSection(t, c)
+	if section.GistID != id {
+		t.Fatalf("pinned gist: %q, want %q", section.GistID, id)
+	}
+	pinned := &backend.GitHubGist{APIURL: server.URL, Client: server.Client()}
+	backendtest.Init(t, pinned, sectionConfig(t, "githubgist", &section))
+	if _, err := pinned.List(ctx, ""); err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if count := countRequests(server, "GET /gists"); count != 3 {
+		t.Errorf("list requests: %v, want no more", count)
+	}
+}
+
+func TestGitHubGistETag(t *testing.T) {
+	ctx := context.Background()
+	server := fakegithub.New()
+	t.Cleanup(server.Close)
+	server.AddToken("octocat", "token", "gist")
+	id := server.AddGist("octocat", "Envman Data", false, map[string]string{"envman": "{}", "dev": `{"A": "1"}`})
+
+	// Every session starts with the pinned gist not loaded yet.
+	session := func() *backend.GitHubGist {
+		g := &backend.GitHubGist{APIURL: server.URL, Client: server.Client()}
+		backendtest.Init(t, g, sectionConfig(t, "githubgist", &backend.GitHubGistConfig{Token: "token", GistID: id}))
+		return g
+	}
+
+	etag, changed, err := session().Revalidate(ctx, "")
+	if err != nil || !changed || etag == "" {
+		t.Fatalf("revalidate without a version: %q, %v, %v, want an ETag", etag, changed, err)
+	}
+
+	// Answered with 304 Not Modified.
+	if current, changed, err := session().Revalidate(ctx, etag); err != nil || changed || current != etag {
+		t.Errorf("revalidate the same version: %q, %v, %v, want not changed", current, changed, err)
+	}
+
+	server.SetFile(id, "dev", `{"A": "2"}`)
+	g := session()
+	current, changed, err := g.Revalidate(ctx, etag)
+	if err != nil || !changed || current == etag || current == "" {
+		t.Errorf("revalidate a changed gist: %q, %v, %v, want a new ETag", current, changed, err)
+	}
+	if vars, err := g.Get(ctx, "dev"); err != nil || vars["A"] != "2" {
+		t.Errorf("get: %v, %v, want the new value", vars, err)
+	}
+}
+
+func TestGitHubGistMerge(t *testing.T) {
+	tests := []struct {
+		name    string
+		theirs  string // The content written by someone else.
+		during  bool   // Written between our check and our write, otherwise before the check.
+		want    map[string]string
+		wantErr error
+		patches int
+	}{
+		{"DifferentVariables", `{"A": "1", "B": "2"}`, false, map[string]string{"A": "3", "B": "2"}, nil, 1},
+		{"SameVariable", `{"A": "2", "B": "1"}`, false, map[string]string{"A": "2", "B": "1"}, backend.ErrConflict, 0},
+		{"SameValue", `{"A": "3", "B": "1"}`, false, map[string]string{"A": "3", "B": "1"}, nil, 1},
+		{"DifferentVariablesDuring", `{"A": "1", "B": "2"}`, true, map[string]string{"A": "3", "B": "2"}, nil, 2},
+		{"SameVariableDuring", `{"A": "2", "B": "1"}`, true, map[string]string{"A": "2", "B": "1"}, backend.ErrConflict, 2},
+		{"DeletedDuring", `{"A": "1"}`, true, map[string]string{"A": "3"}, nil, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			server := fakegithub.New()
+			t.Cleanup(server.Close)
+			server.AddToken("octocat", "token", "gist")
+			id := server.AddGist("octocat", "Envman Data", false, map[string]string{"envman": "{}", "dev": `{"A": "1", "B": "1"}`})
+
+			g := &backend.GitHubGist{APIURL: server.URL, Client: server.Client()}
+			backendtest.Init(t, g, sectionConfig(t, "githubgist", &backend.GitHubGistConfig{Token: "token", GistID: id}))
+			if _, err := g.Get(ctx, "dev"); err != nil {
+				t.Fatalf("get: %v", err)
+			}
+
+			write := func() { server.SetFile(id, "dev", test.theirs) }
+			if test.during {
+				// Our write overwrites theirs, then it is found in the history of the gist and merged back.
+				server.Inject(fakegithub.Fault{Method: http.MethodPatch, Path: "/gists/" + id, Times: 1, Before: write})
+			} else {
+				write()
+			}
+
+			if err := g.Update(ctx, "dev", map[string]string{"A": "3"}); !errors.Is(err, test.wantErr) {
+				t.Errorf("update: %v, want %v", err, test.wantErr)
+			}
+			if vars := gistFileValues(t, server, id, "dev"); !reflect.DeepEqual(vars, test.want) {
+				t.Errorf("file: %v, want %v", vars, test.want)
+			}
+			if count := countRequests(server, "PATCH /gists/"+id); count != test.patches {
+				t.Errorf("writes: %v, want %v", count, test.patches)
+			}
+			// The revision written in between is read from the history.
+			if revisions := countRevisionRequests(server, id); test.during != (revisions > 0) {
+				t.Errorf("revision requests: %v, want some only if written during the update", revisions)
+			}
+		})
+	}
+}
+
+func TestGitHubGistReplace(t *testing.T) {
+	ctx := context.Background()
+	g, server := newTestGist(t)
+
+	if err := g.Update(ctx, "dev", map[string]string{"A": "1", "B": "2"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	id := server.GistIDs("octocat")[0]
+	patches := countRequests(server, "PATCH /gists/"+id)
+
+	// The removed variable and the changed one are in the same revision.
+	if err := g.Replace(ctx, "dev", map[string]string{"A": "3"}); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	if count := countRequests(server, "PATCH /gists/"+id) - patches; count != 1 {
+		t.Errorf("writes: %v, want 1", count)
+	}
+	if vars := gistFileValues(t, server, id, "dev"); !reflect.DeepEqual(vars, map[string]string{"A": "3"}) {
+		t.Errorf("file: %v, want only A=3", vars)
+	}
+}
+
+// Counts the requests of the revisions of the gist.
+func countRevisionRequests(server *fakegithub.Server, id string) (count int) {
+	for _, r := range server.Requests() {
+		if strings.HasPrefix(r, "GET /gists/"+id+"/") {
+			count++
+		}
+	}
+
+	return
+}
+
+func TestGitHubGistMetadata(t *testing.T) {
+	ctx := context.Background()
+	server := fakegithub.New()
+	t.Cleanup(server.Close)
+	server.AddToken("octocat", "token", "gist")
+	// Saved by an earlier version, the entries are plain strings.
+	id := server.AddGist("octocat", "Envman Data", false, map[string]string{"envman": "{}", "dev": `{"A": "1"}`})
+
+	g := &backend.GitHubGist{APIURL: server.URL, Client: server.Client()}
+	backendtest.Init(t, g, sectionConfig(t, "githubgist", &backend.GitHubGistConfig{Token: "token", GistID: id}))
+
+	vars, err := g.GetVariables(ctx, "dev")
+	if err != nil || vars["A"].Value != "1" || !vars["A"].IsZero() {
+		t.Fatalf("get variables of old entries: %+v, %v, want the value without metadata", vars, err)
+	}
+
+	metadata := backend.VariableMetadata{Description: "Port", Tags: []string{"net"}}
+	if err := g.UpdateVariables(ctx, "dev", map[string]backend.Variable{"B": {Value: "2", VariableMetadata: metadata}}); err != nil {
+		t.Fatalf("update variables: %v", err)
+	}
+
+	// The old entry is not touched, the new one is an object with the value.
+	content, _ := server.File(id, "dev")
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(content), &entries); err != nil {
+		t.Fatalf("file: %v", err)
+	}
+	if string(entries["A"]) != `"1"` || !strings.HasPrefix(string(entries["B"]), "{") {
+		t.Errorf("file: %s, want A as a string and B as an object", content)
+	}
+
+	vars, err = g.GetVariables(ctx, "dev")
+	if err != nil || vars["B"].Value != "2" || vars["B"].Description != "Port" || !reflect.DeepEqual(vars["B"].Tags, metadata.Tags) || vars["B"].Created.IsZero() {
+		t.Errorf("get variables: %+v, %v, want B with the metadata", vars, err)
+	}
+	if values, err := g.Get(ctx, "dev"); err != nil || !reflect.DeepEqual(values, map[string]string{"A": "1", "B": "2"}) {
+		t.Errorf("get: %v, %v, want both values", values, err)
+	}
+
+	// An entry which is neither.
+	server.SetFile(id, "dev", `{"A": 1}`)
+	fresh := &backend.GitHubGist{APIURL: server.URL, Client: server.Client()}
+	backendtest.Init(t, fresh, sectionConfig(t, "githubgist", &backend.GitHubGistConfig{Token: "token", GistID: id}))
+	if _, err := fresh.Get(ctx, "dev"); err == nil || !strings.Contains(err.Error(), "variable A") {
+		t.Errorf("get invalid entry: %v, want an error", err)
+	}
+}
+
+func TestGitHubGistRelogin(t *testing.T) {
+	server := fakegithub.New()
+	t.Cleanup(server.Close)
+	server.AddOAuthApp("client", "secret")
+	server.ApproveDevices("octocat")
+
+	// Choose the device flow, the default.
+	fakeStdin(t, "\n")
+
+	// The saved token is not valid anymore.
+	c := sectionConfig(t, "githubgist", &backend.GitHubGistConfig{Token: "revoked", ClientID: "client"})
+	g := &backend.GitHubGist{APIURL: server.URL, WebURL: server.URL, Client: server.Client()}
+	backendtest.Init(t, g, c)
+
+	section := gistSection(t, c)
+	if section.Token == "revoked" || !server.HasToken(section.Token) || section.TokenType != "oauth" {
+		t.Errorf("saved token: %q of type %q, want the new OAuth token", section.Token, section.TokenType)
+	}
+	if len(server.GistIDs("octocat")) != 1 {
+		t.Errorf("gists: %v, want the created one", server.GistIDs("octocat"))
+	}
+}
+
+func TestGitHubGistLoginFallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientID string
+		message  string
+	}{
+		{"NoClientID", "", "register an OAuth app with the device flow enabled at "},
+		{"WrongClientID", "wrong", "browser login is not available"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := fakegithub.New()
+			t.Cleanup(server.Close)
+			server.AddOAuthApp("client", "secret")
+			fakeStdin(t, "\n")
+			stderr := captureStderr(t)
+
+			// The standard input is not a terminal, so the token prompt fails.
+			g := &backend.GitHubGist{APIURL: server.URL, WebURL: server.URL, Client: server.Client()}
+			err := g.Init(context.Background(), sectionConfig(t, "githubgist", &backend.GitHubGistConfig{ClientID: test.clientID}))
+			if err == nil {
+				t.Fatal("init without a token: no error")
+			}
+
+			if output := stderr(); !strings.Contains(output, test.message) || !strings.Contains(output, "Token: ") {
+				t.Errorf("output: %q, want %q and the token prompt", output, test.message)
+			}
+		})
+	}
+}
+
+func TestGitHubGistEnterprise(t *testing.T) {
+	// Writes the certificate of the server to a CA bundle.
+	caBundle := func(t *testing.T, server *fakegithub.Server) string {
+		path := filepath.Join(t.TempDir(), "ca.pem")
+		data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	server := fakegithub.NewEnterprise()
+	t.Cleanup(server.Close)
+	server.AddToken("octocat", "token", "gist")
+
+	// Without the bundle the certificate is not trusted.
+	g := &backend.GitHubGist{}
+	err := g.Init(context.Background(), sectionConfig(t, "githubgist", &backend.GitHubGistConfig{Token: "token", APIURL: server.APIURL()}))
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("init without the CA bundle: %v, want a certificate error", err)
+	}
+	if g.WebURL != server.URL {
+		t.Errorf("web URL: %q, want %q", g.WebURL, server.URL)
+	}
+
+	backendtest.Run(t, func(t *testing.T) backend.IContextBackend {
+		server := fakegithub.NewEnterprise()
+		t.Cleanup(server.Close)
+		server.AddToken("octocat", "token", "gist")
+
+		section := &backend.GitHubGistConfig{Token: "token", APIURL: server.APIURL() + "/", CABundle: caBundle(t, server)}
+		return backendtest.Init(t, &backend.GitHubGist{}, sectionConfig(t, "githubgist", section))
+	})
+}
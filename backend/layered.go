@@ -0,0 +1,290 @@
+package backend
+
+// Inheritance layer. Wraps any other backend and resolves the variables of the environments
+// from their parents, so the common variables can be kept in one environment.
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pyrooka/envman/config"
+)
+
+// ParentsVariable is the variable which lists the parents of the environment, separated by commas.
+// The later parents override the earlier ones, and the environment overrides all of them.
+// A value which overrides a common ancestor is not overridden by that ancestor through a later parent.
+const ParentsVariable = "ENVMAN_PARENTS"
+
+//-------------------------------------------------------------------
+// Structs
+//-------------------------------------------------------------------
+
+// Layered wraps another backend and resolves the inherited variables of the environments.
+// The parents are stored in the ParentsVariable of the environment, so it works with any backend.
+type Layered struct {
+	Backend IContextBackend
+}
+
+// ResolvedVariable is the value of a variable and the environment it comes from.
+type ResolvedVariable struct {
+	Value  string
+	Source string
+}
+
+//-------------------------------------------------------------------
+//  Helper functions
+//-------------------------------------------------------------------
+
+// Splits the value of the ParentsVariable to the names of the parents.
+func parseParents(value string) (parents []string) {
+	for _, parent := range strings.Split(value, ",") {
+		if parent = strings.TrimSpace(parent); parent != "" {
+			parents = append(parents, parent)
+		}
+	}
+
+	return
+}
+
+// Resolves the variables of the environment. The path is the chain of the environments which
+// inherit from it, to detect the cycles. The resolved environments are kept in the resolved map,
+// so a common ancestor is fetched only once, and their ancestors in the ancestors map.
+func (l *Layered) resolve(ctx context.Context, envName string, path []string, resolved map[string]map[string]ResolvedVariable, ancestors map[string]map[string]bool) (vars map[string]ResolvedVariable, err error) {
+	for i, child := range path {
+		if child == envName {
+			return nil, fmt.Errorf("%w: %v -> %v", ErrCycle, strings.Join(path[i:], " -> "), envName)
+		}
+	}
+	if vars, exists := resolved[envName]; exists {
+		return vars, nil
+	}
+
+	own, err := l.Backend.Get(ctx, envName)
+	if err != nil {
+		if len(path) > 0 {
+			err = fmt.Errorf("parent of %q: %w", path[len(path)-1], err)
+		}
+		return
+	}
+
+	vars = map[string]ResolvedVariable{}
+	ownAncestors := map[string]bool{}
+	for _, parent := range parseParents(own[ParentsVariable]) {
+		inherited, err := l.resolve(ctx, parent, append(path, envName), resolved, ancestors)
+		if err != nil {
+			return nil, err
+		}
+		ownAncestors[parent] = true
+		for ancestor := range ancestors[parent] {
+			ownAncestors[ancestor] = true
+		}
+
+		for key, variable := range inherited {
+			// In a diamond the value of an earlier parent is kept over the one of their common ancestor.
+			if current, exists := vars[key]; exists && ancestors[current.Source][variable.Source] {
+				continue
+			}
+			vars[key] = variable
+		}
+	}
+
+	for key, value := range own {
+		if key != ParentsVariable {
+			vars[key] = ResolvedVariable{Value: value, Source: envName}
+		}
+	}
+	resolved[envName] = vars
+	ancestors[envName] = ownAncestors
+
+	return
+}
+
+// Checks if the parents exist and the environment is not an ancestor of them.
+func (l *Layered) checkParents(ctx context.Context, envName string, parents []string) (err error) {
+	resolved, ancestors := map[string]map[string]ResolvedVariable{}, map[string]map[string]bool{}
+	for _, parent := range parents {
+		if _, err = l.resolve(ctx, parent, []string{envName}, resolved, ancestors); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Unwrap returns the wrapped backend.
+func (l *Layered) Unwrap() IContextBackend {
+	return l.Backend
+}
+
+// Resolve returns the variables of the environment with their inherited ones,
+// and the environment each value comes from.
+func (l *Layered) Resolve(ctx context.Context, envName string) (vars map[string]ResolvedVariable, err error) {
+	vars, err = l.resolve(ctx, envName, nil, map[string]map[string]ResolvedVariable{}, map[string]map[string]bool{})
+
+	return
+}
+
+// SetParents sets the parents of the environment, or removes them if none given.
+func (l *Layered) SetParents(ctx context.Context, envName string, parents []string) (err error) {
+	if len(parents) > 0 {
+		err = l.Update(ctx, envName, map[string]string{ParentsVariable: strings.Join(parents, ",")})
+		return
+	}
+
+	own, err := l.Backend.Get(ctx, envName)
+	if err != nil {
+		return
+	}
+	if _, exists := own[ParentsVariable]; exists {
+		err = l.Backend.Delete(ctx, envName, []string{ParentsVariable})
+	}
+
+	return
+}
+
+//-------------------------------------------------------------------
+//  Interface functions
+//-------------------------------------------------------------------
+
+// Init initializes the wrapped backend.
+func (l *Layered) Init(ctx context.Context, c *config.Config) (err error) {
+	err = l.Backend.Init(ctx, c)
+
+	return
+}
+
+// List returns the environments, or the variables of the environment with the inherited ones.
+func (l *Layered) List(ctx context.Context, envName string) (result []string, err error) {
+	if envName == "" {
+		result, err = l.Backend.List(ctx, envName)
+		return
+	}
+
+	vars, err := l.Resolve(ctx, envName)
+	if err != nil {
+		return
+	}
+
+	for key := range vars {
+		result = append(result, key)
+	}
+
+	return
+}
+
+// Get returns the variables of the environment with the inherited ones.
+func (l *Layered) Get(ctx context.Context, envName string) (vars map[string]string, err error) {
+	resolved, err := l.Resolve(ctx, envName)
+	if err != nil {
+		return
+	}
+
+	vars = make(map[string]string, len(resolved))
+	for key, variable := range resolved {
+		vars[key] = variable.Value
+	}
+
+	return
+}
+
+// Update saves the variables with the wrapped backend. The new parents are checked first.
+func (l *Layered) Update(ctx context.Context, envName string, variables map[string]string) (err error) {
+	if value, exists := variables[ParentsVariable]; exists {
+		if err = l.checkParents(ctx, envName, parseParents(value)); err != nil {
+			return
+		}
+	}
+
+	err = l.Backend.Update(ctx, envName, variables)
+
+	return
+}
+
+// Delete deletes the own variables or the environment with the wrapped backend. The inherited variables are not deleted.
+func (l *Layered) Delete(ctx context.Context, envName string, envVars []string) (err error) {
+	err = l.Backend.Delete(ctx, envName, envVars)
+
+	return
+}
+
+// CleanUp cleans up the wrapped backend.
+func (l *Layered) CleanUp(ctx context.Context) (err error) {
+	err = l.Backend.CleanUp(ctx)
+
+	return
+}
+
+// GetVariables returns the own variables of the environment with their metadata from the wrapped backend.
+// The inherited variables and the parents are not included.
+func (l *Layered) GetVariables(ctx context.Context, envName string) (vars map[string]Variable, err error) {
+	var annotated Annotated
+	if !As(l.Backend, &annotated) {
+		return nil, fmt.Errorf("%w: metadata", ErrNotSupported)
+	}
+
+	vars, err = annotated.GetVariables(ctx, envName)
+	delete(vars, ParentsVariable)
+
+	return
+}
+
+// UpdateVariables saves the variables with their metadata with the wrapped backend. The new parents are checked first.
+func (l *Layered) UpdateVariables(ctx context.Context, envName string, variables map[string]Variable) (err error) {
+	var annotated Annotated
+	if !As(l.Backend, &annotated) {
+		return fmt.Errorf("%w: metadata", ErrNotSupported)
+	}
+
+	if variable, exists := variables[ParentsVariable]; exists {
+		if err = l.checkParents(ctx, envName, parseParents(variable.Value)); err != nil {
+			return
+		}
+	}
+
+	err = annotated.UpdateVariables(ctx, envName, variables)
+
+	return
+}
+
+// History returns the revisions of the environment from the wrapped backend.
+func (l *Layered) History(ctx context.Context, envName string) (revisions []Revision, err error) {
+	var versioned Versioned
+	if !As(l.Backend, &versioned) {
+		return nil, fmt.Errorf("%w: history", ErrNotSupported)
+	}
+
+	revisions, err = versioned.History(ctx, envName)
+
+	return
+}
+
+// GetRevision returns the own variables of the environment at the revision from the wrapped backend.
+func (l *Layered) GetRevision(ctx context.Context, envName string, id string) (vars map[string]string, err error) {
+	var versioned Versioned
+	if !As(l.Backend, &versioned) {
+		return nil, fmt.Errorf("%w: history", ErrNotSupported)
+	}
+
+	vars, err = versioned.GetRevision(ctx, envName, id)
+
+	return
+}
+
+// Replace replaces the own variables of the environment with the wrapped backend. The new parents are checked first.
+func (l *Layered) Replace(ctx context.Context, envName string, variables map[string]string) (err error) {
+	var versioned Versioned
+	if !As(l.Backend, &versioned) {
+		return fmt.Errorf("%w: history", ErrNotSupported)
+	}
+
+	if value, exists := variables[ParentsVariable]; exists {
+		if err = l.checkParents(ctx, envName, parseParents(value)); err != nil {
+			return
+		}
+	}
+
+	err = versioned.Replace(ctx, envName, variables)
+
+	return
+}
@@ -0,0 +1,202 @@
+package backend_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pyrooka/envman/backend"
+	"github.com/pyrooka/envman/backend/backendtest"
+	"github.com/pyrooka/envman/config"
+)
+
+func TestLayered(t *testing.T) {
+	tests := []struct {
+		name    string
+		envs    map[string]map[string]string // Saved without the checks of the layer.
+		env     string
+		parents string            // Set through the layer if not empty, the environment is read otherwise.
+		want    map[string]string // The variables of the environment.
+		wantErr error
+		message string // Part of the error message.
+	}{
+		{
+			name:    "SelfParent",
+			envs:    map[string]map[string]string{"a": {"A": "1"}},
+			env:     "a",
+			parents: "a",
+			wantErr: backend.ErrCycle,
+			message: "a -> a",
+		},
+		{
+			name:    "Cycle",
+			envs:    map[string]map[string]string{"a": {"A": "1", backend.ParentsVariable: "b"}, "b": {"B": "2"}},
+			env:     "b",
+			parents: "a",
+			wantErr: backend.ErrCycle,
+			message: "b -> a -> b",
+		},
+		{
+			name:    "StoredCycle",
+			envs:    map[string]map[string]string{"a": {"A": "1", backend.ParentsVariable: "b"}, "b": {"B": "2", backend.ParentsVariable: "a"}},
+			env:     "a",
+			wantErr: backend.ErrCycle,
+			message: "a -> b -> a",
+		},
+		{
+			name: "Diamond",
+			envs: map[string]map[string]string{
+				"base":  {"A": "1", "B": "1", "C": "1"},
+				"left":  {"B": "2", backend.ParentsVariable: "base"},
+				"right": {"C": "3", backend.ParentsVariable: "base"},
+				"top":   {"D": "4", backend.ParentsVariable: "left, right"},
+			},
+			env:  "top",
+			want: map[string]string{"A": "1", "B": "2", "C": "3", "D": "4"},
+		},
+		{
+			name:    "DiamondParents",
+			envs:    map[string]map[string]string{"base": {"A": "1"}, "left": {backend.ParentsVariable: "base"}, "right": {backend.ParentsVariable: "base"}, "top": {"D": "4"}},
+			env:     "top",
+			parents: "left,right",
+			want:    map[string]string{"A": "1", "D": "4"},
+		},
+		{
+			name:    "MissingParent",
+			envs:    map[string]map[string]string{"a": {"A": "1", backend.ParentsVariable: "missing"}},
+			env:     "a",
+			wantErr: backend.ErrEnvNotFound,
+			message: `parent of "a"`,
+		},
+		{
+			name:    "SetMissingParent",
+			envs:    map[string]map[string]string{"a": {"A": "1"}, "b": {backend.ParentsVariable: "missing"}},
+			env:     "a",
+			parents: "b",
+			wantErr: backend.ErrEnvNotFound,
+			message: `parent of "b"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			local := &backend.Local{}
+			layered := &backend.Layered{Backend: local}
+			backendtest.Init(t, layered, &config.Config{})
+			for env, vars := range test.envs {
+				if err := local.Update(ctx, env, vars); err != nil {
+					t.Fatalf("update %v: %v", env, err)
+				}
+			}
+
+			var vars map[string]string
+			var err error
+			if test.parents != "" {
+				if err = layered.SetParents(ctx, test.env, strings.Split(test.parents, ",")); err == nil {
+					vars, err = layered.Get(ctx, test.env)
+				}
+			} else {
+				vars, err = layered.Get(ctx, test.env)
+			}
+
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) || !strings.Contains(err.Error(), test.message) {
+					t.Fatalf("error: %v, want %v with %q", err, test.wantErr, test.message)
+				}
+				// Nothing is saved.
+				if own, _ := local.Get(ctx, test.env); own[backend.ParentsVariable] != test.envs[test.env][backend.ParentsVariable] {
+					t.Errorf("parents: %q, want unchanged", own[backend.ParentsVariable])
+				}
+				return
+			}
+
+			// The parents are not exported.
+			if err != nil || !reflect.DeepEqual(vars, test.want) {
+				t.Errorf("get: %v, %v, want %v", vars, err, test.want)
+			}
+		})
+	}
+}
+
+func TestLayeredMetadata(t *testing.T) {
+	ctx := context.Background()
+	local := &backend.Local{}
+	layered := &backend.Layered{Backend: local}
+	backendtest.Init(t, layered, &config.Config{})
+	if err := local.Update(ctx, "base", map[string]string{"A": "1", backend.ParentsVariable: "dev"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	// Found before the wrapped backend, so the parents are checked like by Update.
+	var annotated backend.Annotated
+	if !backend.As(layered, &annotated) || annotated != backend.Annotated(layered) {
+		t.Fatalf("as annotated: %v, want the layer", annotated)
+	}
+	parents := map[string]backend.Variable{backend.ParentsVariable: {Value: "base", VariableMetadata: backend.VariableMetadata{Description: "Parents"}}}
+	if err := annotated.UpdateVariables(ctx, "dev", parents); !errors.Is(err, backend.ErrCycle) {
+		t.Errorf("update variables with a cycle: %v, want ErrCycle", err)
+	}
+	if _, err := local.Get(ctx, "dev"); !errors.Is(err, backend.ErrEnvNotFound) {
+		t.Errorf("get: %v, want nothing saved", err)
+	}
+
+	vars := map[string]backend.Variable{"B": {Value: "2", VariableMetadata: backend.VariableMetadata{Description: "Own"}}}
+	if err := local.Delete(ctx, "base", []string{backend.ParentsVariable}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := annotated.UpdateVariables(ctx, "dev", vars); err != nil {
+		t.Fatalf("update variables: %v", err)
+	}
+	if err := annotated.UpdateVariables(ctx, "dev", parents); err != nil {
+		t.Fatalf("update variables with parents: %v", err)
+	}
+
+	// Only the own variables, without the parents.
+	got, err := annotated.GetVariables(ctx, "dev")
+	if err != nil || len(got) != 1 || got["B"].Description != "Own" {
+		t.Errorf("get variables: %+v, %v, want only B", got, err)
+	}
+	if values, err := layered.Get(ctx, "dev"); err != nil || !reflect.DeepEqual(values, map[string]string{"A": "1", "B": "2"}) {
+		t.Errorf("get: %v, %v, want the inherited A too", values, err)
+	}
+
+	// Not supported by the wrapped backend.
+	plain := &backend.Layered{Backend: &backend.Dir{}}
+	if _, err := plain.GetVariables(ctx, "dev"); !errors.Is(err, backend.ErrNotSupported) {
+		t.Errorf("get variables without metadata: %v, want ErrNotSupported", err)
+	}
+}
+
+func TestLayeredReplace(t *testing.T) {
+	ctx := context.Background()
+	local := &backend.Local{}
+	layered := &backend.Layered{Backend: local}
+	backendtest.Init(t, layered, &config.Config{})
+	if err := local.Update(ctx, "base", map[string]string{"A": "1", backend.ParentsVariable: "dev"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := local.Update(ctx, "dev", map[string]string{"B": "2"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	// Found before the wrapped backend, so the parents are checked like by Update.
+	var versioned backend.Versioned
+	if !backend.As(layered, &versioned) || versioned != backend.Versioned(layered) {
+		t.Fatalf("as versioned: %v, want the layer", versioned)
+	}
+	if err := versioned.Replace(ctx, "dev", map[string]string{backend.ParentsVariable: "base"}); !errors.Is(err, backend.ErrCycle) {
+		t.Errorf("replace with a cycle: %v, want ErrCycle", err)
+	}
+	if vars, err := local.Get(ctx, "dev"); err != nil || !reflect.DeepEqual(vars, map[string]string{"B": "2"}) {
+		t.Errorf("get: %v, %v, want nothing replaced", vars, err)
+	}
+
+	// Not supported by the wrapped backend.
+	plain := &backend.Layered{Backend: &backend.Dir{}}
+	if err := plain.Replace(ctx, "dev", map[string]string{"B": "3"}); !errors.Is(err, backend.ErrNotSupported) {
+		t.Errorf("replace without history: %v, want ErrNotSupported", err)
+	}
+}
@@ -1,31 +1,101 @@
 package backend
 
 import (
+	"context"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/pyrooka/envman/config"
 )
 
+// Number of the kept snapshots per environment if not configured.
+const localDefaultSnapshots = 10
+
+// Registers the backend.
+func init() {
+	Register("local", func() IContextBackend { return &Local{} })
+}
+
+// LocalConfig is the config section of the backend. The environments are stored in it.
+type LocalConfig struct {
+	Environments map[string]map[string]string           `json:"environments"`
+	Metadata     map[string]map[string]VariableMetadata `json:"metadata,omitempty"`     // Metadata of the variables, next to the values so the old configs work.
+	Snapshots    map[string][]LocalSnapshot             `json:"snapshots,omitempty"`    // The last states of the environments, newest first.
+	MaxSnapshots int                                    `json:"maxSnapshots,omitempty"` // Number of the kept snapshots per environment. Negative turns them off.
+}
+
+// LocalSnapshot is a state of an environment after a change.
+type LocalSnapshot struct {
+	ID        int               `json:"id"`
+	Time      time.Time         `json:"time"`
+	Variables map[string]string `json:"variables"`
+}
+
 // Local uses the computer for backend storage.
 type Local struct {
-	Environments map[string]map[string]string `json:"environments"`
+	Environments map[string]map[string]string           `json:"environments"`
+	Metadata     map[string]map[string]VariableMetadata `json:"metadata"`
+	Snapshots    map[string][]LocalSnapshot             `json:"snapshots"`
+	MaxSnapshots int                                    `json:"maxSnapshots"`
+}
+
+// Saves the current state of the environment and drops the oldest snapshots over the limit.
+func (l *Local) snapshot(envName string) {
+	if l.MaxSnapshots <= 0 {
+		return
+	}
+
+	vars := map[string]string{}
+	for key, value := range l.Environments[envName] {
+		vars[key] = value
+	}
+
+	id := 1
+	if snapshots := l.Snapshots[envName]; len(snapshots) > 0 {
+		id = snapshots[0].ID + 1
+	}
+
+	snapshots := append([]LocalSnapshot{{ID: id, Time: time.Now(), Variables: vars}}, l.Snapshots[envName]...)
+	if len(snapshots) > l.MaxSnapshots {
+		snapshots = snapshots[:l.MaxSnapshots]
+	}
+	l.Snapshots[envName] = snapshots
 }
 
 // Init loads the environments from the config.
-func (l *Local) Init(c *config.Config) (err error) {
+func (l *Local) Init(ctx context.Context, c *config.Config) (err error) {
+	conf := &LocalConfig{}
+	if err = c.Bind("local", conf); err != nil {
+		return
+	}
+
 	// If the local config is null,
-	if c.Local.Environments == nil {
+	if conf.Environments == nil {
 		// init a new map object.
-		c.Local.Environments = map[string]map[string]string{}
+		conf.Environments = map[string]map[string]string{}
+	}
+
+	if conf.Metadata == nil {
+		conf.Metadata = map[string]map[string]VariableMetadata{}
+	}
+	if conf.Snapshots == nil {
+		conf.Snapshots = map[string][]LocalSnapshot{}
 	}
 
-	l.Environments = c.Local.Environments
+	l.Environments = conf.Environments
+	l.Metadata = conf.Metadata
+	l.Snapshots = conf.Snapshots
+	l.MaxSnapshots = conf.MaxSnapshots
+	if l.MaxSnapshots == 0 {
+		l.MaxSnapshots = localDefaultSnapshots
+	}
 
 	return
 }
 
 // List returns the name of environments or variables.
-func (l *Local) List(envName string) (result []string, err error) {
+func (l *Local) List(ctx context.Context, envName string) (result []string, err error) {
 	if envName == "" {
 		// Get the name of the environments.
 		for key := range l.Environments {
@@ -38,7 +108,7 @@ func (l *Local) List(envName string) (result []string, err error) {
 				result = append(result, key)
 			}
 		} else {
-			err = fmt.Errorf("environment \"%v\" doesn't exist", envName)
+			err = envNotFound(envName)
 		}
 	}
 
@@ -46,57 +116,161 @@ func (l *Local) List(envName string) (result []string, err error) {
 }
 
 // Get returns the environment variables with its values.
-func (l *Local) Get(envName string) (vars map[string]string, err error) {
+func (l *Local) Get(ctx context.Context, envName string) (vars map[string]string, err error) {
 	if env, exists := l.Environments[envName]; exists {
 		vars = env
 	} else {
-		err = fmt.Errorf("environment \"%v\" doesn't exist", envName)
+		err = envNotFound(envName)
 	}
 
 	return
 }
 
 // Update saves the given variable to the environments. Overwrites if exists.
-func (l *Local) Update(envName string, variables map[string]string) (err error) {
-	// Create the environment if not already exists.
-	if _, exists := l.Environments[envName]; !exists {
-		l.Environments[envName] = map[string]string{}
-	}
-
-	// Add the variables to the env.
+func (l *Local) Update(ctx context.Context, envName string, variables map[string]string) (err error) {
+	vars := make(map[string]Variable, len(variables))
 	for key, value := range variables {
-		l.Environments[envName][key] = value
+		vars[key] = Variable{Value: value}
 	}
 
+	err = l.UpdateVariables(ctx, envName, vars)
+
 	return
 }
 
 // Delete removes an environment.
-func (l *Local) Delete(envName string, envVars []string) (err error) {
+func (l *Local) Delete(ctx context.Context, envName string, envVars []string) (err error) {
 	// We need the environment in both cases.
 	if env, exists := l.Environments[envName]; exists {
 		if len(envVars) == 0 {
 			// Delete the environment.
 			delete(l.Environments, envName)
+			delete(l.Metadata, envName)
 		} else {
-			// Delete variables.
+			// Delete variables. The missing ones are skipped.
 			for _, envVar := range envVars {
-				// NOTE: should we check is the variables exists?
 				delete(env, envVar)
+				delete(l.Metadata[envName], envVar)
 			}
 
+			l.snapshot(envName)
 		}
 	} else {
-		err = fmt.Errorf("environment \"%v\" doesn't exist", envName)
+		err = envNotFound(envName)
 	}
 
 	return
 }
 
-// CleanUp removes all the environments from the config.
-func (l *Local) CleanUp() (err error) {
+// CleanUp removes all the environments and their history from the config.
+func (l *Local) CleanUp(ctx context.Context) (err error) {
 	for key := range l.Environments {
 		delete(l.Environments, key)
 	}
+	for key := range l.Metadata {
+		delete(l.Metadata, key)
+	}
+	for key := range l.Snapshots {
+		delete(l.Snapshots, key)
+	}
+	return
+}
+
+// GetVariables returns the variables of the environment with their metadata.
+func (l *Local) GetVariables(ctx context.Context, envName string) (vars map[string]Variable, err error) {
+	env, exists := l.Environments[envName]
+	if !exists {
+		return nil, envNotFound(envName)
+	}
+
+	vars = make(map[string]Variable, len(env))
+	for key, value := range env {
+		vars[key] = Variable{Value: value, VariableMetadata: l.Metadata[envName][key]}
+	}
+
+	return
+}
+
+// UpdateVariables saves the variables with their metadata to the environment. Overwrites if exists.
+func (l *Local) UpdateVariables(ctx context.Context, envName string, variables map[string]Variable) (err error) {
+	// Create the environment if not already exists.
+	if _, exists := l.Environments[envName]; !exists {
+		l.Environments[envName] = map[string]string{}
+	}
+	if _, exists := l.Metadata[envName]; !exists {
+		l.Metadata[envName] = map[string]VariableMetadata{}
+	}
+
+	// Add the variables to the env.
+	now := time.Now()
+	for key, variable := range variables {
+		var current *Variable
+		if value, exists := l.Environments[envName][key]; exists {
+			current = &Variable{Value: value, VariableMetadata: l.Metadata[envName][key]}
+		}
+		l.Environments[envName][key] = variable.Value
+		if metadata := annotate(current, variable, now); !metadata.IsZero() {
+			l.Metadata[envName][key] = metadata
+		}
+	}
+
+	l.snapshot(envName)
+
+	return
+}
+
+// History returns the snapshots of the environment. The history is kept after the environment is deleted.
+func (l *Local) History(ctx context.Context, envName string) (revisions []Revision, err error) {
+	snapshots, exists := l.Snapshots[envName]
+	if !exists {
+		_, exists = l.Environments[envName]
+	}
+	if !exists {
+		return nil, envNotFound(envName)
+	}
+
+	for _, snapshot := range snapshots {
+		revisions = append(revisions, Revision{ID: strconv.Itoa(snapshot.ID), Time: snapshot.Time})
+	}
+
 	return
 }
+
+// Replace replaces the variables of the environment, or creates it, with one snapshot.
+// The metadata of the deleted variables is removed.
+func (l *Local) Replace(ctx context.Context, envName string, variables map[string]string) (err error) {
+	env := make(map[string]string, len(variables))
+	metadata := map[string]VariableMetadata{}
+	now := time.Now()
+	for key, value := range variables {
+		var current *Variable
+		if currentValue, exists := l.Environments[envName][key]; exists {
+			current = &Variable{Value: currentValue, VariableMetadata: l.Metadata[envName][key]}
+		}
+		env[key] = value
+		if variableMetadata := annotate(current, Variable{Value: value}, now); !variableMetadata.IsZero() {
+			metadata[key] = variableMetadata
+		}
+	}
+
+	l.Environments[envName] = env
+	l.Metadata[envName] = metadata
+	l.snapshot(envName)
+
+	return
+}
+
+// GetRevision returns the variables of the environment in the snapshot.
+func (l *Local) GetRevision(ctx context.Context, envName string, id string) (vars map[string]string, err error) {
+	for _, snapshot := range l.Snapshots[envName] {
+		if strconv.Itoa(snapshot.ID) == id {
+			vars = map[string]string{}
+			for key, value := range snapshot.Variables {
+				vars[key] = value
+			}
+			return
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %q of environment %q", ErrRevisionNotFound, id, envName)
+}
@@ -0,0 +1,175 @@
+package backend_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pyrooka/envman/backend"
+	"github.com/pyrooka/envman/backend/backendtest"
+	"github.com/pyrooka/envman/config"
+)
+
+// Returns the IDs of the revisions.
+func revisionIDs(revisions []backend.Revision) (ids []string) {
+	for _, revision := range revisions {
+		ids = append(ids, revision.ID)
+	}
+
+	return
+}
+
+func TestLocal(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.IContextBackend {
+		return backendtest.Init(t, &backend.Local{}, &config.Config{})
+	})
+}
+
+func TestLocalSnapshotLimit(t *testing.T) {
+	ctx := context.Background()
+	local := &backend.Local{}
+	backendtest.Init(t, local, sectionConfig(t, "local", &backend.LocalConfig{MaxSnapshots: 3}))
+
+	for i := 1; i <= 5; i++ {
+		if err := local.Update(ctx, "dev", map[string]string{"A": strconv.Itoa(i)}); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+	}
+
+	// Only the newest ones are kept.
+	revisions, err := local.History(ctx, "dev")
+	if want := []string{"5", "4", "3"}; err != nil || !reflect.DeepEqual(revisionIDs(revisions), want) {
+		t.Fatalf("history: %v, %v, want %v", revisionIDs(revisions), err, want)
+	}
+	if _, err := local.GetRevision(ctx, "dev", "2"); !errors.Is(err, backend.ErrRevisionNotFound) {
+		t.Errorf("get dropped revision: %v, want ErrRevisionNotFound", err)
+	}
+
+	// The IDs go on after the oldest ones are dropped.
+	if err := local.Delete(ctx, "dev", []string{"A"}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	revisions, err = local.History(ctx, "dev")
+	if want := []string{"6", "5", "4"}; err != nil || !reflect.DeepEqual(revisionIDs(revisions), want) {
+		t.Errorf("history after delete: %v, %v, want %v", revisionIDs(revisions), err, want)
+	}
+	if vars, err := local.GetRevision(ctx, "dev", "4"); err != nil || vars["A"] != "4" {
+		t.Errorf("get revision: %v, %v, want A=4", vars, err)
+	}
+
+	// Negative turns them off.
+	local = &backend.Local{}
+	backendtest.Init(t, local, sectionConfig(t, "local", &backend.LocalConfig{MaxSnapshots: -1}))
+	if err := local.Update(ctx, "dev", map[string]string{"A": "1"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if revisions, err := local.History(ctx, "dev"); err != nil || len(revisions) != 0 {
+		t.Errorf("history without snapshots: %v, %v, want none", revisionIDs(revisions), err)
+	}
+}
+
+func TestLocalDeletedHistory(t *testing.T) {
+	ctx := context.Background()
+	local := &backend.Local{}
+	backendtest.Init(t, local, &config.Config{})
+
+	if err := local.Update(ctx, "dev", map[string]string{"A": "1", "B": "2"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := local.Update(ctx, "dev", map[string]string{"A": "3"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := local.Delete(ctx, "dev", nil); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	// The history is kept after the environment is deleted.
+	revisions, err := local.History(ctx, "dev")
+	if want := []string{"2", "1"}; err != nil || !reflect.DeepEqual(revisionIDs(revisions), want) {
+		t.Fatalf("history of deleted environment: %v, %v, want %v", revisionIDs(revisions), err, want)
+	}
+	if _, err := local.History(ctx, "missing"); !errors.Is(err, backend.ErrEnvNotFound) {
+		t.Errorf("history of missing environment: %v, want ErrEnvNotFound", err)
+	}
+
+	// Rollback recreates the environment and continues its history.
+	vars, err := local.GetRevision(ctx, "dev", "1")
+	if want := map[string]string{"A": "1", "B": "2"}; err != nil || !reflect.DeepEqual(vars, want) {
+		t.Fatalf("get revision: %v, %v, want %v", vars, err, want)
+	}
+	if err := local.Update(ctx, "dev", vars); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	if got, err := local.Get(ctx, "dev"); err != nil || !reflect.DeepEqual(got, vars) {
+		t.Errorf("get after rollback: %v, %v, want %v", got, err, vars)
+	}
+	revisions, err = local.History(ctx, "dev")
+	if want := []string{"3", "2", "1"}; err != nil || !reflect.DeepEqual(revisionIDs(revisions), want) {
+		t.Errorf("history after rollback: %v, %v, want %v", revisionIDs(revisions), err, want)
+	}
+}
+
+func TestLocalMetadata(t *testing.T) {
+	ctx := context.Background()
+	local := &backend.Local{}
+	backendtest.Init(t, local, &config.Config{})
+
+	variable := func() backend.Variable {
+		t.Helper()
+		vars, err := local.GetVariables(ctx, "dev")
+		if err != nil {
+			t.Fatalf("get variables: %v", err)
+		}
+		return vars["A"]
+	}
+
+	metadata := backend.VariableMetadata{Description: "Address", Tags: []string{"db", "prod"}}
+	if err := local.UpdateVariables(ctx, "dev", map[string]backend.Variable{"A": {Value: "1", VariableMetadata: metadata}}); err != nil {
+		t.Fatalf("update variables: %v", err)
+	}
+	created := variable()
+	if created.Description != "Address" || !reflect.DeepEqual(created.Tags, metadata.Tags) {
+		t.Errorf("metadata: %+v, want %+v", created.VariableMetadata, metadata)
+	}
+	if created.Created.IsZero() || !created.Updated.Equal(created.Created) || created.UpdatedBy == "" {
+		t.Errorf("timestamps: %+v, want created and updated now by the user", created.VariableMetadata)
+	}
+
+	// The same value again keeps everything.
+	if err := local.Update(ctx, "dev", map[string]string{"A": "1"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if same := variable(); !reflect.DeepEqual(same, created) {
+		t.Errorf("after the same value: %+v, want %+v", same, created)
+	}
+
+	// A new value without metadata keeps the description, the tags and the creation.
+	time.Sleep(10 * time.Millisecond)
+	if err := local.UpdateVariables(ctx, "dev", map[string]backend.Variable{"A": {Value: "2"}}); err != nil {
+		t.Fatalf("update variables: %v", err)
+	}
+	changed := variable()
+	if changed.Value != "2" || changed.Description != "Address" || !reflect.DeepEqual(changed.Tags, metadata.Tags) {
+		t.Errorf("after a new value: %+v, want the metadata kept", changed)
+	}
+	if !changed.Created.Equal(created.Created) || !changed.Updated.After(created.Updated) {
+		t.Errorf("timestamps after a new value: %+v, want only the update time changed", changed.VariableMetadata)
+	}
+
+	// The metadata is removed with the variable.
+	if err := local.Delete(ctx, "dev", []string{"A"}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := local.Update(ctx, "dev", map[string]string{"A": "3"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if recreated := variable(); recreated.Description != "" || recreated.Created.Before(changed.Updated) {
+		t.Errorf("after recreation: %+v, want new metadata", recreated.VariableMetadata)
+	}
+	if _, err := local.GetVariables(ctx, "missing"); !errors.Is(err, backend.ErrEnvNotFound) {
+		t.Errorf("get variables of missing environment: %v, want ErrEnvNotFound", err)
+	}
+}
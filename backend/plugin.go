@@ -0,0 +1,309 @@
+package backend
+
+// External process backends. An executable named envman-backend-<name> on the PATH can be used
+// as the <name> backend. The executable is started for every call, gets a JSON request on the
+// standard input and writes a JSON response to the standard output, like the git credential helpers.
+//
+// Request:
+//   {"version": 1, "method": "get", "config": {...}, "env": "dev", "vars": {"A": "1"}, "names": ["A"]}
+// The method is one of init, list, get, update, delete and cleanup. The config is the section of the
+// backend in the config file. The env is the name of the environment, the vars are the variables of
+// update and the names are the variables of delete.
+//
+// Response:
+//   {"names": ["A"], "vars": {"A": "1"}, "config": {...}, "error": {"code": "env_not_found", "message": "..."}}
+// The names are the result of list and the vars are the result of get. If the config is set, it
+// replaces the section of the backend in the config file. The error is set if the call failed.
+// The code is one of the pluginErrorCodes or empty for any other error.
+//
+// The standard error is passed through, so the plugin can write messages to the user.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pyrooka/envman/config"
+)
+
+// Plugin related constants.
+const (
+	pluginPrefix          = "envman-backend-"
+	pluginProtocolVersion = 1
+)
+
+// Error codes of the protocol for the backend errors.
+var pluginErrorCodes = map[string]error{
+	"env_not_found": ErrEnvNotFound,
+	"var_not_found": ErrVarNotFound,
+	"reserved_name": ErrReservedName,
+	"invalid_name":  ErrInvalidName,
+	"unauthorized":  ErrUnauthorized,
+	"rate_limited":  ErrRateLimited,
+	"conflict":      ErrConflict,
+}
+
+//-------------------------------------------------------------------
+// Structs
+//-------------------------------------------------------------------
+
+// Plugin uses an external executable for backend storage.
+type Plugin struct {
+	Name   string          // Name of the backend, the key of the config section.
+	Path   string          // Path of the executable.
+	Config json.RawMessage // The config section sent to the executable.
+}
+
+// Request sent to the plugin.
+type pluginRequest struct {
+	Version int               `json:"version"`
+	Method  string            `json:"method"`
+	Config  json.RawMessage   `json:"config,omitempty"`
+	Env     string            `json:"env,omitempty"`
+	Vars    map[string]string `json:"vars,omitempty"`
+	Names   []string          `json:"names,omitempty"`
+}
+
+// Response of the plugin.
+type pluginResponse struct {
+	Names  []string          `json:"names,omitempty"`
+	Vars   map[string]string `json:"vars,omitempty"`
+	Config json.RawMessage   `json:"config,omitempty"`
+	Error  *pluginError      `json:"error,omitempty"`
+}
+
+// Error in the response of the plugin. Unwraps to the backend error of the code.
+type pluginError struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+// Error returns the message of the plugin.
+func (e *pluginError) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the backend error of the code, so errors.Is works with it.
+func (e *pluginError) Unwrap() error {
+	return pluginErrorCodes[e.Code]
+}
+
+// Creates the error for the response from a backend error.
+func newPluginError(err error) *pluginError {
+	for code, sentinel := range pluginErrorCodes {
+		if errors.Is(err, sentinel) {
+			return &pluginError{Code: code, Message: err.Error()}
+		}
+	}
+
+	return &pluginError{Message: err.Error()}
+}
+
+//-------------------------------------------------------------------
+//  Plugin functions
+//-------------------------------------------------------------------
+
+// Looks for the executable of the backend on the PATH.
+func findPlugin(name string) (p *Plugin, err error) {
+	// The name shouldn't be a path.
+	if strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("backend not found: %q", name)
+	}
+
+	path, err := exec.LookPath(pluginPrefix + name)
+	if err != nil {
+		return nil, fmt.Errorf("backend not found: %q", name)
+	}
+
+	p = &Plugin{Name: name, Path: path}
+
+	return
+}
+
+// Runs the plugin with the request and returns its response.
+func (p *Plugin) call(ctx context.Context, req *pluginRequest) (resp *pluginResponse, err error) {
+	req.Version = pluginProtocolVersion
+	req.Config = p.Config
+
+	input, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.Path)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &output
+	cmd.Stderr = os.Stderr
+
+	runErr := cmd.Run()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	resp = &pluginResponse{}
+	if err = json.Unmarshal(output.Bytes(), resp); err != nil {
+		if runErr != nil {
+			return nil, fmt.Errorf("backend %v: %v", p.Name, runErr)
+		}
+		return nil, fmt.Errorf("backend %v: invalid response: %v", p.Name, err)
+	}
+
+	// Keep the changes of the config.
+	if len(resp.Config) > 0 && string(resp.Config) != "null" {
+		p.Config = resp.Config
+	}
+
+	if resp.Error != nil {
+		err = resp.Error
+	} else if runErr != nil {
+		err = fmt.Errorf("backend %v: %v", p.Name, runErr)
+	}
+
+	return
+}
+
+//-------------------------------------------------------------------
+//  Interface functions
+//-------------------------------------------------------------------
+
+// Init loads the config section and initializes the plugin with it.
+func (p *Plugin) Init(ctx context.Context, c *config.Config) (err error) {
+	p.Config = json.RawMessage("{}")
+	if err = c.Bind(p.Name, &p.Config); err != nil {
+		return
+	}
+
+	_, err = p.call(ctx, &pluginRequest{Method: "init"})
+
+	return
+}
+
+// List returns the name of environments or variables.
+func (p *Plugin) List(ctx context.Context, envName string) (result []string, err error) {
+	resp, err := p.call(ctx, &pluginRequest{Method: "list", Env: envName})
+	if err != nil {
+		return
+	}
+
+	result = resp.Names
+
+	return
+}
+
+// Get returns the environment variables with its values.
+func (p *Plugin) Get(ctx context.Context, envName string) (vars map[string]string, err error) {
+	resp, err := p.call(ctx, &pluginRequest{Method: "get", Env: envName})
+	if err != nil {
+		return
+	}
+
+	vars = resp.Vars
+	if vars == nil {
+		vars = map[string]string{}
+	}
+
+	return
+}
+
+// Update saves the variables to the environment.
+func (p *Plugin) Update(ctx context.Context, envName string, variables map[string]string) (err error) {
+	_, err = p.call(ctx, &pluginRequest{Method: "update", Env: envName, Vars: variables})
+
+	return
+}
+
+// Delete removes the environment or the variables from it.
+func (p *Plugin) Delete(ctx context.Context, envName string, envVars []string) (err error) {
+	_, err = p.call(ctx, &pluginRequest{Method: "delete", Env: envName, Names: envVars})
+
+	return
+}
+
+// CleanUp removes everything created by the plugin.
+func (p *Plugin) CleanUp(ctx context.Context) (err error) {
+	_, err = p.call(ctx, &pluginRequest{Method: "cleanup"})
+
+	return
+}
+
+//-------------------------------------------------------------------
+//  Plugin side
+//-------------------------------------------------------------------
+
+// ServePlugin answers a request of envman with the backend, so it can be used as a plugin.
+// Reads the request from the standard input and writes the response to the standard output.
+// The backend is initialized with the config of the request for every call.
+// The name should be the same as the one used in the Init of the backend.
+func ServePlugin(name string, b IContextBackend) (err error) {
+	return servePlugin(context.Background(), name, b, os.Stdin, os.Stdout)
+}
+
+// Answers a request with the backend.
+func servePlugin(ctx context.Context, name string, b IContextBackend, r io.Reader, w io.Writer) (err error) {
+	req := &pluginRequest{}
+	if err = json.NewDecoder(r).Decode(req); err != nil {
+		return fmt.Errorf("invalid request: %v", err)
+	}
+
+	resp := &pluginResponse{}
+	err = handlePluginRequest(ctx, name, b, req, resp)
+	if err != nil {
+		resp.Error = newPluginError(err)
+	}
+
+	err = json.NewEncoder(w).Encode(resp)
+
+	return
+}
+
+// Runs the method of the request and fills the response.
+func handlePluginRequest(ctx context.Context, name string, b IContextBackend, req *pluginRequest, resp *pluginResponse) (err error) {
+	if req.Version != pluginProtocolVersion {
+		return fmt.Errorf("unsupported protocol version: %v", req.Version)
+	}
+
+	c := &config.Config{Backends: map[string]json.RawMessage{}}
+	if len(req.Config) > 0 {
+		c.Backends[name] = req.Config
+	}
+
+	if err = b.Init(ctx, c); err != nil {
+		return
+	}
+
+	switch req.Method {
+	case "init":
+	case "list":
+		resp.Names, err = b.List(ctx, req.Env)
+	case "get":
+		resp.Vars, err = b.Get(ctx, req.Env)
+	case "update":
+		err = b.Update(ctx, req.Env, req.Vars)
+	case "delete":
+		err = b.Delete(ctx, req.Env, req.Names)
+	case "cleanup":
+		err = b.CleanUp(ctx)
+	default:
+		err = fmt.Errorf("unsupported method: %q", req.Method)
+	}
+
+	// Send back the config section, the backend could change it.
+	data, marshalErr := json.Marshal(c)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	sections := map[string]json.RawMessage{}
+	if marshalErr = json.Unmarshal(data, &sections); marshalErr != nil {
+		return marshalErr
+	}
+	resp.Config = sections[name]
+
+	return
+}
@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pyrooka/envman/config"
+)
+
+// Backend which fails every call with the error.
+type failingBackend struct {
+	err error
+}
+
+func (f *failingBackend) Init(ctx context.Context, c *config.Config) error { return nil }
+func (f *failingBackend) List(ctx context.Context, envName string) ([]string, error) {
+	return nil, f.err
+}
+func (f *failingBackend) Get(ctx context.Context, envName string) (map[string]string, error) {
+	return nil, f.err
+}
+func (f *failingBackend) Update(ctx context.Context, envName string, vars map[string]string) error {
+	return f.err
+}
+func (f *failingBackend) Delete(ctx context.Context, envName string, vars []string) error {
+	return f.err
+}
+func (f *failingBackend) CleanUp(ctx context.Context) error { return f.err }
+
+func TestPluginErrorCodes(t *testing.T) {
+	tests := []struct {
+		err  error
+		code string
+	}{
+		{envNotFound("dev"), "env_not_found"},
+		{fmt.Errorf("%w: %q in environment %q", ErrVarNotFound, "A", "dev"), "var_not_found"},
+		{fmt.Errorf("%w: %q", ErrReservedName, "envman"), "reserved_name"},
+		{invalidEnvName("a/b"), "invalid_name"},
+		{fmt.Errorf("%w: bad token", ErrUnauthorized), "unauthorized"},
+		{&RateLimitError{Message: "slow down"}, "rate_limited"},
+		{conflict("dev", []string{"A"}), "conflict"},
+		{errors.New("something else"), ""},
+	}
+
+	for _, test := range tests {
+		name := test.code
+		if name == "" {
+			name = "Other"
+		}
+		t.Run(name, func(t *testing.T) {
+			// The plugin side writes the code of the error.
+			var output bytes.Buffer
+			input := strings.NewReader(`{"version": 1, "method": "get", "env": "dev"}`)
+			if err := servePlugin(context.Background(), "test", &failingBackend{err: test.err}, input, &output); err != nil {
+				t.Fatalf("serve: %v", err)
+			}
+
+			resp := &pluginResponse{}
+			if err := json.Unmarshal(output.Bytes(), resp); err != nil {
+				t.Fatalf("response %q: %v", output.String(), err)
+			}
+			if resp.Error == nil || resp.Error.Code != test.code || resp.Error.Message != test.err.Error() {
+				t.Fatalf("response error: %+v, want code %q", resp.Error, test.code)
+			}
+
+			// The envman side maps the code back to the same error.
+			want := pluginErrorCodes[test.code]
+			if got := errors.Unwrap(resp.Error); got != want {
+				t.Errorf("unwrapped error: %v, want %v", got, want)
+			}
+			if want != nil && !errors.Is(resp.Error, want) {
+				t.Errorf("errors.Is(%v, %v) is false", resp.Error, want)
+			}
+		})
+	}
+}
+
+func TestPluginProtocolErrors(t *testing.T) {
+	for _, request := range []string{
+		`{"version": 2, "method": "get"}`,
+		`{"version": 1, "method": "unknown"}`,
+	} {
+		var output bytes.Buffer
+		if err := servePlugin(context.Background(), "test", &failingBackend{}, strings.NewReader(request), &output); err != nil {
+			t.Fatalf("serve %v: %v", request, err)
+		}
+
+		resp := &pluginResponse{}
+		if err := json.Unmarshal(output.Bytes(), resp); err != nil || resp.Error == nil || resp.Error.Code != "" {
+			t.Errorf("response of %v: %q, want an error without code", request, output.String())
+		}
+	}
+
+	if err := servePlugin(context.Background(), "test", &failingBackend{}, strings.NewReader("not json"), &bytes.Buffer{}); err == nil {
+		t.Error("serve invalid request: no error")
+	}
+}
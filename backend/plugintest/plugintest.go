@@ -0,0 +1,74 @@
+// Package plugintest checks a backend plugin executable against the protocol of envman.
+//
+// Use it from a test of the plugin:
+//
+//	func TestPlugin(t *testing.T) {
+//		plugintest.Run(t, "./envman-backend-example", json.RawMessage(`{"path": "/tmp/scratch"}`))
+//	}
+//
+// The plugin should use a scratch storage, because the test removes everything with cleanup.
+package plugintest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/pyrooka/envman/backend"
+	"github.com/pyrooka/envman/backend/backendtest"
+	"github.com/pyrooka/envman/config"
+)
+
+// Name of the config section during the test.
+const sectionName = "plugintest"
+
+// Run runs the checks against the plugin at the path. The section is the config of the plugin.
+func Run(t *testing.T, path string, section json.RawMessage) {
+	t.Run("Protocol", func(t *testing.T) {
+		for _, request := range []string{
+			`{"version": 0, "method": "list"}`,
+			`{"version": 1, "method": "unknown"}`,
+		} {
+			resp := rawCall(t, path, request)
+			if _, exists := resp["error"]; !exists {
+				t.Errorf("no error in the response of %v", request)
+			}
+		}
+	})
+
+	t.Run("Contract", func(t *testing.T) {
+		backendtest.Run(t, func(t *testing.T) backend.IContextBackend {
+			plugin := &backend.Plugin{Name: sectionName, Path: path}
+			c := &config.Config{Backends: map[string]json.RawMessage{sectionName: section}}
+			backendtest.Init(t, plugin, c)
+
+			// Start with an empty storage.
+			if err := plugin.CleanUp(context.Background()); err != nil {
+				t.Fatalf("cleanup: %v", err)
+			}
+
+			return plugin
+		})
+	})
+}
+
+// Sends a raw request to the plugin and returns the decoded response.
+func rawCall(t *testing.T, path string, request string) (resp map[string]interface{}) {
+	var output bytes.Buffer
+	cmd := exec.Command(path)
+	cmd.Stdin = bytes.NewReader([]byte(request))
+	cmd.Stdout = &output
+	cmd.Stderr = os.Stderr
+
+	// The exit code is not part of the protocol.
+	_ = cmd.Run()
+
+	if err := json.Unmarshal(output.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response for %v: %v: %q", request, err, output.String())
+	}
+
+	return
+}
@@ -0,0 +1,67 @@
+package backend
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Factory creates a new, uninitialized backend.
+type Factory func() IContextBackend
+
+// The registered backends by name.
+var (
+	registryMutex sync.RWMutex
+	registry      = map[string]Factory{}
+)
+
+// Register makes a backend available by the name. The name is used for the --backend flag
+// and as the key of the config section of the backend. Should be called from an init function.
+// Panics if the name is empty or already registered.
+func Register(name string, factory Factory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if name == "" || factory == nil {
+		panic("backend: Register called with empty name or nil factory")
+	}
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("backend: Register called twice for backend %q", name))
+	}
+
+	registry[name] = factory
+}
+
+// New creates the backend registered with the name. If no backend registered with the name,
+// looks for an envman-backend-<name> executable on the PATH and uses it as a plugin.
+func New(name string) (b IContextBackend, err error) {
+	registryMutex.RLock()
+	factory, exists := registry[name]
+	registryMutex.RUnlock()
+
+	if !exists {
+		// Do not return a nil pointer in the interface.
+		plugin, err := findPlugin(name)
+		if err != nil {
+			return nil, err
+		}
+		return plugin, nil
+	}
+
+	b = factory()
+
+	return
+}
+
+// Names returns the names of the registered backends in alphabetical order.
+func Names() (names []string) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return
+}
@@ -0,0 +1,629 @@
+package backend
+
+// AWS Systems Manager Parameter Store backend. https://aws.amazon.com/systems-manager/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pyrooka/envman/config"
+)
+
+// SSM related constants.
+const (
+	ssmDefaultPrefix   = "/envman"
+	ssmService         = "ssm"
+	ssmTargetPrefix    = "AmazonSSM."
+	ssmContentType     = "application/x-amz-json-1.1"
+	ssmDeleteBatchSize = 10 // Maximum number of names in a DeleteParameters request.
+	awsSigningAlgo     = "AWS4-HMAC-SHA256"
+	awsDateFormat      = "20060102T150405Z"
+)
+
+// Registers the backend.
+func init() {
+	Register("ssm", func() IContextBackend { return &SSM{} })
+}
+
+//-------------------------------------------------------------------
+// Structs
+//-------------------------------------------------------------------
+
+// SSMConfig is the config section of the backend.
+type SSMConfig struct {
+	Region   string `json:"region"`
+	Profile  string `json:"profile"`
+	KMSKeyID string `json:"kmsKeyId"`
+	Prefix   string `json:"prefix"`
+	Endpoint string `json:"endpoint"`
+}
+
+// SSM uses the AWS Systems Manager Parameter Store for backend storage.
+// Every variable is a SecureString parameter with the name <prefix>/<environment>/<variable>.
+type SSM struct {
+	Region   string
+	KMSKeyID string
+	Prefix   string
+	Endpoint string
+
+	credentials *awsCredentials
+}
+
+// AWS credentials for the request signing.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// A parameter in the Parameter Store.
+type ssmParameter struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+// Response of the GetParametersByPath action.
+type ssmParametersResponse struct {
+	Parameters []ssmParameter `json:"Parameters"`
+	NextToken  string         `json:"NextToken"`
+}
+
+// Error response of the API.
+type ssmErrorResponse struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+//-------------------------------------------------------------------
+//  Credentials
+//-------------------------------------------------------------------
+
+// The credential sources of the AWS profiles which are not supported, by their keys.
+var unsupportedAWSSources = []struct {
+	key    string
+	source string
+}{
+	{"sso_session", "IAM Identity Center (SSO)"},
+	{"sso_start_url", "IAM Identity Center (SSO)"},
+	{"role_arn", "assumed role"},
+	{"credential_process", "credential_process"},
+	{"web_identity_token_file", "web identity"},
+}
+
+// The environment variables of the credential sources which are not supported.
+var unsupportedAWSEnvSources = []struct {
+	name   string
+	source string
+}{
+	{"AWS_WEB_IDENTITY_TOKEN_FILE", "web identity"},
+	{"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "container role"},
+	{"AWS_CONTAINER_CREDENTIALS_FULL_URI", "container role"},
+}
+
+// Returns the path of the shared AWS file from the environment variable, or the file in ~/.aws.
+func awsFilePath(envVar string, name string) (path string, err error) {
+	if path = os.Getenv(envVar); path != "" {
+		return
+	}
+
+	currentUser, err := user.Current()
+	if err != nil {
+		return
+	}
+	path = filepath.Join(currentUser.HomeDir, ".aws", name)
+
+	return
+}
+
+// Reads the key = value lines of the section from the INI file. A missing file has no values.
+func readAWSSection(path string, section string) (values map[string]string, err error) {
+	values = map[string]string{}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return values, nil
+	} else if err != nil {
+		return
+	}
+	defer file.Close()
+
+	// Simple INI parsing, only the key = value lines in the section.
+	inSection := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inSection = strings.Join(strings.Fields(line[1:len(line)-1]), " ") == section
+			continue
+		}
+		if !inSection {
+			continue
+		}
+
+		keyValue := strings.SplitN(line, "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		values[strings.TrimSpace(keyValue[0])] = strings.TrimSpace(keyValue[1])
+	}
+	err = scanner.Err()
+
+	return
+}
+
+// Loads the settings of the profile from the shared config file and the shared credentials file.
+// The values in the credentials file override the ones in the config file.
+func loadAWSProfile(profile string) (settings map[string]string, err error) {
+	configPath, err := awsFilePath("AWS_CONFIG_FILE", "config")
+	if err != nil {
+		return
+	}
+	credsPath, err := awsFilePath("AWS_SHARED_CREDENTIALS_FILE", "credentials")
+	if err != nil {
+		return
+	}
+
+	// The profiles of the config file are prefixed except the default one.
+	section := "profile " + profile
+	if profile == "default" {
+		section = profile
+	}
+	if settings, err = readAWSSection(configPath, section); err != nil {
+		return
+	}
+
+	creds, err := readAWSSection(credsPath, profile)
+	for key, value := range creds {
+		settings[key] = value
+	}
+
+	return
+}
+
+// Loads the credentials from the environment variables if allowed, or from the settings of the profile.
+// Only the static keys are supported, for the other credential sources an error tells which one is not supported.
+func loadAWSCredentials(profile string, settings map[string]string, fromEnv bool) (creds *awsCredentials, err error) {
+	if fromEnv {
+		if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+			creds = &awsCredentials{
+				AccessKeyID:     id,
+				SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+				SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			}
+			return
+		}
+	}
+
+	if settings["aws_access_key_id"] != "" && settings["aws_secret_access_key"] != "" {
+		creds = &awsCredentials{
+			AccessKeyID:     settings["aws_access_key_id"],
+			SecretAccessKey: settings["aws_secret_access_key"],
+			SessionToken:    settings["aws_session_token"],
+		}
+		return
+	}
+
+	for _, unsupported := range unsupportedAWSSources {
+		if settings[unsupported.key] != "" {
+			return nil, fmt.Errorf("unsupported credential source: %v in the %v profile, set the access keys in the environment variables or in the shared credentials file", unsupported.source, profile)
+		}
+	}
+	if fromEnv {
+		for _, unsupported := range unsupportedAWSEnvSources {
+			if os.Getenv(unsupported.name) != "" {
+				return nil, fmt.Errorf("unsupported credential source: %v from %v, set the access keys in the environment variables or in the shared credentials file", unsupported.source, unsupported.name)
+			}
+		}
+	}
+
+	err = fmt.Errorf("no credentials found for the %v profile, set the access keys in the environment variables or in the shared credentials file (the instance roles are not supported)", profile)
+
+	return
+}
+
+//-------------------------------------------------------------------
+//  HTTP requests
+//-------------------------------------------------------------------
+
+// Returns the HMAC-SHA256 of the data.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+// Returns the hex encoded SHA256 of the data.
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Signs the request with AWS Signature Version 4.
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func signAWSRequest(req *http.Request, payload []byte, creds *awsCredentials, region string, service string, now time.Time) {
+	amzDate := now.UTC().Format(awsDateFormat)
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	// Sign the host, the content type and all the amazon headers.
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uri,
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		hexSHA256(payload),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		awsSigningAlgo,
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsSigningAlgo, creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// Calls an action of the SSM API and decodes the response to the result.
+func (s *SSM) call(ctx context.Context, action string, input interface{}, result interface{}) (err error) {
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", ssmContentType)
+	req.Header.Set("X-Amz-Target", ssmTargetPrefix+action)
+	signAWSRequest(req, payload, s.credentials, s.Region, ssmService, time.Now())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := ssmErrorResponse{}
+		json.Unmarshal(body, &apiErr)
+		// The type is like com.amazonaws.ssm#ParameterNotFound
+		errType := apiErr.Type[strings.LastIndex(apiErr.Type, "#")+1:]
+		message := fmt.Sprintf("invalid status code: %v (%v). %v: %v", resp.StatusCode, http.StatusText(resp.StatusCode), errType, apiErr.Message)
+
+		switch errType {
+		case "UnrecognizedClientException", "InvalidSignatureException", "AccessDeniedException", "ExpiredTokenException":
+			return fmt.Errorf("%w: %v", ErrUnauthorized, message)
+		case "ThrottlingException":
+			return fmt.Errorf("%w: %v", ErrRateLimited, message)
+		default:
+			return errors.New(message)
+		}
+	}
+
+	if result != nil {
+		err = json.Unmarshal(body, result)
+	}
+
+	return
+}
+
+//-------------------------------------------------------------------
+//  SSM functions
+//-------------------------------------------------------------------
+
+// Returns the path of the environment.
+func (s *SSM) envPath(envName string) string {
+	return s.Prefix + "/" + envName
+}
+
+// Checks the name of the environment. The path separator cannot be in it.
+func checkSSMEnvName(envName string) (err error) {
+	if envName == "" || strings.Contains(envName, "/") {
+		err = invalidEnvName(envName)
+	}
+
+	return
+}
+
+// Gets all the parameters under the path. Follows the pagination.
+func (s *SSM) getParametersByPath(ctx context.Context, path string, recursive bool, decrypt bool) (params []ssmParameter, err error) {
+	input := map[string]interface{}{
+		"Path":           path,
+		"Recursive":      recursive,
+		"WithDecryption": decrypt,
+	}
+
+	for {
+		resp := ssmParametersResponse{}
+		err = s.call(ctx, "GetParametersByPath", input, &resp)
+		if err != nil {
+			return
+		}
+		params = append(params, resp.Parameters...)
+
+		if resp.NextToken == "" {
+			break
+		}
+		input["NextToken"] = resp.NextToken
+	}
+
+	return
+}
+
+// Deletes the parameters in batches.
+func (s *SSM) deleteParameters(ctx context.Context, names []string) (err error) {
+	for start := 0; start < len(names); start += ssmDeleteBatchSize {
+		end := start + ssmDeleteBatchSize
+		if end > len(names) {
+			end = len(names)
+		}
+
+		err = s.call(ctx, "DeleteParameters", map[string]interface{}{"Names": names[start:end]}, nil)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+//-------------------------------------------------------------------
+//  Interface functions
+//-------------------------------------------------------------------
+
+// Init loads the region and the credentials.
+func (s *SSM) Init(ctx context.Context, c *config.Config) (err error) {
+	conf := &SSMConfig{}
+	if err = c.Bind("ssm", conf); err != nil {
+		return
+	}
+
+	// The profile in the config skips the credentials in the environment variables.
+	profile := conf.Profile
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	settings, err := loadAWSProfile(profile)
+	if err != nil {
+		return
+	}
+
+	s.Region = conf.Region
+	if s.Region == "" {
+		s.Region = os.Getenv("AWS_REGION")
+	}
+	if s.Region == "" {
+		s.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.Region == "" {
+		s.Region = settings["region"]
+	}
+	if s.Region == "" {
+		return errors.New("no AWS region configured")
+	}
+
+	s.Prefix = "/" + strings.Trim(conf.Prefix, "/")
+	if s.Prefix == "/" {
+		s.Prefix = ssmDefaultPrefix
+	}
+	s.KMSKeyID = conf.KMSKeyID
+
+	s.Endpoint = conf.Endpoint
+	if s.Endpoint == "" {
+		s.Endpoint = fmt.Sprintf("https://ssm.%s.amazonaws.com/", s.Region)
+	}
+	if _, err = url.Parse(s.Endpoint); err != nil {
+		return
+	}
+
+	s.credentials, err = loadAWSCredentials(profile, settings, conf.Profile == "")
+
+	return
+}
+
+// List the environments or variables.
+func (s *SSM) List(ctx context.Context, envName string) (result []string, err error) {
+	if envName == "" {
+		// Collect the environments from the names of all the parameters.
+		params, err := s.getParametersByPath(ctx, s.Prefix, true, false)
+		if err != nil {
+			return nil, err
+		}
+
+		envs := map[string]bool{}
+		for _, param := range params {
+			env := strings.SplitN(strings.TrimPrefix(param.Name, s.Prefix+"/"), "/", 2)[0]
+			if !envs[env] {
+				envs[env] = true
+				result = append(result, env)
+			}
+		}
+
+		return result, nil
+	}
+
+	if err = checkSSMEnvName(envName); err != nil {
+		return
+	}
+
+	params, err := s.getParametersByPath(ctx, s.envPath(envName), false, false)
+	if err != nil {
+		return
+	}
+	if len(params) == 0 {
+		return nil, envNotFound(envName)
+	}
+
+	for _, param := range params {
+		result = append(result, path.Base(param.Name))
+	}
+
+	return
+}
+
+// Get returns the decrypted parameters of the environment.
+func (s *SSM) Get(ctx context.Context, envName string) (vars map[string]string, err error) {
+	if err = checkSSMEnvName(envName); err != nil {
+		return
+	}
+
+	params, err := s.getParametersByPath(ctx, s.envPath(envName), false, true)
+	if err != nil {
+		return
+	}
+	if len(params) == 0 {
+		return nil, envNotFound(envName)
+	}
+
+	vars = make(map[string]string, len(params))
+	for _, param := range params {
+		vars[path.Base(param.Name)] = param.Value
+	}
+
+	return
+}
+
+// Update puts the variables as SecureString parameters. Overwrites if exists.
+func (s *SSM) Update(ctx context.Context, envName string, variables map[string]string) (err error) {
+	if err = checkSSMEnvName(envName); err != nil {
+		return
+	}
+
+	// The Parameter Store does not allow empty values. Checked before the first write,
+	// because there is no transaction and a failure would leave the environment half updated.
+	for key, value := range variables {
+		if value == "" {
+			return fmt.Errorf("empty value of %v is not supported by SSM", key)
+		}
+	}
+
+	for key, value := range variables {
+		input := map[string]interface{}{
+			"Name":      s.envPath(envName) + "/" + key,
+			"Value":     value,
+			"Type":      "SecureString",
+			"Overwrite": true,
+		}
+		if s.KMSKeyID != "" {
+			input["KeyId"] = s.KMSKeyID
+		}
+
+		err = s.call(ctx, "PutParameter", input, nil)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Delete removes the parameters of the variables or all the parameters of the environment.
+func (s *SSM) Delete(ctx context.Context, envName string, envVars []string) (err error) {
+	vars, err := s.List(ctx, envName)
+	if err != nil {
+		return
+	}
+
+	if len(envVars) == 0 {
+		envVars = vars
+	}
+
+	// The missing variables are skipped.
+	existing := map[string]bool{}
+	for _, envVar := range vars {
+		existing[envVar] = true
+	}
+	names := make([]string, 0, len(envVars))
+	for _, envVar := range envVars {
+		if existing[envVar] {
+			names = append(names, s.envPath(envName)+"/"+envVar)
+		}
+	}
+
+	err = s.deleteParameters(ctx, names)
+
+	return
+}
+
+// CleanUp removes all the parameters under the prefix.
+func (s *SSM) CleanUp(ctx context.Context) (err error) {
+	params, err := s.getParametersByPath(ctx, s.Prefix, true, false)
+	if err != nil {
+		return
+	}
+
+	names := make([]string, 0, len(params))
+	for _, param := range params {
+		names = append(names, param.Name)
+	}
+
+	err = s.deleteParameters(ctx, names)
+
+	return
+}
@@ -0,0 +1,331 @@
+package backend_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pyrooka/envman/backend"
+	"github.com/pyrooka/envman/backend/backendtest"
+)
+
+//-------------------------------------------------------------------
+//  Fake Parameter Store
+//-------------------------------------------------------------------
+
+// Number of the parameters in a page of the fake, small to test the pagination.
+const fakeSSMPageSize = 2
+
+// Serves the used actions of the SSM API like AWS does.
+type fakeSSM struct {
+	mu      sync.Mutex
+	params  map[string]string
+	actions []string // The called actions.
+	fail    string   // Error type of the next response if set.
+}
+
+func newFakeSSM(t *testing.T) (fake *fakeSSM, server *httptest.Server) {
+	fake = &fakeSSM{params: map[string]string{}}
+	server = httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return
+}
+
+// Returns the called actions since the last call.
+func (f *fakeSSM) takeActions() (actions []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	actions, f.actions = f.actions, nil
+
+	return
+}
+
+func (f *fakeSSM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSSM.")
+	f.actions = append(f.actions, action)
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		writeSSMError(w, http.StatusBadRequest, "UnrecognizedClientException", "The security token included in the request is invalid.")
+		return
+	}
+	if f.fail != "" {
+		writeSSMError(w, http.StatusBadRequest, f.fail, "Injected error.")
+		f.fail = ""
+		return
+	}
+
+	var input struct {
+		Name      string
+		Value     string
+		Type      string
+		Overwrite bool
+		Path      string
+		Recursive bool
+		NextToken string
+		Names     []string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeSSMError(w, http.StatusBadRequest, "SerializationException", err.Error())
+		return
+	}
+
+	switch action {
+	case "PutParameter":
+		if input.Value == "" {
+			writeSSMError(w, http.StatusBadRequest, "ValidationException", "Value must not be empty.")
+			return
+		}
+		if _, exists := f.params[input.Name]; exists && !input.Overwrite {
+			writeSSMError(w, http.StatusBadRequest, "ParameterAlreadyExists", "The parameter already exists.")
+			return
+		}
+		f.params[input.Name] = input.Value
+		json.NewEncoder(w).Encode(map[string]interface{}{"Version": 1, "Tier": "Standard"})
+
+	case "GetParametersByPath":
+		var names []string
+		for name := range f.params {
+			rest := strings.TrimPrefix(name, strings.TrimSuffix(input.Path, "/")+"/")
+			if rest != name && (input.Recursive || !strings.Contains(rest, "/")) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		start, _ := strconv.Atoi(input.NextToken)
+		end := start + fakeSSMPageSize
+		resp := map[string]interface{}{}
+		if end < len(names) {
+			resp["NextToken"] = strconv.Itoa(end)
+		} else {
+			end = len(names)
+		}
+		params := []map[string]string{}
+		for _, name := range names[start:end] {
+			params = append(params, map[string]string{"Name": name, "Value": f.params[name], "Type": "SecureString"})
+		}
+		resp["Parameters"] = params
+		json.NewEncoder(w).Encode(resp)
+
+	case "DeleteParameters":
+		if len(input.Names) > 10 {
+			writeSSMError(w, http.StatusBadRequest, "ValidationException", "Too many names.")
+			return
+		}
+		deleted, invalid := []string{}, []string{}
+		for _, name := range input.Names {
+			if _, exists := f.params[name]; exists {
+				delete(f.params, name)
+				deleted = append(deleted, name)
+			} else {
+				invalid = append(invalid, name)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"DeletedParameters": deleted, "InvalidParameters": invalid})
+
+	default:
+		writeSSMError(w, http.StatusBadRequest, "InvalidAction", "Unknown action.")
+	}
+}
+
+// Writes an error response like AWS.
+func writeSSMError(w http.ResponseWriter, statusCode int, errType string, message string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{"__type": "com.amazonaws.ssm#" + errType, "message": message})
+}
+
+// Points the shared AWS files to a temporary directory, so the files of the user are not read.
+func noAWSFiles(t *testing.T) (dir string) {
+	dir = t.TempDir()
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+
+	return
+}
+
+// Returns an SSM backend which uses the fake.
+func newTestSSM(t *testing.T) (ssm *backend.SSM, fake *fakeSSM) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	noAWSFiles(t)
+
+	fake, server := newFakeSSM(t)
+	ssm = &backend.SSM{}
+	backendtest.Init(t, ssm, sectionConfig(t, "ssm", &backend.SSMConfig{Region: "eu-west-1", Endpoint: server.URL}))
+
+	return
+}
+
+//-------------------------------------------------------------------
+//  Tests
+//-------------------------------------------------------------------
+
+func TestSSM(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.IContextBackend {
+		ssm, _ := newTestSSM(t)
+		return ssm
+	})
+}
+
+func TestSSMEmptyValue(t *testing.T) {
+	ctx := context.Background()
+	ssm, fake := newTestSSM(t)
+
+	if err := ssm.Update(ctx, "dev", map[string]string{"A": "1", "B": "", "C": "3"}); err == nil {
+		t.Fatal("update with an empty value: no error")
+	}
+
+	// Nothing is written, not even the valid values.
+	if actions := fake.takeActions(); len(actions) != 0 {
+		t.Errorf("actions: %v, want none", actions)
+	}
+	if _, err := ssm.Get(ctx, "dev"); !errors.Is(err, backend.ErrEnvNotFound) {
+		t.Errorf("get: %v, want ErrEnvNotFound", err)
+	}
+}
+
+func TestSSMParameters(t *testing.T) {
+	ctx := context.Background()
+	ssm, fake := newTestSSM(t)
+
+	vars := map[string]string{}
+	for i := 0; i < 12; i++ {
+		vars["VAR_"+strconv.Itoa(i)] = strconv.Itoa(i)
+	}
+	if err := ssm.Update(ctx, "dev", vars); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := ssm.Update(ctx, "prod", map[string]string{"A": "1"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if _, exists := fake.params["/envman/dev/VAR_0"]; !exists {
+		t.Errorf("parameters: %v, want them under the prefix", fake.params)
+	}
+
+	// The pages are followed.
+	got, err := ssm.Get(ctx, "dev")
+	if err != nil || len(got) != len(vars) {
+		t.Errorf("get: %v, %v, want %v", got, err, vars)
+	}
+
+	// More parameters than a DeleteParameters request can take.
+	fake.takeActions()
+	if err := ssm.Delete(ctx, "dev", nil); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	deletes := 0
+	for _, action := range fake.takeActions() {
+		if action == "DeleteParameters" {
+			deletes++
+		}
+	}
+	if deletes != 2 {
+		t.Errorf("DeleteParameters requests: %v, want 2", deletes)
+	}
+	if envs, err := ssm.List(ctx, ""); err != nil || len(envs) != 1 || envs[0] != "prod" {
+		t.Errorf("list: %v, %v, want [prod]", envs, err)
+	}
+}
+
+func TestSSMErrors(t *testing.T) {
+	tests := []struct {
+		errType string
+		want    error
+	}{
+		{"AccessDeniedException", backend.ErrUnauthorized},
+		{"ExpiredTokenException", backend.ErrUnauthorized},
+		{"ThrottlingException", backend.ErrRateLimited},
+	}
+
+	for _, test := range tests {
+		t.Run(test.errType, func(t *testing.T) {
+			ssm, fake := newTestSSM(t)
+			fake.fail = test.errType
+
+			if _, err := ssm.List(context.Background(), ""); !errors.Is(err, test.want) {
+				t.Errorf("list: %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestSSMCredentials(t *testing.T) {
+	keys := "aws_access_key_id = AKID\naws_secret_access_key = secret\n"
+	tests := []struct {
+		name        string
+		config      string // The shared config file.
+		credentials string // The shared credentials file.
+		profile     string // The profile in the config of envman.
+		env         map[string]string
+		wantRegion  string
+		wantErr     string
+	}{
+		{"CredentialsFile", "[default]\nregion = eu-central-1\n", "[default]\n" + keys, "", nil, "eu-central-1", ""},
+		{"ConfigFile", "[profile ci]\nregion = us-east-1\n" + keys, "", "", map[string]string{"AWS_PROFILE": "ci"}, "us-east-1", ""},
+		{"CredentialsFirst", "[default]\nregion = eu-central-1\naws_access_key_id = OTHER\naws_secret_access_key = other\n", "[default]\n" + keys, "", nil, "eu-central-1", ""},
+		{"EnvironmentFirst", "", "[default]\naws_access_key_id = OTHER\naws_secret_access_key = other\n", "", map[string]string{"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "secret", "AWS_REGION": "eu-west-1"}, "eu-west-1", ""},
+		{"ProfileSkipsEnvironment", "[profile ci]\nregion = us-east-1\n", "[ci]\n" + keys, "ci", map[string]string{"AWS_ACCESS_KEY_ID": "OTHER"}, "us-east-1", ""},
+		{"SSO", "[profile ci]\nregion = us-east-1\nsso_session = corp\n", "", "ci", nil, "", "unsupported credential source: IAM Identity Center (SSO) in the ci profile"},
+		{"AssumeRole", "[default]\nregion = us-east-1\nrole_arn = arn:aws:iam::123456789012:role/ci\nsource_profile = base\n", "", "", nil, "", "unsupported credential source: assumed role in the default profile"},
+		{"CredentialProcess", "[default]\nregion = us-east-1\ncredential_process = aws-vault export ci\n", "", "", nil, "", "unsupported credential source: credential_process in the default profile"},
+		{"ContainerRole", "[default]\nregion = us-east-1\n", "", "", map[string]string{"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "/v2/credentials"}, "", "unsupported credential source: container role from AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"},
+		{"Missing", "[default]\nregion = us-east-1\n", "", "", nil, "", "no credentials found for the default profile"},
+		{"NoRegion", "", "[default]\n" + keys, "", nil, "", "no AWS region configured"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE", "AWS_REGION", "AWS_DEFAULT_REGION",
+				"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI"} {
+				t.Setenv(name, "")
+			}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			dir := noAWSFiles(t)
+			for name, content := range map[string]string{"config": test.config, "credentials": test.credentials} {
+				if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, server := newFakeSSM(t)
+			ssm := &backend.SSM{}
+			err := ssm.Init(ctx, sectionConfig(t, "ssm", &backend.SSMConfig{Profile: test.profile, Endpoint: server.URL}))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("init: %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("init: %v", err)
+			}
+
+			if ssm.Region != test.wantRegion {
+				t.Errorf("region: %q, want %q", ssm.Region, test.wantRegion)
+			}
+			// The fake accepts only the AKID access key.
+			if _, err := ssm.List(ctx, ""); err != nil {
+				t.Errorf("list: %v, want the right access key", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package backend
+
+// HashiCorp Vault backend. Uses the KV secrets engine version 2. https://www.vaultproject.io
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pyrooka/envman/config"
+)
+
+// Vault related constants.
+const (
+	vaultDefaultMount  = "secret"
+	vaultDefaultPrefix = "envman"
+	vaultAddrEnvVar    = "VAULT_ADDR"
+	vaultTokenEnvVar   = "VAULT_TOKEN"
+	mergePatchType     = "application/merge-patch+json"
+)
+
+// Registers the backend.
+func init() {
+	Register("vault", func() IContextBackend { return &Vault{} })
+}
+
+//-------------------------------------------------------------------
+// Structs
+//-------------------------------------------------------------------
+
+// VaultConfig is the config section of the backend.
+type VaultConfig struct {
+	Address   string `json:"address"`
+	Token     string `json:"token"`
+	RoleID    string `json:"roleId"`
+	SecretID  string `json:"secretId"`
+	Namespace string `json:"namespace"`
+	Mount     string `json:"mount"`
+	Prefix    string `json:"prefix"`
+}
+
+// Vault uses the KV version 2 secrets engine of HashiCorp Vault for backend storage.
+// Every environment is a secret under the prefix in the mount.
+type Vault struct {
+	Address   string
+	Token     string
+	Namespace string
+	Mount     string
+	Prefix    string
+	Client    *http.Client // Client for the requests. The default is used if nil.
+}
+
+// Response of the Vault API. Only the used fields.
+type vaultResponse struct {
+	Data struct {
+		Keys []string               `json:"keys"`
+		Data map[string]interface{} `json:"data"`
+	} `json:"data"`
+	Auth struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+//-------------------------------------------------------------------
+//  HTTP requests
+//-------------------------------------------------------------------
+
+// Makes a request to the Vault API. Returns the status code too, because 404 is not always an error.
+func (v *Vault) request(ctx context.Context, method string, path string, contentType string, payload interface{}) (resp *vaultResponse, statusCode int, err error) {
+	var content []byte
+	if payload != nil {
+		content, err = json.Marshal(payload)
+		if err != nil {
+			return
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(v.Address, "/")+"/v1/"+path, bytes.NewReader(content))
+	if err != nil {
+		return
+	}
+	if v.Token != "" {
+		req.Header.Add("X-Vault-Token", v.Token)
+	}
+	if v.Namespace != "" {
+		req.Header.Add("X-Vault-Namespace", v.Namespace)
+	}
+	if contentType != "" {
+		req.Header.Add("Content-Type", contentType)
+	}
+
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	httpResp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer httpResp.Body.Close()
+	statusCode = httpResp.StatusCode
+
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return
+	}
+
+	resp = &vaultResponse{}
+	if len(body) > 0 {
+		err = json.Unmarshal(body, resp)
+		if err != nil {
+			return
+		}
+	}
+
+	if statusCode < 200 || statusCode > 299 {
+		message := fmt.Sprintf("invalid status code: %v (%v)", statusCode, http.StatusText(statusCode))
+		if len(resp.Errors) > 0 {
+			message += ": " + strings.Join(resp.Errors, ", ")
+		}
+
+		// Vault responds with 403 for invalid tokens too.
+		switch statusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			err = fmt.Errorf("%w: %v", ErrUnauthorized, message)
+		case http.StatusTooManyRequests:
+			err = fmt.Errorf("%w: %v", ErrRateLimited, message)
+		default:
+			err = errors.New(message)
+		}
+	}
+
+	return
+}
+
+// Returns the API path of an environment.
+func (v *Vault) secretPath(kind string, envName string) string {
+	path := url.PathEscape(v.Mount) + "/" + kind
+	if v.Prefix != "" {
+		path += "/" + v.Prefix
+	}
+	if envName != "" {
+		path += "/" + url.PathEscape(envName)
+	}
+
+	return path
+}
+
+//-------------------------------------------------------------------
+//  Vault functions
+//-------------------------------------------------------------------
+
+// Login with AppRole and returns the client token.
+func (v *Vault) loginAppRole(ctx context.Context, roleID string, secretID string) (token string, err error) {
+	payload := map[string]string{"role_id": roleID, "secret_id": secretID}
+	resp, _, err := v.request(ctx, http.MethodPost, "auth/approle/login", "application/json", payload)
+	if err != nil {
+		return
+	}
+
+	token = resp.Auth.ClientToken
+	if token == "" {
+		err = errors.New("no token in the AppRole login response")
+	}
+
+	return
+}
+
+// Reads the secret of the environment.
+func (v *Vault) readSecret(ctx context.Context, envName string) (vars map[string]string, err error) {
+	resp, statusCode, err := v.request(ctx, http.MethodGet, v.secretPath("data", envName), "", nil)
+	if statusCode == http.StatusNotFound {
+		return nil, envNotFound(envName)
+	} else if err != nil {
+		return
+	}
+
+	vars = make(map[string]string, len(resp.Data.Data))
+	for key, value := range resp.Data.Data {
+		if str, ok := value.(string); ok {
+			vars[key] = str
+		} else {
+			// Not created by envman, but use it anyway.
+			vars[key] = fmt.Sprint(value)
+		}
+	}
+
+	return
+}
+
+// Lists the environments under the prefix.
+func (v *Vault) listSecrets(ctx context.Context) (envs []string, err error) {
+	resp, statusCode, err := v.request(ctx, http.MethodGet, v.secretPath("metadata", "")+"?list=true", "", nil)
+	if statusCode == http.StatusNotFound {
+		// Nothing created yet.
+		return []string{}, nil
+	} else if err != nil {
+		return
+	}
+
+	for _, key := range resp.Data.Keys {
+		// Skip the folders.
+		if strings.HasSuffix(key, "/") {
+			continue
+		}
+		envs = append(envs, key)
+	}
+
+	return
+}
+
+// Deletes all the versions and the metadata of the environment.
+func (v *Vault) deleteSecret(ctx context.Context, envName string) (err error) {
+	_, _, err = v.request(ctx, http.MethodDelete, v.secretPath("metadata", envName), "", nil)
+
+	return
+}
+
+//-------------------------------------------------------------------
+//  Interface functions
+//-------------------------------------------------------------------
+
+// Init sets the connection details and logs in with AppRole if no token given.
+func (v *Vault) Init(ctx context.Context, c *config.Config) (err error) {
+	conf := &VaultConfig{}
+	if err = c.Bind("vault", conf); err != nil {
+		return
+	}
+
+	v.Address = conf.Address
+	if v.Address == "" {
+		v.Address = os.Getenv(vaultAddrEnvVar)
+	}
+	if v.Address == "" {
+		return errors.New("no Vault address configured")
+	}
+
+	v.Mount = strings.Trim(conf.Mount, "/")
+	if v.Mount == "" {
+		v.Mount = vaultDefaultMount
+	}
+	v.Prefix = strings.Trim(conf.Prefix, "/")
+	if v.Prefix == "" {
+		v.Prefix = vaultDefaultPrefix
+	}
+	v.Namespace = conf.Namespace
+
+	v.Token = conf.Token
+	if v.Token == "" {
+		v.Token = os.Getenv(vaultTokenEnvVar)
+	}
+	if v.Token == "" {
+		if conf.RoleID == "" {
+			return errors.New("no Vault token or AppRole configured")
+		}
+
+		// The AppRole tokens are short living, so do not save it.
+		v.Token, err = v.loginAppRole(ctx, conf.RoleID, conf.SecretID)
+	}
+
+	return
+}
+
+// List the environments or variables.
+func (v *Vault) List(ctx context.Context, envName string) (result []string, err error) {
+	if envName == "" {
+		result, err = v.listSecrets(ctx)
+		return
+	}
+
+	vars, err := v.readSecret(ctx, envName)
+	if err != nil {
+		return
+	}
+
+	for key := range vars {
+		result = append(result, key)
+	}
+
+	return
+}
+
+// Get reads the secret of the environment.
+func (v *Vault) Get(ctx context.Context, envName string) (vars map[string]string, err error) {
+	vars, err = v.readSecret(ctx, envName)
+
+	return
+}
+
+// Update patches the secret or creates it if doesn't exist yet.
+func (v *Vault) Update(ctx context.Context, envName string, variables map[string]string) (err error) {
+	payload := map[string]interface{}{"data": variables}
+
+	_, statusCode, err := v.request(ctx, http.MethodPatch, v.secretPath("data", envName), mergePatchType, payload)
+	if statusCode == http.StatusNotFound {
+		// The patch only works for existing secrets.
+		_, _, err = v.request(ctx, http.MethodPost, v.secretPath("data", envName), "application/json", payload)
+	}
+
+	return
+}
+
+// Delete removes the whole secret or the variables from it.
+func (v *Vault) Delete(ctx context.Context, envName string, envVars []string) (err error) {
+	// Check if the environment exists.
+	vars, err := v.readSecret(ctx, envName)
+	if err != nil {
+		return
+	}
+
+	if len(envVars) == 0 {
+		err = v.deleteSecret(ctx, envName)
+		return
+	}
+
+	// A null value removes the key in a merge patch. The missing variables are skipped.
+	data := map[string]interface{}{}
+	for _, envVar := range envVars {
+		if _, exists := vars[envVar]; exists {
+			data[envVar] = nil
+		}
+	}
+	if len(data) == 0 {
+		return
+	}
+	_, _, err = v.request(ctx, http.MethodPatch, v.secretPath("data", envName), mergePatchType, map[string]interface{}{"data": data})
+
+	return
+}
+
+// CleanUp deletes all the environments.
+func (v *Vault) CleanUp(ctx context.Context) (err error) {
+	envs, err := v.listSecrets(ctx)
+	if err != nil {
+		return
+	}
+
+	for _, env := range envs {
+		err = v.deleteSecret(ctx, env)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
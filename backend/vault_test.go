@@ -0,0 +1,250 @@
+package backend_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pyrooka/envman/backend"
+	"github.com/pyrooka/envman/backend/backendtest"
+)
+
+//-------------------------------------------------------------------
+//  Fake Vault
+//-------------------------------------------------------------------
+
+// Paths of the secrets in the fake, with the default mount and prefix.
+const (
+	fakeVaultDataPath     = "/v1/secret/data/envman/"
+	fakeVaultMetadataPath = "/v1/secret/metadata/envman/"
+)
+
+// Serves the used part of the KV version 2 API like Vault does.
+type fakeVault struct {
+	token    string
+	mu       sync.Mutex
+	secrets  map[string]map[string]interface{}
+	requests []string // Method, path with the query and the content type of the requests.
+}
+
+func newFakeVault(t *testing.T, token string) (fake *fakeVault, server *httptest.Server) {
+	fake = &fakeVault{token: token, secrets: map[string]map[string]interface{}{}}
+	server = httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return
+}
+
+// Returns the requests since the last call.
+func (f *fakeVault) takeRequests() (requests []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	requests, f.requests = f.requests, nil
+
+	return
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, strings.TrimSpace(r.Method+" "+r.URL.RequestURI()+" "+r.Header.Get("Content-Type")))
+
+	if r.Header.Get("X-Vault-Token") != f.token {
+		writeVaultErrors(w, http.StatusForbidden, "permission denied")
+		return
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeVaultErrors(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	switch {
+	case r.URL.Path == strings.TrimSuffix(fakeVaultMetadataPath, "/") && r.Method == http.MethodGet && r.URL.Query().Get("list") == "true":
+		keys := []string{}
+		for name := range f.secrets {
+			keys = append(keys, name)
+		}
+		if len(keys) == 0 {
+			writeVaultErrors(w, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+
+	case strings.HasPrefix(r.URL.Path, fakeVaultMetadataPath) && r.Method == http.MethodDelete:
+		delete(f.secrets, strings.TrimPrefix(r.URL.Path, fakeVaultMetadataPath))
+		w.WriteHeader(http.StatusNoContent)
+
+	case strings.HasPrefix(r.URL.Path, fakeVaultDataPath):
+		name := strings.TrimPrefix(r.URL.Path, fakeVaultDataPath)
+		secret, exists := f.secrets[name]
+
+		switch r.Method {
+		case http.MethodGet:
+			if !exists {
+				writeVaultErrors(w, http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"data": secret}})
+		case http.MethodPost, http.MethodPut:
+			f.secrets[name] = body.Data
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{}})
+		case http.MethodPatch:
+			if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+				writeVaultErrors(w, http.StatusUnsupportedMediaType, "unsupported content type")
+				return
+			}
+			if !exists {
+				writeVaultErrors(w, http.StatusNotFound)
+				return
+			}
+			for key, value := range body.Data {
+				if value == nil {
+					delete(secret, key)
+				} else {
+					secret[key] = value
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{}})
+		default:
+			writeVaultErrors(w, http.StatusMethodNotAllowed)
+		}
+
+	default:
+		writeVaultErrors(w, http.StatusNotFound)
+	}
+}
+
+// Writes an error response like Vault.
+func writeVaultErrors(w http.ResponseWriter, statusCode int, messages ...string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": append([]string{}, messages...)})
+}
+
+//-------------------------------------------------------------------
+//  Tests
+//-------------------------------------------------------------------
+
+func TestVault(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.IContextBackend {
+		_, server := newFakeVault(t, "token")
+		vault := &backend.Vault{Client: server.Client()}
+		return backendtest.Init(t, vault, sectionConfig(t, "vault", &backend.VaultConfig{Address: server.URL, Token: "token"}))
+	})
+}
+
+func TestVaultRequests(t *testing.T) {
+	ctx := context.Background()
+	fake, server := newFakeVault(t, "token")
+	vault := &backend.Vault{Client: server.Client()}
+	backendtest.Init(t, vault, sectionConfig(t, "vault", &backend.VaultConfig{Address: server.URL, Token: "token"}))
+
+	tests := []struct {
+		name string
+		call func() error
+		want []string
+	}{
+		{
+			name: "ListEmpty",
+			call: func() error { _, err := vault.List(ctx, ""); return err },
+			want: []string{"GET /v1/secret/metadata/envman?list=true"},
+		},
+		{
+			name: "UpdateNew",
+			call: func() error { return vault.Update(ctx, "dev", map[string]string{"A": "1", "B": "2"}) },
+			want: []string{
+				"PATCH /v1/secret/data/envman/dev application/merge-patch+json",
+				"POST /v1/secret/data/envman/dev application/json",
+			},
+		},
+		{
+			name: "UpdateExisting",
+			call: func() error { return vault.Update(ctx, "dev", map[string]string{"B": "3"}) },
+			want: []string{"PATCH /v1/secret/data/envman/dev application/merge-patch+json"},
+		},
+		{
+			name: "List",
+			call: func() error { _, err := vault.List(ctx, ""); return err },
+			want: []string{"GET /v1/secret/metadata/envman?list=true"},
+		},
+		{
+			name: "DeleteVariable",
+			call: func() error { return vault.Delete(ctx, "dev", []string{"A"}) },
+			want: []string{
+				"GET /v1/secret/data/envman/dev",
+				"PATCH /v1/secret/data/envman/dev application/merge-patch+json",
+			},
+		},
+		{
+			name: "DeleteEnvironment",
+			call: func() error { return vault.Delete(ctx, "dev", nil) },
+			want: []string{
+				"GET /v1/secret/data/envman/dev",
+				"DELETE /v1/secret/metadata/envman/dev",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		if err := test.call(); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if requests := fake.takeRequests(); !reflect.DeepEqual(requests, test.want) {
+			t.Errorf("%v: requests %q, want %q", test.name, requests, test.want)
+		}
+	}
+}
+
+func TestVaultValues(t *testing.T) {
+	ctx := context.Background()
+	fake, server := newFakeVault(t, "token")
+	vault := &backend.Vault{Client: server.Client()}
+	backendtest.Init(t, vault, sectionConfig(t, "vault", &backend.VaultConfig{Address: server.URL, Token: "token"}))
+
+	if err := vault.Update(ctx, "dev", map[string]string{"A": "1", "B": "2"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := vault.Update(ctx, "dev", map[string]string{"B": "3"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := vault.Delete(ctx, "dev", []string{"A"}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	// The merge patch keeps the others and the null removes the key.
+	want := map[string]interface{}{"B": "3"}
+	if secret := fake.secrets["dev"]; !reflect.DeepEqual(secret, want) {
+		t.Errorf("stored secret: %v, want %v", secret, want)
+	}
+
+	// Secrets not created by envman can have other types.
+	fake.secrets["dev"]["PORT"] = 8080.0
+	vars, err := vault.Get(ctx, "dev")
+	if err != nil || vars["PORT"] != "8080" {
+		t.Errorf("get: %v, %v, want the number as string", vars, err)
+	}
+}
+
+func TestVaultUnauthorized(t *testing.T) {
+	_, server := newFakeVault(t, "token")
+	vault := &backend.Vault{Client: server.Client()}
+	backendtest.Init(t, vault, sectionConfig(t, "vault", &backend.VaultConfig{Address: server.URL, Token: "wrong"}))
+
+	if _, err := vault.List(context.Background(), ""); !errors.Is(err, backend.ErrUnauthorized) {
+		t.Errorf("list: %v, want %v", err, backend.ErrUnauthorized)
+	}
+}
@@ -0,0 +1,170 @@
+// Reference envman backend plugin. Stores all the environments in a JSON file.
+//
+// Install it to a directory on the PATH, then use it with envman -b jsonfile.
+// The path of the file can be set in the jsonfile section of the envman config.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+
+	"github.com/pyrooka/envman/backend"
+	"github.com/pyrooka/envman/config"
+)
+
+// Name of the backend. The executable should be named envman-backend-<name>.
+const name = "jsonfile"
+
+// Default file in the home directory.
+const defaultFile = ".envman-jsonfile.json"
+
+// Config is the config section of the backend.
+type Config struct {
+	Path string `json:"path"`
+}
+
+// JSONFile uses a JSON file for backend storage.
+type JSONFile struct {
+	Path         string
+	Environments map[string]map[string]string
+}
+
+// Writes the environments to the file.
+func (j *JSONFile) save() (err error) {
+	data, err := json.MarshalIndent(j.Environments, "", "  ")
+	if err != nil {
+		return
+	}
+
+	err = ioutil.WriteFile(j.Path, data, 0600)
+
+	return
+}
+
+// Returns the environment or an error if doesn't exist.
+func (j *JSONFile) env(envName string) (env map[string]string, err error) {
+	env, exists := j.Environments[envName]
+	if !exists {
+		err = fmt.Errorf("%w: %q", backend.ErrEnvNotFound, envName)
+	}
+
+	return
+}
+
+// Init reads the file.
+func (j *JSONFile) Init(ctx context.Context, c *config.Config) (err error) {
+	conf := &Config{}
+	if err = c.Bind(name, conf); err != nil {
+		return
+	}
+
+	j.Path = conf.Path
+	if j.Path == "" {
+		currentUser, err := user.Current()
+		if err != nil {
+			return err
+		}
+		j.Path = filepath.Join(currentUser.HomeDir, defaultFile)
+	}
+
+	j.Environments = map[string]map[string]string{}
+	data, err := ioutil.ReadFile(j.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &j.Environments)
+
+	return
+}
+
+// List returns the name of environments or variables.
+func (j *JSONFile) List(ctx context.Context, envName string) (result []string, err error) {
+	if envName == "" {
+		for key := range j.Environments {
+			result = append(result, key)
+		}
+		return
+	}
+
+	env, err := j.env(envName)
+	if err != nil {
+		return
+	}
+	for key := range env {
+		result = append(result, key)
+	}
+
+	return
+}
+
+// Get returns the environment variables with its values.
+func (j *JSONFile) Get(ctx context.Context, envName string) (vars map[string]string, err error) {
+	vars, err = j.env(envName)
+
+	return
+}
+
+// Update saves the variables to the environment.
+func (j *JSONFile) Update(ctx context.Context, envName string, variables map[string]string) (err error) {
+	if envName == "" {
+		return fmt.Errorf("%w: %q", backend.ErrInvalidName, envName)
+	}
+
+	if _, exists := j.Environments[envName]; !exists {
+		j.Environments[envName] = map[string]string{}
+	}
+	for key, value := range variables {
+		j.Environments[envName][key] = value
+	}
+
+	err = j.save()
+
+	return
+}
+
+// Delete removes the environment or the variables from it.
+func (j *JSONFile) Delete(ctx context.Context, envName string, envVars []string) (err error) {
+	env, err := j.env(envName)
+	if err != nil {
+		return
+	}
+
+	if len(envVars) == 0 {
+		delete(j.Environments, envName)
+		return j.save()
+	}
+
+	// The missing variables are skipped.
+	for _, envVar := range envVars {
+		delete(env, envVar)
+	}
+
+	err = j.save()
+
+	return
+}
+
+// CleanUp removes the file.
+func (j *JSONFile) CleanUp(ctx context.Context) (err error) {
+	err = os.Remove(j.Path)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+
+	return
+}
+
+func main() {
+	if err := backend.ServePlugin(name, &JSONFile{}); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/pyrooka/envman/backend"
+	"github.com/pyrooka/envman/backend/plugintest"
+	"github.com/pyrooka/envman/config"
+)
+
+// Builds the plugin to a temporary directory and puts it on the PATH.
+func buildPlugin(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	executable := "envman-backend-" + name
+	if runtime.GOOS == "windows" {
+		executable += ".exe"
+	}
+
+	if output, err := exec.Command("go", "build", "-o", filepath.Join(dir, executable), ".").CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v: %s", err, output)
+	}
+
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// Returns the config section of the plugin with a file in a temporary directory.
+func section(t *testing.T) json.RawMessage {
+	data, err := json.Marshal(&Config{Path: filepath.Join(t.TempDir(), "environments.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestPlugin(t *testing.T) {
+	buildPlugin(t)
+
+	path, err := exec.LookPath("envman-backend-" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugintest.Run(t, path, section(t))
+}
+
+func TestPluginErrors(t *testing.T) {
+	buildPlugin(t)
+	ctx := context.Background()
+
+	// Found on the PATH like envman does.
+	b, err := backend.New(name)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	c := &config.Config{Backends: map[string]json.RawMessage{name: section(t)}}
+	if err = b.Init(ctx, c); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+
+	// The errors of the plugin are mapped back to the errors of the backend package.
+	if _, err := b.Get(ctx, "missing"); !errors.Is(err, backend.ErrEnvNotFound) {
+		t.Errorf("get missing environment: %v, want ErrEnvNotFound", err)
+	}
+	if err := b.Delete(ctx, "missing", nil); !errors.Is(err, backend.ErrEnvNotFound) {
+		t.Errorf("delete missing environment: %v, want ErrEnvNotFound", err)
+	}
+	if err := b.Update(ctx, "", map[string]string{"A": "1"}); !errors.Is(err, backend.ErrInvalidName) {
+		t.Errorf("update without a name: %v, want ErrInvalidName", err)
+	}
+}
@@ -0,0 +1,9 @@
+package config
+
+// CacheConfig structure. The ages are durations, like 10m or 24h.
+type CacheConfig struct {
+	Enabled  bool   `json:"enabled"`
+	MaxAge   string `json:"maxAge,omitempty"`   // The environments are used without asking the backend until this age. 1m if empty.
+	MaxStale string `json:"maxStale,omitempty"` // The environments are used until this age if the backend is unreachable. 168h if empty.
+	Key      string `json:"key,omitempty"`      // Key of the cache files, generated on the first use.
+}
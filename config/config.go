@@ -2,6 +2,7 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/user"
@@ -11,11 +12,90 @@ import (
 // Store the path of the config file.
 var configFilePath string
 
-// Config defines the structure of the config file.
+// Keys of the config file which are not backend sections.
+const (
+	defaultBackendKey = "defaultBackend"
+	encryptionKey     = "encryption"
+	cacheKey          = "cache"
+)
+
+// Config defines the structure of the config file. The sections of the backends
+// are at the top level of the file too, keyed by the name of the backend.
 type Config struct {
-	DefaultBackend string           `json:"defaultBackend"`
-	Local          LocalConfig      `json:"local"`
-	GitHubGist     GitHubGistConfig `json:"githubgist"`
+	DefaultBackend string                     `json:"defaultBackend"`
+	Encryption     EncryptionConfig           `json:"encryption"`
+	Cache          CacheConfig                `json:"cache"`
+	Backends       map[string]json.RawMessage `json:"-"` // The raw sections of the backends.
+
+	bound map[string]interface{} // The decoded sections, written back on save.
+}
+
+// Bind decodes the section of the backend into the given pointer. The section is saved
+// from the pointer, so the backend can modify it later.
+func (c *Config) Bind(name string, section interface{}) (err error) {
+	if name == defaultBackendKey || name == encryptionKey || name == cacheKey {
+		return fmt.Errorf("reserved config section name: %q", name)
+	}
+
+	if raw, exists := c.Backends[name]; exists && len(raw) > 0 {
+		if err = json.Unmarshal(raw, section); err != nil {
+			return fmt.Errorf("invalid %q config section: %v", name, err)
+		}
+	}
+
+	if c.bound == nil {
+		c.bound = map[string]interface{}{}
+	}
+	c.bound[name] = section
+
+	return
+}
+
+// UnmarshalJSON reads the known keys and keeps all the others as backend sections.
+func (c *Config) UnmarshalJSON(data []byte) (err error) {
+	var sections map[string]json.RawMessage
+	if err = json.Unmarshal(data, &sections); err != nil {
+		return
+	}
+
+	if raw, exists := sections[defaultBackendKey]; exists {
+		if err = json.Unmarshal(raw, &c.DefaultBackend); err != nil {
+			return
+		}
+		delete(sections, defaultBackendKey)
+	}
+	if raw, exists := sections[encryptionKey]; exists {
+		if err = json.Unmarshal(raw, &c.Encryption); err != nil {
+			return
+		}
+		delete(sections, encryptionKey)
+	}
+	if raw, exists := sections[cacheKey]; exists {
+		if err = json.Unmarshal(raw, &c.Cache); err != nil {
+			return
+		}
+		delete(sections, cacheKey)
+	}
+
+	c.Backends = sections
+
+	return
+}
+
+// MarshalJSON writes the known keys and the backend sections to the top level.
+func (c *Config) MarshalJSON() ([]byte, error) {
+	sections := map[string]interface{}{}
+	for name, raw := range c.Backends {
+		sections[name] = raw
+	}
+	for name, section := range c.bound {
+		sections[name] = section
+	}
+	sections[defaultBackendKey] = c.DefaultBackend
+	sections[encryptionKey] = c.Encryption
+	sections[cacheKey] = c.Cache
+
+	return json.Marshal(sections)
 }
 
 // Helper functions.
@@ -62,7 +142,7 @@ func Load() (c *Config, err error) {
 	return
 }
 
-// Save writes the config to the file.
+// Save writes the config to the file. Only the user can read it, because it contains the tokens and the keys.
 func (c *Config) Save() (err error) {
 	// Create JSON from the struct.
 	data, err := json.Marshal(c)
@@ -71,12 +151,17 @@ func (c *Config) Save() (err error) {
 	}
 
 	// Write to file.
-	file, err := os.Create(configFilePath)
+	file, err := os.OpenFile(configFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return
 	}
 	defer file.Close()
 
+	// The mode is not changed by the open if the file already exists.
+	if err = file.Chmod(0600); err != nil {
+		return
+	}
+
 	_, err = file.Write(data)
 
 	return
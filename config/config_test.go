@@ -0,0 +1,49 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestSavePermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no Unix permissions")
+	}
+
+	oldPath := configFilePath
+	configFilePath = filepath.Join(t.TempDir(), ".envman")
+	t.Cleanup(func() { configFilePath = oldPath })
+
+	// Written by an earlier version, readable by everyone.
+	if err := ioutil.WriteFile(configFilePath, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{DefaultBackend: "local", Cache: CacheConfig{Key: "secret"}}
+	if err := c.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	info, err := os.Stat(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("mode: %v, want 0600", mode)
+	}
+
+	// A new file too.
+	configFilePath = filepath.Join(t.TempDir(), ".envman")
+	if err := c.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if info, err = os.Stat(configFilePath); err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("mode of a new file: %v, want 0600", mode)
+	}
+}
@@ -0,0 +1,7 @@
+package config
+
+// EncryptionConfig structure.
+type EncryptionConfig struct {
+	Enabled        bool `json:"enabled"`
+	AllowPlaintext bool `json:"allowPlaintext"` // Load the values saved before the encryption was turned on, to migrate them.
+}
@@ -1,6 +0,0 @@
-package config
-
-// GitHubGistConfig structure.
-type GitHubGistConfig struct {
-	Token string `json:"token"`
-}
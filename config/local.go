@@ -1,6 +0,0 @@
-package config
-
-// LocalConfig structure.
-type LocalConfig struct {
-	Environments map[string]map[string]string `json:"environments"`
-}
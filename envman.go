@@ -1,22 +1,82 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"gopkg.in/urfave/cli.v1"
 
 	"github.com/pyrooka/envman/backend"
 	"github.com/pyrooka/envman/config"
+	"github.com/pyrooka/envman/shell"
 )
 
-const scriptPrefixTemplate = "loadenv_%s.%s"
+// Name templates of the created scripts.
+const (
+	scriptPrefixTemplate       = "loadenv_%s.%s"
+	unloadScriptPrefixTemplate = "unloadenv_%s.%s"
+)
+
+// Exit codes of the known errors.
+const (
+	exitCodeError        = 1
+	exitCodeInvalidName  = 2
+	exitCodeNotFound     = 3
+	exitCodeUnauthorized = 4
+	exitCodeRateLimited  = 5
+	exitCodeConflict     = 6
+)
+
+// Prints the error with a hint if the user can do something about it and returns the exit code for it.
+func handleError(err error) (exitCode int) {
+	fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+
+	switch {
+	case errors.Is(err, backend.ErrEnvNotFound), errors.Is(err, backend.ErrVarNotFound), errors.Is(err, backend.ErrRevisionNotFound):
+		exitCode = exitCodeNotFound
+	case errors.Is(err, backend.ErrReservedName), errors.Is(err, backend.ErrInvalidName):
+		exitCode = exitCodeInvalidName
+	case errors.Is(err, backend.ErrUnauthorized):
+		fmt.Fprintln(os.Stderr, "The credentials of the backend are invalid or expired. Update them in the config, or run envman again to login.")
+		exitCode = exitCodeUnauthorized
+	case errors.Is(err, backend.ErrRateLimited):
+		var rateLimitErr *backend.RateLimitError
+		if errors.As(err, &rateLimitErr) && !rateLimitErr.Reset.IsZero() {
+			fmt.Fprintf(os.Stderr, "The backend is rate limited. Try again after %v.\n", rateLimitErr.Reset.Local().Format("15:04:05"))
+		} else {
+			fmt.Fprintln(os.Stderr, "The backend is rate limited. Try again later.")
+		}
+		exitCode = exitCodeRateLimited
+	case errors.Is(err, backend.ErrConflict):
+		fmt.Fprintln(os.Stderr, "The same variables were changed somewhere else at the same time. Check them and save again.")
+		exitCode = exitCodeConflict
+	case errors.Is(err, backend.ErrCycle):
+		fmt.Fprintln(os.Stderr, "The environments inherit from each other. Change the parents with envman inherit.")
+		exitCode = exitCodeError
+	case errors.Is(err, context.DeadlineExceeded):
+		fmt.Fprintln(os.Stderr, "The backend didn't respond in time. Try again with a longer --timeout.")
+		exitCode = exitCodeError
+	default:
+		exitCode = exitCodeError
+	}
+
+	return
+}
 
 // Creates a shell script.
 func createScript(name string, content string) (err error) {
-	file, err := os.Create(name)
+	// Only the user should be able to read the secrets.
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return
 	}
@@ -27,68 +87,208 @@ func createScript(name string, content string) (err error) {
 	return
 }
 
-// Creates the shell scripts with the environemnt variables based on the OS type.
-func createScripts(envName string, envVars map[string]string) (err error) {
-	var scriptName, script string
+// Gets the shells for the scripts. The shell flag has the priority, then the SHELL environment variable
+// and if none of them set, decides based on the OS type.
+func detectShells(shellName string) []string {
+	if shellName != "" {
+		return []string{shellName}
+	}
+
+	// An unsupported login shell (e.g. xonsh) falls back to the default of the OS.
+	if shellPath := os.Getenv("SHELL"); shellPath != "" {
+		name := strings.TrimSuffix(filepath.Base(shellPath), ".exe")
+		if _, err := shell.Lookup(name); err == nil {
+			return []string{name}
+		}
+	}
 
 	switch runtime.GOOS {
 	case "windows":
-		// First create the batch script.
-		scriptName = fmt.Sprintf(scriptPrefixTemplate, envName, "bat")
-		script = fmt.Sprintln("@echo off")
-		for key, value := range envVars {
-			script += fmt.Sprintln(fmt.Sprintf("SET %s=%s", key, value))
+		// Both powershell and batch scripts. The powershell can eval the output, so it is the first.
+		return []string{"powershell", "cmd"}
+	default:
+		// If not Windows should be SH compatible, right?
+		return []string{"sh"}
+	}
+}
+
+// Creates the shell scripts with the environemnt variables for the given shells.
+func createScripts(envName string, envVars map[string]string, shellNames []string) (err error) {
+	for _, shellName := range shellNames {
+		generator, err := shell.Lookup(shellName)
+		if err != nil {
+			return err
+		}
+
+		script, err := generator.Script(envVars)
+		if err != nil {
+			return err
 		}
+
+		scriptName := fmt.Sprintf(scriptPrefixTemplate, envName, generator.Extension)
 		err = createScript(scriptName, script)
 		if err != nil {
-			return
+			return err
 		}
+	}
+
+	return
+}
+
+// Prints the script of the shell with the environment variables to the writer.
+func printScript(w io.Writer, envVars map[string]string, shellName string) (err error) {
+	generator, err := shell.Lookup(shellName)
+	if err != nil {
+		return
+	}
+
+	script, err := generator.Script(envVars)
+	if err != nil {
+		return
+	}
+
+	_, err = fmt.Fprint(w, script)
+
+	return
+}
 
-		// Then the powershell script.
-		scriptName = fmt.Sprintf(scriptPrefixTemplate, envName, "ps1")
-		script = ""
-		for key, value := range envVars {
-			script += fmt.Sprintln(fmt.Sprintf("$env:%s=\"%s\"", key, value))
+// Creates the unload scripts which revert the environment variables to the current values.
+func createUnloadScripts(envName string, envVars map[string]string, shellNames []string) (err error) {
+	// Capture the current values of the variables which will be overwritten.
+	names := make([]string, 0, len(envVars))
+	previous := map[string]string{}
+	for key := range envVars {
+		names = append(names, key)
+		if value, exists := os.LookupEnv(key); exists {
+			previous[key] = value
 		}
-		err = createScript(scriptName, script)
+	}
 
-	default:
-		// If not Windows should be SH compatible, right?
-		scriptName = fmt.Sprintf(scriptPrefixTemplate, envName, "sh")
-		for key, value := range envVars {
-			script += fmt.Sprintln(fmt.Sprintf("export %s=%s", key, value))
+	for _, shellName := range shellNames {
+		generator, err := shell.Lookup(shellName)
+		if err != nil {
+			return err
+		}
+
+		script, err := generator.UnloadScript(names, previous)
+		if err != nil {
+			return err
 		}
 
+		scriptName := fmt.Sprintf(unloadScriptPrefixTemplate, envName, generator.Extension)
 		err = createScript(scriptName, script)
+		if err != nil {
+			return err
+		}
 	}
 
 	return
 }
 
-// Gets the backend based on the input string.
-func getBackend(backendStr string) (backend.IBackend, error) {
-	switch backendStr {
-	case "local":
-		l := backend.Local{}
-		return &l, nil
-	case "githubgist":
-		g := backend.GitHubGist{}
-		return &g, nil
-	default:
-		return nil, errors.New("backend not found")
+// Prints the variables with their metadata in a table to the writer, sorted by the name.
+func printVariables(w io.Writer, vars map[string]backend.Variable) (err error) {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Local().Format("2006-01-02 15:04:05")
+	}
+	orDash := func(value string) string {
+		if value == "" {
+			return "-"
+		}
+		return value
+	}
+
+	writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tCREATED\tUPDATED\tUPDATED BY\tTAGS\tDESCRIPTION")
+	for _, name := range names {
+		variable := vars[name]
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\t%v\n", name, formatTime(variable.Created), formatTime(variable.Updated),
+			orDash(variable.UpdatedBy), orDash(strings.Join(variable.Tags, ",")), variable.Description)
+	}
+
+	err = writer.Flush()
+
+	return
+}
+
+// Prints the variables with the environments they come from, sorted by the name.
+func printResolved(vars map[string]backend.ResolvedVariable) (err error) {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tFROM")
+	for _, name := range names {
+		fmt.Fprintf(writer, "%v\t%v\n", name, vars[name].Source)
+	}
+
+	err = writer.Flush()
+
+	return
+}
+
+// Restores the own variables of the environment to the revision in one change. The inherited variables are not rolled back.
+func rollback(ctx context.Context, b backend.IContextBackend, envName string, id string) (err error) {
+	var versioned backend.Versioned
+	if !backend.As(b, &versioned) {
+		return fmt.Errorf("%w: rollback", backend.ErrNotSupported)
+	}
+
+	vars, err := versioned.GetRevision(ctx, envName, id)
+	if err != nil {
+		return
 	}
+
+	// The variables added since the revision are removed by the same write.
+	err = versioned.Replace(ctx, envName, vars)
+
+	return
+}
+
+// Cancels the context on the first interrupt signal. The second one terminates the process,
+// in case something doesn't respect the context (e.g. a password prompt).
+func cancelOnInterrupt(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+
+	go func() {
+		<-signals
+		cancel()
+		signal.Stop(signals)
+	}()
 }
 
 func main() {
 	// Load the config.
 	conf, err := config.Load()
 	if err != nil {
-		fmt.Println("Error while reading the config: " + err.Error())
+		fmt.Fprintln(os.Stderr, "Error while reading the config: "+err.Error())
 		return
 	}
 
 	// The backend which we will use.
-	var backendObj backend.IBackend
+	var backendObj backend.IContextBackend
+
+	// Context of the backend calls. Cancelled by Ctrl-C or when the timeout expires.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cancelOnInterrupt(cancel)
+	// Stops the timer of the timeout if it is set.
+	cancelTimeout := context.CancelFunc(func() {})
+
+	// Exit code of the executed command.
+	var exitCode int
 
 	app := cli.NewApp()
 	app.Name = "Envman"
@@ -104,9 +304,44 @@ func main() {
 			backendStr = conf.DefaultBackend
 		}
 
-		backendObj, err = getBackend(backendStr)
+		switch c.String("encryption") {
+		case "":
+		case "on":
+			conf.Encryption.Enabled = true
+		case "off":
+			conf.Encryption.Enabled = false
+		default:
+			return errors.New("invalid encryption value, should be on or off")
+		}
+
+		switch c.String("cache") {
+		case "":
+		case "on":
+			conf.Cache.Enabled = true
+		case "off":
+			conf.Cache.Enabled = false
+		default:
+			return errors.New("invalid cache value, should be on or off")
+		}
+
+		backendObj, err = backend.New(backendStr)
 		if backendObj != nil {
-			err = backendObj.Init(conf)
+			// Wrap the backend with the cache. Below the encryption, so the cached values are encrypted twice.
+			if conf.Cache.Enabled {
+				backendObj = &backend.Cached{Backend: backendObj, Name: backendStr}
+			}
+			// Wrap the backend if the values should be encrypted.
+			if conf.Encryption.Enabled {
+				backendObj = &backend.Encrypted{Backend: backendObj, AllowPlaintext: conf.Encryption.AllowPlaintext}
+			}
+			// Resolve the inherited variables. Above the encryption, so the parents can be read.
+			backendObj = &backend.Layered{Backend: backendObj}
+			// The timeout is for all the backend calls together.
+			if timeout := c.Duration("timeout"); timeout > 0 {
+				ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+			}
+
+			err = backendObj.Init(ctx, conf)
 		}
 
 		return err
@@ -116,7 +351,19 @@ func main() {
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:  "backend, b",
-			Usage: "Use and set a different backend as default",
+			Usage: "Use and set a different backend as default (" + strings.Join(backend.Names(), ", ") + ")",
+		},
+		cli.DurationFlag{
+			Name:  "timeout, t",
+			Usage: "Cancel the backend calls after the timeout (e.g. 30s, 1m)",
+		},
+		cli.StringFlag{
+			Name:  "encryption, e",
+			Usage: "Turn the client-side encryption on or off and set it as default",
+		},
+		cli.StringFlag{
+			Name:  "cache",
+			Usage: "Turn the offline cache on or off and set it as default",
 		},
 	}
 
@@ -127,9 +374,45 @@ func main() {
 			Aliases:   []string{"ls"},
 			Usage:     "List the environments or variables in the environment",
 			ArgsUsage: "[environment name]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "long, l",
+					Usage: "Show the metadata of the variables",
+				},
+				cli.BoolFlag{
+					Name:  "resolved, r",
+					Usage: "Show the environment each variable is inherited from",
+				},
+			},
 			Action: func(c *cli.Context) error {
+				if c.Bool("resolved") && c.NArg() > 0 {
+					var layered *backend.Layered
+					if !backend.As(backendObj, &layered) {
+						return fmt.Errorf("%w: inheritance", backend.ErrNotSupported)
+					}
+
+					vars, err := layered.Resolve(ctx, c.Args().First())
+					if err != nil {
+						return err
+					}
+					return printResolved(vars)
+				}
+
+				if c.Bool("long") && c.NArg() > 0 {
+					var annotated backend.Annotated
+					if !backend.As(backendObj, &annotated) {
+						return fmt.Errorf("%w: metadata", backend.ErrNotSupported)
+					}
+
+					vars, err := annotated.GetVariables(ctx, c.Args().First())
+					if err != nil {
+						return err
+					}
+					return printVariables(os.Stdout, vars)
+				}
+
 				// If the first arg is not provided (empty string ""), then list the environments.
-				result, err := backendObj.List(c.Args().First())
+				result, err := backendObj.List(ctx, c.Args().First())
 				if err == nil {
 					fmt.Println(result)
 				}
@@ -141,18 +424,85 @@ func main() {
 			Aliases:   []string{"l"},
 			Usage:     "Load and environment to the current one",
 			ArgsUsage: "environment_name",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "shell, s",
+					Usage: "Print the script for the given shell to the standard output (" + strings.Join(shell.Names(), ", ") + ")",
+				},
+				cli.BoolFlag{
+					Name:  "print, p",
+					Usage: "Print the script for the current shell to the standard output",
+				},
+				cli.BoolFlag{
+					Name:  "file, f",
+					Usage: "Write the script to a file even if the shell is given",
+				},
+				cli.BoolFlag{
+					Name:  "unload, u",
+					Usage: "Create an unload script too, which restores the current values",
+				},
+			},
 			Action: func(c *cli.Context) error {
 				if c.NArg() < 1 {
 					return errors.New("missing environment name")
 				}
 
 				envName := c.Args().First()
-				vars, err := backendObj.Get(envName)
+				vars, err := backendObj.Get(ctx, envName)
+				if err != nil {
+					return err
+				}
+
+				shellNames := detectShells(c.String("shell"))
+				toStdout := (c.IsSet("shell") || c.Bool("print")) && !c.Bool("file")
+				if toStdout {
+					// Only one script can be printed.
+					shellNames = shellNames[:1]
+				}
+
+				// The unload script must capture the values before the variables are loaded, so it is always a file.
+				if c.Bool("unload") {
+					err = createUnloadScripts(envName, vars, shellNames)
+					if err != nil {
+						return err
+					}
+				}
+
+				// Print the script, so it can be evaluated without writing the secrets to the disk.
+				if toStdout {
+					err = printScript(os.Stdout, vars, shellNames[0])
+					return err
+				}
+
+				err = createScripts(envName, vars, shellNames)
+				return err
+			},
+		},
+		{
+			Name:      "exec",
+			Aliases:   []string{"x"},
+			Usage:     "Execute a command with the variables of the environment",
+			ArgsUsage: "environment_name [--] command [arguments...]",
+			// Do not steal the flags of the command.
+			SkipArgReorder: true,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "clean, c",
+					Usage: "Replace the current environment instead of merging into it",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() < 2 {
+					return errors.New("not enough argument")
+				}
+
+				args := c.Args()
+				vars, err := backendObj.Get(ctx, args[0])
 				if err != nil {
 					return err
 				}
 
-				err = createScripts(envName, vars)
+				exitCode, err = runCommand(commandArgs(args[1:]), vars, c.Bool("clean"))
 				return err
 			},
 		},
@@ -161,6 +511,16 @@ func main() {
 			Aliases:   []string{"s"},
 			Usage:     "Save environment variables to an environment",
 			ArgsUsage: "environment_name environment_variables...",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "description, d",
+					Usage: "Set the description of the variables",
+				},
+				cli.StringSliceFlag{
+					Name:  "tag",
+					Usage: "Set the tags of the variables, can be repeated",
+				},
+			},
 			Action: func(c *cli.Context) error {
 				if c.NArg() < 2 {
 					return errors.New("not enough argument")
@@ -176,7 +536,23 @@ func main() {
 					}
 				}
 
-				err = backendObj.Update(args[0], envVars)
+				description, tags := c.String("description"), c.StringSlice("tag")
+				if description == "" && len(tags) == 0 {
+					err = backendObj.Update(ctx, args[0], envVars)
+					return err
+				}
+
+				var annotated backend.Annotated
+				if !backend.As(backendObj, &annotated) {
+					return fmt.Errorf("%w: metadata", backend.ErrNotSupported)
+				}
+
+				vars := make(map[string]backend.Variable, len(envVars))
+				for key, value := range envVars {
+					vars[key] = backend.Variable{Value: value, VariableMetadata: backend.VariableMetadata{Description: description, Tags: tags}}
+				}
+
+				err = annotated.UpdateVariables(ctx, args[0], vars)
 				return err
 			},
 		},
@@ -192,9 +568,9 @@ func main() {
 
 				args := c.Args()
 				if len(args) == 1 {
-					err = backendObj.Delete(args[0], []string{})
+					err = backendObj.Delete(ctx, args[0], []string{})
 				} else {
-					err = backendObj.Delete(args[0], args[1:])
+					err = backendObj.Delete(ctx, args[0], args[1:])
 				}
 
 				return err
@@ -204,22 +580,107 @@ func main() {
 			Name:  "cleanup",
 			Usage: "Cleanup the backend, delete all the created files",
 			Action: func(c *cli.Context) error {
-				err = backendObj.CleanUp()
+				err = backendObj.CleanUp(ctx)
 				return err
 			},
 		},
+		{
+			Name:      "attach",
+			Usage:     "Use an existing storage of the backend (e.g. a gist)",
+			ArgsUsage: "id",
+			Action: func(c *cli.Context) error {
+				if c.NArg() < 1 {
+					return errors.New("not enough argument")
+				}
+
+				var attacher backend.Attacher
+				if !backend.As(backendObj, &attacher) {
+					return fmt.Errorf("%w: attach", backend.ErrNotSupported)
+				}
+
+				err = attacher.Attach(ctx, c.Args().First())
+				return err
+			},
+		},
+		{
+			Name:      "inherit",
+			Usage:     "Set the parents of an environment, or remove them if none given",
+			ArgsUsage: "environment_name [parent_environments...]",
+			Action: func(c *cli.Context) error {
+				if c.NArg() < 1 {
+					return errors.New("not enough argument")
+				}
+
+				var layered *backend.Layered
+				if !backend.As(backendObj, &layered) {
+					return fmt.Errorf("%w: inheritance", backend.ErrNotSupported)
+				}
+
+				args := c.Args()
+				err = layered.SetParents(ctx, args[0], args[1:])
+				return err
+			},
+		},
+		{
+			Name:      "history",
+			Usage:     "List the revisions of an environment",
+			ArgsUsage: "environment_name",
+			Action: func(c *cli.Context) error {
+				if c.NArg() < 1 {
+					return errors.New("not enough argument")
+				}
+
+				var versioned backend.Versioned
+				if !backend.As(backendObj, &versioned) {
+					return fmt.Errorf("%w: history", backend.ErrNotSupported)
+				}
+
+				revisions, err := versioned.History(ctx, c.Args().First())
+				if err != nil {
+					return err
+				}
+
+				for _, revision := range revisions {
+					line := fmt.Sprintf("%v\t%v", revision.ID, revision.Time.Local().Format("2006-01-02 15:04:05"))
+					if revision.Message != "" {
+						line += "\t" + revision.Message
+					}
+					fmt.Println(line)
+				}
+
+				return nil
+			},
+		},
+		{
+			Name:      "rollback",
+			Usage:     "Restore an environment to a revision",
+			ArgsUsage: "environment_name revision",
+			Action: func(c *cli.Context) error {
+				if c.NArg() < 2 {
+					return errors.New("not enough argument")
+				}
+
+				args := c.Args()
+				return rollback(ctx, backendObj, args[0], args[1])
+			},
+		},
 	}
 
 	// Run the command line application.
 	err = app.Run(os.Args)
+	// Called here, because os.Exit skips the deferred calls.
+	cancelTimeout()
+	cancel()
 	if err != nil {
-		fmt.Println("Error: " + err.Error())
+		exitCode = handleError(err)
 	}
 
 	// Save the config.
 	err = conf.Save()
 	if err != nil {
-		fmt.Println("Error while writing the config: " + err.Error())
-		return
+		fmt.Fprintln(os.Stderr, "Error while writing the config: "+err.Error())
+		os.Exit(exitCodeError)
 	}
+
+	os.Exit(exitCode)
 }
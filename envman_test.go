@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pyrooka/envman/backend"
+	"github.com/pyrooka/envman/backend/backendtest"
+	"github.com/pyrooka/envman/config"
+)
+
+func TestDetectShells(t *testing.T) {
+	osDefault := []string{"sh"}
+	if runtime.GOOS == "windows" {
+		osDefault = []string{"powershell", "cmd"}
+	}
+
+	tests := []struct {
+		name  string
+		flag  string
+		shell string
+		want  []string
+	}{
+		{"Flag", "fish", "/bin/zsh", []string{"fish"}},
+		{"Environment", "", "/usr/bin/zsh", []string{"zsh"}},
+		{"Executable", "", "/c/Program Files/PowerShell/7/pwsh.exe", []string{"pwsh"}},
+		{"Unsupported", "", "/usr/bin/xonsh", osDefault},
+		{"Unset", "", "", osDefault},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("SHELL", test.shell)
+
+			if shells := detectShells(test.flag); !reflect.DeepEqual(shells, test.want) {
+				t.Errorf("detect shells: %v, want %v", shells, test.want)
+			}
+		})
+	}
+}
+
+func TestPrintVariables(t *testing.T) {
+	updated := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	vars := map[string]backend.Variable{
+		"B": {Value: "secret"},
+		"A": {Value: "secret", VariableMetadata: backend.VariableMetadata{
+			Description: "Database address", Tags: []string{"db", "prod"}, Created: updated.Add(-time.Hour), Updated: updated, UpdatedBy: "user@host",
+		}},
+	}
+
+	var output bytes.Buffer
+	if err := printVariables(&output, vars); err != nil {
+		t.Fatalf("print: %v", err)
+	}
+
+	// Sorted by the name, the missing metadata is a dash and the values are not shown.
+	format := "2006-01-02 15:04:05"
+	want := [][]string{
+		strings.Fields("NAME CREATED UPDATED UPDATED BY TAGS DESCRIPTION"),
+		strings.Fields("A " + updated.Add(-time.Hour).Local().Format(format) + " " + updated.Local().Format(format) + " user@host db,prod Database address"),
+		strings.Fields("B - - - -"),
+	}
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	if len(lines) != len(want) || strings.Contains(output.String(), "secret") {
+		t.Fatalf("output: %q, want %v lines without the values", output.String(), len(want))
+	}
+	for i, line := range lines {
+		if fields := strings.Fields(line); !reflect.DeepEqual(fields, want[i]) {
+			t.Errorf("line %v: %q, want %q", i, fields, want[i])
+		}
+	}
+}
+
+func TestRollback(t *testing.T) {
+	ctx := context.Background()
+	local := &backend.Local{}
+	layered := &backend.Layered{Backend: local}
+	backendtest.Init(t, layered, &config.Config{})
+
+	mustUpdate := func(envName string, vars map[string]string) {
+		t.Helper()
+		if err := local.Update(ctx, envName, vars); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+	}
+	mustUpdate("base", map[string]string{"A": "1"})
+	mustUpdate("dev", map[string]string{"B": "1", backend.ParentsVariable: "base"})
+	mustUpdate("dev", map[string]string{"B": "2", "C": "3"})
+
+	// One revision, which changes B back and removes the added C.
+	if err := rollback(ctx, layered, "dev", "1"); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	revisions, err := local.History(ctx, "dev")
+	if err != nil || len(revisions) != 3 {
+		t.Errorf("history: %v, %v, want one more revision", revisions, err)
+	}
+	want := map[string]string{"B": "1", backend.ParentsVariable: "base"}
+	if vars, err := local.Get(ctx, "dev"); err != nil || !reflect.DeepEqual(vars, want) {
+		t.Errorf("own variables: %v, %v, want %v", vars, err, want)
+	}
+	if vars, err := layered.Get(ctx, "dev"); err != nil || vars["A"] != "1" {
+		t.Errorf("resolved variables: %v, %v, want the inherited A", vars, err)
+	}
+
+	// The environment is created again after it was deleted.
+	if err := local.Delete(ctx, "dev", nil); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := rollback(ctx, layered, "dev", "2"); err != nil {
+		t.Fatalf("rollback deleted environment: %v", err)
+	}
+	want = map[string]string{"B": "2", "C": "3", backend.ParentsVariable: "base"}
+	if vars, err := local.Get(ctx, "dev"); err != nil || !reflect.DeepEqual(vars, want) {
+		t.Errorf("own variables: %v, %v, want %v", vars, err, want)
+	}
+
+	if err := rollback(ctx, layered, "dev", "9"); !errors.Is(err, backend.ErrRevisionNotFound) {
+		t.Errorf("rollback to missing revision: %v, want ErrRevisionNotFound", err)
+	}
+	if err := rollback(ctx, &backend.Dir{}, "dev", "1"); !errors.Is(err, backend.ErrNotSupported) {
+		t.Errorf("rollback without history: %v, want ErrNotSupported", err)
+	}
+}
+
+// Changes the working directory to a temporary one until the end of the test.
+func chdirTemp(t *testing.T) (dir string) {
+	dir = t.TempDir()
+	oldDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(oldDir) })
+
+	return
+}
+
+func TestUnloadScripts(t *testing.T) {
+	dir := chdirTemp(t)
+	t.Setenv("ENVMAN_TEST_A", "it's old")
+	t.Setenv("ENVMAN_TEST_B", "")
+	os.Unsetenv("ENVMAN_TEST_B")
+	vars := map[string]string{"ENVMAN_TEST_A": "new", "ENVMAN_TEST_B": "added"}
+
+	if err := createUnloadScripts("dev", vars, []string{"sh", "fish"}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	// The values before the load are restored, the new variables are removed.
+	tests := map[string]string{
+		"unloadenv_dev.sh":   "export ENVMAN_TEST_A='it'\\''s old'\nunset ENVMAN_TEST_B\n",
+		"unloadenv_dev.fish": "set -gx ENVMAN_TEST_A 'it\\'s old'\nset -e ENVMAN_TEST_B\n",
+	}
+	for name, want := range tests {
+		path := filepath.Join(dir, name)
+		if data, err := ioutil.ReadFile(path); err != nil || string(data) != want {
+			t.Errorf("%v: %q, %v, want %q", name, data, err, want)
+		}
+		if info, err := os.Stat(path); err == nil && runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+			t.Errorf("%v: mode %v, want 0600", name, info.Mode().Perm())
+		}
+	}
+
+	if err := createUnloadScripts("dev", vars, []string{"xonsh"}); err == nil {
+		t.Error("create for an unsupported shell: no error")
+	}
+}
+
+func TestPrintScript(t *testing.T) {
+	chdirTemp(t)
+	vars := map[string]string{"B": "2", "A": "it's"}
+
+	var output bytes.Buffer
+	if err := printScript(&output, vars, "sh"); err != nil {
+		t.Fatalf("print: %v", err)
+	}
+	if want := "export A='it'\\''s'\nexport B='2'\n"; output.String() != want {
+		t.Errorf("script: %q, want %q", output.String(), want)
+	}
+
+	// Printed only, nothing is written to the disk.
+	if files, err := ioutil.ReadDir("."); err != nil || len(files) != 0 {
+		t.Errorf("files: %v, %v, want none", files, err)
+	}
+
+	if err := printScript(&output, vars, "xonsh"); err == nil {
+		t.Error("print for an unsupported shell: no error")
+	}
+}
+
+// Loads with the printed script and unloads with the created file, like eval "$(envman load -p -u ENV_NAME)".
+func TestLoadUnloadRoundTrip(t *testing.T) {
+	path, err := exec.LookPath("sh")
+	if err != nil || runtime.GOOS == "windows" {
+		t.Skip("sh is not installed")
+	}
+	chdirTemp(t)
+	t.Setenv("ENVMAN_TEST_A", "old")
+	t.Setenv("ENVMAN_TEST_B", "")
+	os.Unsetenv("ENVMAN_TEST_B")
+	vars := map[string]string{"ENVMAN_TEST_A": "new $HOME", "ENVMAN_TEST_B": "added"}
+
+	if err := createUnloadScripts("dev", vars, []string{"sh"}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	var load bytes.Buffer
+	if err := printScript(&load, vars, "sh"); err != nil {
+		t.Fatalf("print: %v", err)
+	}
+
+	script := load.String() + `printf '%s,%s;' "$ENVMAN_TEST_A" "$ENVMAN_TEST_B"
+. ./unloadenv_dev.sh
+printf '%s,%s' "$ENVMAN_TEST_A" "${ENVMAN_TEST_B-unset}"`
+	want := "new $HOME,added;old,unset"
+	if output, err := exec.Command(path, "-c", script).Output(); err != nil || string(output) != want {
+		t.Errorf("output: %q, %v, want %q", output, err, want)
+	}
+}
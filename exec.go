@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Signals forwarded to the child process.
+var forwardedSignals = []os.Signal{syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT}
+
+// Returns the command from the arguments after the environment name, without the separator.
+func commandArgs(args []string) []string {
+	if len(args) > 0 && args[0] == "--" {
+		return args[1:]
+	}
+
+	return args
+}
+
+// Creates the environment of the child process. If clean is true, only the given variables will be set,
+// otherwise they are merged into the current environment overwriting the existing ones.
+func buildEnviron(envVars map[string]string, clean bool) (environ []string) {
+	if !clean {
+		for _, keyValue := range os.Environ() {
+			key := strings.SplitN(keyValue, "=", 2)[0]
+			if !containsKey(envVars, key) {
+				environ = append(environ, keyValue)
+			}
+		}
+	}
+
+	// Sort the keys, so the order is always the same.
+	keys := make([]string, 0, len(envVars))
+	for key := range envVars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		environ = append(environ, key+"="+envVars[key])
+	}
+
+	return
+}
+
+// Checks if the key is in the variables. Variable names are case insensitive on Windows.
+func containsKey(envVars map[string]string, key string) bool {
+	if _, exists := envVars[key]; exists {
+		return true
+	}
+
+	if runtime.GOOS == "windows" {
+		for envVar := range envVars {
+			if strings.EqualFold(envVar, key) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Runs the command with the environment variables and waits for it.
+// The standard streams are inherited and the signals are forwarded to the child.
+// The interrupt is not forwarded, because the terminal sends it to the child too and a second one
+// makes many tools force-quit. Envman ignores it and exits when the child does.
+// Returns the exit code of the command.
+func runCommand(args []string, envVars map[string]string, clean bool) (exitCode int, err error) {
+	if len(args) == 0 {
+		err = errors.New("missing command")
+		return
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = buildEnviron(envVars, clean)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+
+	// Forward the signals while the child is running.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append(forwardedSignals, os.Interrupt)...)
+	go func() {
+		for sig := range signals {
+			if sig == os.Interrupt {
+				continue
+			}
+			// Nothing to do if the process already exited or the signal is not supported.
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	err = cmd.Wait()
+
+	signal.Stop(signals)
+	close(signals)
+
+	// A non-zero exit code is not an error of envman, just pass it back.
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		err = nil
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			// Same as the shells do.
+			exitCode = 128 + int(status.Signal())
+		} else {
+			exitCode = exitErr.ExitCode()
+		}
+	}
+
+	return
+}
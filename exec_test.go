@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Skips the test if there is no sh to run the commands with.
+func requireSh(t *testing.T) {
+	t.Helper()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("signals and exit statuses of sh")
+	}
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+}
+
+func TestBuildEnviron(t *testing.T) {
+	t.Setenv("ENVMAN_TEST_KEPT", "kept")
+	t.Setenv("ENVMAN_TEST_OVERRIDDEN", "old")
+	vars := map[string]string{"ENVMAN_TEST_OVERRIDDEN": "new", "ENVMAN_TEST_ADDED": "added"}
+
+	// Merged into the current environment.
+	environ := buildEnviron(vars, false)
+	count := map[string]int{}
+	for _, keyValue := range environ {
+		count[keyValue]++
+	}
+	for _, keyValue := range []string{"ENVMAN_TEST_KEPT=kept", "ENVMAN_TEST_OVERRIDDEN=new", "ENVMAN_TEST_ADDED=added"} {
+		if count[keyValue] != 1 {
+			t.Errorf("merged environment has %q %v times, want once", keyValue, count[keyValue])
+		}
+	}
+	if count["ENVMAN_TEST_OVERRIDDEN=old"] != 0 || len(environ) != len(os.Environ())+1 {
+		t.Errorf("merged environment: %v, want the old value replaced", environ)
+	}
+
+	// Only the variables, sorted.
+	want := []string{"ENVMAN_TEST_ADDED=added", "ENVMAN_TEST_OVERRIDDEN=new"}
+	if environ := buildEnviron(vars, true); !reflect.DeepEqual(environ, want) {
+		t.Errorf("clean environment: %v, want %v", environ, want)
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"--", "ls", "-l"}, []string{"ls", "-l"}},
+		{[]string{"ls", "-l"}, []string{"ls", "-l"}},
+		{[]string{"ls", "--", "-l"}, []string{"ls", "--", "-l"}},
+		{[]string{"--", "--"}, []string{"--"}},
+		{[]string{"--"}, []string{}},
+	}
+
+	for _, test := range tests {
+		if command := commandArgs(test.args); !reflect.DeepEqual(command, test.want) {
+			t.Errorf("command of %q: %q, want %q", test.args, command, test.want)
+		}
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	requireSh(t)
+
+	tests := []struct {
+		name     string
+		script   string
+		vars     map[string]string
+		exitCode int
+	}{
+		{"Success", "exit 0", nil, 0},
+		{"ExitCode", "exit 3", nil, 3},
+		{"Variables", `test "$ENVMAN_TEST" = "value"`, map[string]string{"ENVMAN_TEST": "value"}, 0},
+		{"Killed", "kill -TERM $$", nil, 128 + int(syscall.SIGTERM)},
+		{"KilledByQuit", "kill -QUIT $$", nil, 128 + int(syscall.SIGQUIT)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exitCode, err := runCommand([]string{"sh", "-c", test.script}, test.vars, false)
+			if err != nil || exitCode != test.exitCode {
+				t.Errorf("run %q: %v, %v, want %v", test.script, exitCode, err, test.exitCode)
+			}
+		})
+	}
+
+	if _, err := runCommand(nil, nil, false); err == nil {
+		t.Error("run without command: no error")
+	}
+	if _, err := runCommand([]string{"envman-test-missing-command"}, nil, false); err == nil {
+		t.Error("run missing command: no error")
+	}
+}
+
+func TestRunCommandSignals(t *testing.T) {
+	requireSh(t)
+
+	// The child tells which signal it got by its exit code.
+	ready := filepath.Join(t.TempDir(), "ready")
+	script := `trap 'exit 10' INT; trap 'exit 11' TERM; touch "$READY"; while :; do sleep 0.01; done`
+
+	done := make(chan int)
+	go func() {
+		exitCode, err := runCommand([]string{"sh", "-c", script}, map[string]string{"READY": ready}, false)
+		if err != nil {
+			t.Errorf("run: %v", err)
+		}
+		done <- exitCode
+	}()
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(ready); err == nil {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("the child didn't start")
+		}
+	}
+
+	// The interrupt is ignored, the terminal sends it to the child directly. The others are forwarded.
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sig := range []os.Signal{os.Interrupt, syscall.SIGTERM} {
+		if err := self.Signal(sig); err != nil {
+			t.Fatalf("signal %v: %v", sig, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	select {
+	case exitCode := <-done:
+		if exitCode != 11 {
+			t.Errorf("exit code: %v, want 11 from the forwarded SIGTERM only", exitCode)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the child didn't exit, SIGTERM was not forwarded")
+	}
+}
@@ -0,0 +1,113 @@
+package shell
+
+// Registry of the script generators by shell name.
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Generator creates the scripts for a shell dialect.
+type Generator struct {
+	Extension string  // Extension of the script file.
+	Header    string  // First lines of the script.
+	Encoder   Encoder // Encoder for the variables.
+}
+
+// The registered generators by shell name.
+var generators = map[string]*Generator{}
+
+func init() {
+	sh := &Generator{Extension: "sh", Encoder: Sh{}}
+	for _, name := range []string{"sh", "bash", "zsh", "dash", "ksh", "mksh", "ash", "busybox"} {
+		Register(name, sh)
+	}
+
+	csh := &Generator{Extension: "csh", Encoder: Csh{}}
+	Register("csh", csh)
+	Register("tcsh", csh)
+
+	nu := &Generator{Extension: "nu", Encoder: Nu{}}
+	Register("nu", nu)
+	Register("nushell", nu)
+
+	powerShell := &Generator{Extension: "ps1", Encoder: PowerShell{}}
+	Register("powershell", powerShell)
+	Register("pwsh", powerShell)
+
+	Register("fish", &Generator{Extension: "fish", Encoder: Fish{}})
+	Register("elvish", &Generator{Extension: "elv", Encoder: Elvish{}})
+	Register("cmd", &Generator{Extension: "bat", Header: fmt.Sprintln("@echo off"), Encoder: Cmd{}})
+}
+
+// Register adds a generator for the shell. Overwrites the existing one.
+func Register(name string, g *Generator) {
+	generators[name] = g
+}
+
+// Lookup returns the generator of the shell.
+func Lookup(name string) (g *Generator, err error) {
+	g, exists := generators[name]
+	if !exists {
+		err = fmt.Errorf("unsupported shell: %v", name)
+	}
+
+	return
+}
+
+// Names returns the name of the registered shells in alphabetical order.
+func Names() (names []string) {
+	for name := range generators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return
+}
+
+// Script creates a script which sets the variables.
+func (g *Generator) Script(envVars map[string]string) (script string, err error) {
+	script = g.Header
+
+	// Sort the keys, so the output is always the same.
+	keys := make([]string, 0, len(envVars))
+	for key := range envVars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		line, err := g.Encoder.Set(key, envVars[key])
+		if err != nil {
+			return "", err
+		}
+		script += fmt.Sprintln(line)
+	}
+
+	return
+}
+
+// UnloadScript creates a script which reverts the variables. The variables in the previous
+// values are restored, all the other ones are unset.
+func (g *Generator) UnloadScript(names []string, previous map[string]string) (script string, err error) {
+	script = g.Header
+
+	// Sort the names, so the output is always the same.
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		var line string
+		if value, exists := previous[name]; exists {
+			line, err = g.Encoder.Set(name, value)
+		} else {
+			line, err = g.Encoder.Unset(name)
+		}
+		if err != nil {
+			return "", err
+		}
+		script += fmt.Sprintln(line)
+	}
+
+	return
+}
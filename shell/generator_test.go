@@ -0,0 +1,67 @@
+package shell
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestUnloadScript(t *testing.T) {
+	// A had a value before the load, B and C didn't.
+	names := []string{"C", "A", "B"}
+	previous := map[string]string{"A": "it's old"}
+
+	tests := map[string]string{
+		"sh":         "export A='it'\\''s old'\nunset B\nunset C\n",
+		"cmd":        "@echo off\nSET A=it's old\nSET B=\nSET C=\n",
+		"powershell": "$env:A='it''s old'\nRemove-Item Env:B -ErrorAction SilentlyContinue\nRemove-Item Env:C -ErrorAction SilentlyContinue\n",
+		"fish":       "set -gx A 'it\\'s old'\nset -e B\nset -e C\n",
+		"csh":        "setenv A 'it'\\''s old'\nunsetenv B\nunsetenv C\n",
+		"nu":         "$env.A = r#'it's old'#\nhide-env -i B\nhide-env -i C\n",
+		"elvish":     "set-env A 'it''s old'\nunset-env B\nunset-env C\n",
+	}
+
+	for shellName, want := range tests {
+		t.Run(shellName, func(t *testing.T) {
+			generator, err := Lookup(shellName)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if script, err := generator.UnloadScript(names, previous); err != nil || script != want {
+				t.Errorf("unload script: %q, %v, want %q", script, err, want)
+			}
+			if _, err := generator.UnloadScript([]string{"A B"}, nil); err == nil {
+				t.Error("unload script with an invalid name: no error")
+			}
+		})
+	}
+}
+
+// Loads and unloads the variables with the POSIX shells on the machine.
+func TestUnloadRoundTrip(t *testing.T) {
+	generator, err := Lookup("sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	load, err := generator.Script(map[string]string{"A": "new", "B": "added"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unload, err := generator.UnloadScript([]string{"A", "B"}, map[string]string{"A": "it's $old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, shellName := range []string{"sh", "bash", "dash", "zsh", "ksh"} {
+		path, err := exec.LookPath(shellName)
+		if err != nil {
+			continue
+		}
+
+		script := "A='it'\\''s $old'; export A\n" + load + "printf '%s,%s;' \"$A\" \"$B\"\n" + unload + "printf '%s,%s' \"$A\" \"${B-unset}\""
+		want := "new,added;it's $old,unset"
+		if output, err := exec.Command(path, "-c", script).Output(); err != nil || string(output) != want {
+			t.Errorf("%v: %q, %v, want %q", shellName, output, err, want)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package shell
+
+// Quoting of the environment variables for the generated scripts.
+// Every shell has its own encoder, because the quoting rules are totally different.
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Encoder creates the lines of a script which set or unset an environment variable.
+type Encoder interface {
+	Set(name string, value string) (line string, err error)
+	Unset(name string) (line string, err error)
+}
+
+//-------------------------------------------------------------------
+//  Validation
+//-------------------------------------------------------------------
+
+// ValidateName checks the name of an environment variable.
+// Only letters, digits and underscores allowed and it cannot start with a digit,
+// because this is the only form every shell accepts without quoting.
+func ValidateName(name string) (err error) {
+	if name == "" {
+		return fmt.Errorf("empty variable name")
+	}
+
+	for i, r := range name {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return fmt.Errorf("invalid variable name: %q", name)
+		}
+	}
+
+	return
+}
+
+// Calls the function with every rune of the value and the bytes it was decoded from.
+// Unlike range, the invalid UTF-8 bytes are passed as they are instead of U+FFFD,
+// so they can be copied to the output unchanged.
+func forEachRune(value string, f func(r rune, raw string)) {
+	for i := 0; i < len(value); {
+		r, size := utf8.DecodeRuneInString(value[i:])
+		f(r, value[i:i+size])
+		i += size
+	}
+}
+
+// Checks the value for characters which cannot be in an environment variable at all.
+func validateValue(name string, value string) (err error) {
+	if strings.ContainsRune(value, 0) {
+		err = fmt.Errorf("value of %v contains a NUL character", name)
+	}
+
+	return
+}
+
+// Validates both the name and the value.
+func validate(name string, value string) (err error) {
+	if err = ValidateName(name); err != nil {
+		return
+	}
+
+	err = validateValue(name, value)
+
+	return
+}
+
+//-------------------------------------------------------------------
+//  POSIX sh
+//-------------------------------------------------------------------
+
+// Sh encodes for POSIX compatible shells (sh, bash, zsh, dash, ksh...).
+type Sh struct{}
+
+// QuoteSh quotes the value between single quotes. Nothing is special between single quotes,
+// except the single quote itself, so it closes the quoting, adds an escaped quote and opens again.
+func QuoteSh(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// Set returns an export line.
+func (Sh) Set(name string, value string) (line string, err error) {
+	if err = validate(name, value); err != nil {
+		return
+	}
+
+	line = fmt.Sprintf("export %s=%s", name, QuoteSh(value))
+
+	return
+}
+
+// Unset returns an unset line.
+func (Sh) Unset(name string) (line string, err error) {
+	if err = ValidateName(name); err != nil {
+		return
+	}
+
+	line = "unset " + name
+
+	return
+}
+
+//-------------------------------------------------------------------
+//  cmd.exe
+//-------------------------------------------------------------------
+
+// Cmd encodes for cmd.exe batch files.
+type Cmd struct{}
+
+// QuoteCmd escapes the value for a SET command in a batch file. The value is not quoted,
+// because an odd number of quotes in the value would make the rest of the line unquoted.
+// Instead every special character is escaped with a caret, and the percent sign is doubled.
+// Delayed expansion (the ! character) is off by default, so it is not handled.
+// Newlines cannot be represented in a batch file at all, so values with them are rejected.
+func QuoteCmd(value string) (quoted string, err error) {
+	if strings.ContainsAny(value, "\r\n") {
+		err = fmt.Errorf("newlines are not supported by cmd.exe")
+		return
+	}
+
+	var b strings.Builder
+	forEachRune(value, func(r rune, raw string) {
+		switch r {
+		case '^', '&', '|', '<', '>', '(', ')', '"':
+			b.WriteRune('^')
+		case '%':
+			b.WriteRune('%')
+		}
+		b.WriteString(raw)
+	})
+	quoted = b.String()
+
+	return
+}
+
+// Set returns a SET line. Note that an empty value removes the variable in cmd.exe.
+func (Cmd) Set(name string, value string) (line string, err error) {
+	if err = validate(name, value); err != nil {
+		return
+	}
+
+	quoted, err := QuoteCmd(value)
+	if err != nil {
+		return "", fmt.Errorf("value of %v: %v", name, err)
+	}
+
+	line = fmt.Sprintf("SET %s=%s", name, quoted)
+
+	return
+}
+
+// Unset returns a SET line with empty value.
+func (Cmd) Unset(name string) (line string, err error) {
+	if err = ValidateName(name); err != nil {
+		return
+	}
+
+	line = "SET " + name + "="
+
+	return
+}
+
+//-------------------------------------------------------------------
+//  PowerShell
+//-------------------------------------------------------------------
+
+// PowerShell encodes for PowerShell scripts.
+type PowerShell struct{}
+
+// QuotePowerShell quotes the value between single quotes, where no variable expansion happens.
+// A single quote is escaped by doubling it. PowerShell treats the typographic quotes
+// as single quotes too, so those are doubled as well.
+func QuotePowerShell(value string) string {
+	var b strings.Builder
+	b.WriteRune('\'')
+	forEachRune(value, func(r rune, raw string) {
+		switch r {
+		case '\'', '‘', '’', '‚', '‛':
+			b.WriteString(raw)
+		}
+		b.WriteString(raw)
+	})
+	b.WriteRune('\'')
+
+	return b.String()
+}
+
+// Set returns an $env: assignment.
+func (PowerShell) Set(name string, value string) (line string, err error) {
+	if err = validate(name, value); err != nil {
+		return
+	}
+
+	line = fmt.Sprintf("$env:%s=%s", name, QuotePowerShell(value))
+
+	return
+}
+
+// Unset returns a Remove-Item line.
+func (PowerShell) Unset(name string) (line string, err error) {
+	if err = ValidateName(name); err != nil {
+		return
+	}
+
+	line = fmt.Sprintf("Remove-Item Env:%s -ErrorAction SilentlyContinue", name)
+
+	return
+}
+
+//-------------------------------------------------------------------
+//  fish
+//-------------------------------------------------------------------
+
+// Fish encodes for the fish shell.
+type Fish struct{}
+
+// QuoteFish quotes the value between single quotes. In fish only the backslash
+// and the single quote are special between single quotes, both can be escaped with a backslash.
+func QuoteFish(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// Set returns a set -gx line.
+func (Fish) Set(name string, value string) (line string, err error) {
+	if err = validate(name, value); err != nil {
+		return
+	}
+
+	line = fmt.Sprintf("set -gx %s %s", name, QuoteFish(value))
+
+	return
+}
+
+// Unset returns a set -e line.
+func (Fish) Unset(name string) (line string, err error) {
+	if err = ValidateName(name); err != nil {
+		return
+	}
+
+	line = "set -e " + name
+
+	return
+}
+
+//-------------------------------------------------------------------
+//  csh/tcsh
+//-------------------------------------------------------------------
+
+// Csh encodes for csh and tcsh.
+type Csh struct{}
+
+// QuoteCsh quotes the value between single quotes like in sh, but the history
+// substitution works even between single quotes, so the exclamation mark must be escaped.
+// A newline is only allowed in quotes when it is escaped with a backslash.
+func QuoteCsh(value string) string {
+	return "'" + strings.NewReplacer(`'`, `'\''`, "!", `\!`, "\n", "\\\n").Replace(value) + "'"
+}
+
+// Set returns a setenv line.
+func (Csh) Set(name string, value string) (line string, err error) {
+	if err = validate(name, value); err != nil {
+		return
+	}
+
+	line = fmt.Sprintf("setenv %s %s", name, QuoteCsh(value))
+
+	return
+}
+
+// Unset returns an unsetenv line.
+func (Csh) Unset(name string) (line string, err error) {
+	if err = ValidateName(name); err != nil {
+		return
+	}
+
+	line = "unsetenv " + name
+
+	return
+}
+
+//-------------------------------------------------------------------
+//  nushell
+//-------------------------------------------------------------------
+
+// Nu encodes for nushell.
+type Nu struct{}
+
+// QuoteNu creates a raw string from the value. Nothing is escaped in a raw string,
+// it ends with a single quote followed by the same number of hashes it started with.
+// So the number of hashes must be more than the longest hash sequence after a single quote in the value.
+func QuoteNu(value string) string {
+	hashes := 1
+	for i := strings.Index(value, "'"); i != -1; {
+		rest := value[i+1:]
+		count := len(rest) - len(strings.TrimLeft(rest, "#"))
+		if count >= hashes {
+			hashes = count + 1
+		}
+
+		next := strings.Index(rest, "'")
+		if next == -1 {
+			break
+		}
+		i += next + 1
+	}
+
+	return "r" + strings.Repeat("#", hashes) + "'" + value + "'" + strings.Repeat("#", hashes)
+}
+
+// Set returns an $env assignment.
+func (Nu) Set(name string, value string) (line string, err error) {
+	if err = validate(name, value); err != nil {
+		return
+	}
+
+	line = fmt.Sprintf("$env.%s = %s", name, QuoteNu(value))
+
+	return
+}
+
+// Unset returns a hide-env line.
+func (Nu) Unset(name string) (line string, err error) {
+	if err = ValidateName(name); err != nil {
+		return
+	}
+
+	line = "hide-env -i " + name
+
+	return
+}
+
+//-------------------------------------------------------------------
+//  elvish
+//-------------------------------------------------------------------
+
+// Elvish encodes for elvish.
+type Elvish struct{}
+
+// QuoteElvish quotes the value between single quotes. The only special character is
+// the single quote itself, which is escaped by doubling it.
+func QuoteElvish(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// Set returns a set-env line.
+func (Elvish) Set(name string, value string) (line string, err error) {
+	if err = validate(name, value); err != nil {
+		return
+	}
+
+	line = fmt.Sprintf("set-env %s %s", name, QuoteElvish(value))
+
+	return
+}
+
+// Unset returns an unset-env line.
+func (Elvish) Unset(name string) (line string, err error) {
+	if err = ValidateName(name); err != nil {
+		return
+	}
+
+	line = "unset-env " + name
+
+	return
+}
@@ -0,0 +1,271 @@
+package shell
+
+import (
+	"os/exec"
+	"testing"
+)
+
+// Marks the shells which reject the value.
+const rejected = "<rejected>"
+
+func TestSet(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  map[string]string // Shell name to the line.
+	}{
+		{
+			name:  "Plain",
+			value: "value",
+			want: map[string]string{
+				"sh":         `export A='value'`,
+				"cmd":        `SET A=value`,
+				"powershell": `$env:A='value'`,
+				"fish":       `set -gx A 'value'`,
+				"csh":        `setenv A 'value'`,
+				"nu":         `$env.A = r#'value'#`,
+				"elvish":     `set-env A 'value'`,
+			},
+		},
+		{
+			name:  "Empty",
+			value: "",
+			want: map[string]string{
+				"sh":         `export A=''`,
+				"cmd":        `SET A=`,
+				"powershell": `$env:A=''`,
+				"fish":       `set -gx A ''`,
+				"csh":        `setenv A ''`,
+				"nu":         `$env.A = r#''#`,
+				"elvish":     `set-env A ''`,
+			},
+		},
+		{
+			name:  "Quotes",
+			value: `it's "quoted"`,
+			want: map[string]string{
+				"sh":         `export A='it'\''s "quoted"'`,
+				"cmd":        `SET A=it's ^"quoted^"`,
+				"powershell": `$env:A='it''s "quoted"'`,
+				"fish":       `set -gx A 'it\'s "quoted"'`,
+				"csh":        `setenv A 'it'\''s "quoted"'`,
+				"nu":         `$env.A = r#'it's "quoted"'#`,
+				"elvish":     `set-env A 'it''s "quoted"'`,
+			},
+		},
+		{
+			name:  "TypographicQuote",
+			value: "it’s",
+			want: map[string]string{
+				"sh":         "export A='it’s'",
+				"cmd":        "SET A=it’s",
+				"powershell": "$env:A='it’’s'",
+				"fish":       "set -gx A 'it’s'",
+				"csh":        "setenv A 'it’s'",
+				"nu":         "$env.A = r#'it’s'#",
+				"elvish":     "set-env A 'it’s'",
+			},
+		},
+		{
+			name:  "Dollar",
+			value: "$HOME ${PATH} $(id)",
+			want: map[string]string{
+				"sh":         `export A='$HOME ${PATH} $(id)'`,
+				"cmd":        `SET A=$HOME ${PATH} $^(id^)`,
+				"powershell": `$env:A='$HOME ${PATH} $(id)'`,
+				"fish":       `set -gx A '$HOME ${PATH} $(id)'`,
+				"csh":        `setenv A '$HOME ${PATH} $(id)'`,
+				"nu":         `$env.A = r#'$HOME ${PATH} $(id)'#`,
+				"elvish":     `set-env A '$HOME ${PATH} $(id)'`,
+			},
+		},
+		{
+			name:  "Backticks",
+			value: "`id`",
+			want: map[string]string{
+				"sh":         "export A='`id`'",
+				"cmd":        "SET A=`id`",
+				"powershell": "$env:A='`id`'",
+				"fish":       "set -gx A '`id`'",
+				"csh":        "setenv A '`id`'",
+				"nu":         "$env.A = r#'`id`'#",
+				"elvish":     "set-env A '`id`'",
+			},
+		},
+		{
+			name:  "Percent",
+			value: "100% %PATH%",
+			want: map[string]string{
+				"sh":         `export A='100% %PATH%'`,
+				"cmd":        `SET A=100%% %%PATH%%`,
+				"powershell": `$env:A='100% %PATH%'`,
+				"fish":       `set -gx A '100% %PATH%'`,
+				"csh":        `setenv A '100% %PATH%'`,
+				"nu":         `$env.A = r#'100% %PATH%'#`,
+				"elvish":     `set-env A '100% %PATH%'`,
+			},
+		},
+		{
+			name:  "Exclamation",
+			value: "hi!!",
+			want: map[string]string{
+				"sh":         `export A='hi!!'`,
+				"cmd":        `SET A=hi!!`,
+				"powershell": `$env:A='hi!!'`,
+				"fish":       `set -gx A 'hi!!'`,
+				"csh":        `setenv A 'hi\!\!'`,
+				"nu":         `$env.A = r#'hi!!'#`,
+				"elvish":     `set-env A 'hi!!'`,
+			},
+		},
+		{
+			name:  "CmdSpecial",
+			value: `a^b&c|d<e>f`,
+			want: map[string]string{
+				"sh":         `export A='a^b&c|d<e>f'`,
+				"cmd":        `SET A=a^^b^&c^|d^<e^>f`,
+				"powershell": `$env:A='a^b&c|d<e>f'`,
+				"fish":       `set -gx A 'a^b&c|d<e>f'`,
+				"csh":        `setenv A 'a^b&c|d<e>f'`,
+				"nu":         `$env.A = r#'a^b&c|d<e>f'#`,
+				"elvish":     `set-env A 'a^b&c|d<e>f'`,
+			},
+		},
+		{
+			name:  "Backslash",
+			value: `C:\dir\`,
+			want: map[string]string{
+				"sh":         `export A='C:\dir\'`,
+				"cmd":        `SET A=C:\dir\`,
+				"powershell": `$env:A='C:\dir\'`,
+				"fish":       `set -gx A 'C:\\dir\\'`,
+				"csh":        `setenv A 'C:\dir\'`,
+				"nu":         `$env.A = r#'C:\dir\'#`,
+				"elvish":     `set-env A 'C:\dir\'`,
+			},
+		},
+		{
+			name:  "Hashes",
+			value: `a'#b'##c`,
+			want: map[string]string{
+				"sh":         `export A='a'\''#b'\''##c'`,
+				"cmd":        `SET A=a'#b'##c`,
+				"powershell": `$env:A='a''#b''##c'`,
+				"fish":       `set -gx A 'a\'#b\'##c'`,
+				"csh":        `setenv A 'a'\''#b'\''##c'`,
+				"nu":         `$env.A = r###'a'#b'##c'###`,
+				"elvish":     `set-env A 'a''#b''##c'`,
+			},
+		},
+		{
+			name:  "Newline",
+			value: "first\nsecond",
+			want: map[string]string{
+				"sh":         "export A='first\nsecond'",
+				"cmd":        rejected,
+				"powershell": "$env:A='first\nsecond'",
+				"fish":       "set -gx A 'first\nsecond'",
+				"csh":        "setenv A 'first\\\nsecond'",
+				"nu":         "$env.A = r#'first\nsecond'#",
+				"elvish":     "set-env A 'first\nsecond'",
+			},
+		},
+		{
+			name:  "NonUTF8",
+			value: "a\xff\xfe'\xc3b",
+			want: map[string]string{
+				"sh":         "export A='a\xff\xfe'\\''\xc3b'",
+				"cmd":        "SET A=a\xff\xfe'\xc3b",
+				"powershell": "$env:A='a\xff\xfe''\xc3b'",
+				"fish":       "set -gx A 'a\xff\xfe\\'\xc3b'",
+				"csh":        "setenv A 'a\xff\xfe'\\''\xc3b'",
+				"nu":         "$env.A = r#'a\xff\xfe'\xc3b'#",
+				"elvish":     "set-env A 'a\xff\xfe''\xc3b'",
+			},
+		},
+		{
+			name:  "NUL",
+			value: "a\x00b",
+			want: map[string]string{
+				"sh":         rejected,
+				"cmd":        rejected,
+				"powershell": rejected,
+				"fish":       rejected,
+				"csh":        rejected,
+				"nu":         rejected,
+				"elvish":     rejected,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		for shellName, want := range test.want {
+			t.Run(test.name+"/"+shellName, func(t *testing.T) {
+				generator, err := Lookup(shellName)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				line, err := generator.Encoder.Set("A", test.value)
+				if want == rejected {
+					if err == nil {
+						t.Errorf("set %q: %q, want an error", test.value, line)
+					}
+					return
+				}
+				if err != nil || line != want {
+					t.Errorf("set %q:\n got %q, %v\nwant %q", test.value, line, err, want)
+				}
+			})
+		}
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"A", true},
+		{"_a1", true},
+		{"PATH_2", true},
+		{"", false},
+		{"1A", false},
+		{"A-B", false},
+		{"A B", false},
+		{"Á", false},
+		{"A;id", false},
+	}
+
+	for _, test := range tests {
+		if err := ValidateName(test.name); (err == nil) != test.valid {
+			t.Errorf("validate %q: %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+// Runs the generated scripts with the POSIX shells on the machine, to check that the values round-trip.
+func TestShRoundTrip(t *testing.T) {
+	values := []string{
+		`it's "quoted"`, "$HOME ${PATH} $(id) `id`", "100% hi!!", "first\nsecond\n", "a\xff\xfe'\xc3b", `C:\dir\`, "",
+	}
+
+	for _, shellName := range []string{"sh", "bash", "dash", "zsh", "ksh"} {
+		path, err := exec.LookPath(shellName)
+		if err != nil {
+			continue
+		}
+
+		for _, value := range values {
+			line, err := Sh{}.Set("A", value)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			output, err := exec.Command(path, "-c", line+"\nprintf '%s' \"$A\"").Output()
+			if err != nil || string(output) != value {
+				t.Errorf("%v: %q, %v, want %q", shellName, output, err, value)
+			}
+		}
+	}
+}